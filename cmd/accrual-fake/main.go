@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gophermart/internal/accrual/accrualfake"
+	"gophermart/internal/money"
+)
+
+func main() {
+	var (
+		addr string
+		opts accrualfake.Options
+	)
+	flag.StringVar(&addr, "a", "localhost:8081", "HTTP listen address")
+	flag.DurationVar(&opts.Latency, "latency", 0, "delay added to every request")
+	flag.Float64Var(&opts.ErrorRate, "error-rate", 0, "fraction of order queries answered with 500")
+	flag.IntVar(&opts.RateLimit, "rate-limit", 0, "order queries allowed per minute, 0 disables the limit")
+	flag.DurationVar(&opts.RetryAfter, "retry-after", 0, "Retry-After sent with 429, defaults to the rest of the current window")
+	flag.DurationVar(&opts.RateWindow, "rate-window", time.Minute, "window the rate limit applies to")
+	flag.DurationVar(&opts.RegisteredFor, "registered-for", time.Second, "how long a new order stays REGISTERED")
+	flag.DurationVar(&opts.ProcessingFor, "processing-for", 2*time.Second, "how long an order stays PROCESSING before it is calculated")
+	flag.TextVar(&opts.AutoAccrual, "auto-accrual", money.Zero, "register unknown orders on their first query with this many points, 0 answers 204")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: addr, Handler: accrualfake.New(opts)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
+
+	log.Printf("fake accrual system listening on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("listen and serve: %v", err)
+	}
+}
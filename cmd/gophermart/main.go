@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"gophermart/internal/accrual"
 	"gophermart/internal/config"
 	"gophermart/internal/server"
 )
@@ -10,12 +18,90 @@ import (
 func main() {
 	cfg := config.Load()
 
-	srv, err := server.New(cfg)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var opts []server.Option
+	provider, err := newAccrualProvider(cfg)
+	if err != nil {
+		log.Fatalf("create accrual provider: %v", err)
+	}
+	if provider != nil {
+		opts = append(opts, server.WithAccrualProvider(provider))
+	}
+
+	srv, err := server.New(ctx, cfg, opts...)
 	if err != nil {
 		log.Fatalf("create server: %v", err)
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("listen and serve: %v", err)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	var serveErr error
+	select {
+	case serveErr = <-errCh:
+	case <-ctx.Done():
+		log.Printf("shutting down")
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	if serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) {
+		log.Fatalf("listen and serve: %v", serveErr)
 	}
 }
+
+// newAccrualProvider builds the provider from the static file or the accrual
+// system address, with routes in front of it when configured. It returns nil
+// when none is configured.
+func newAccrualProvider(cfg *config.Config) (accrual.Provider, error) {
+	var fallback accrual.Provider
+	switch {
+	case cfg.AccrualStaticFile != "":
+		p, err := accrual.LoadStaticProvider(cfg.AccrualStaticFile)
+		if err != nil {
+			return nil, err
+		}
+		fallback = p
+	case cfg.AccrualSystemAddr != "":
+		cl, err := newAccrualClient(cfg, cfg.AccrualSystemAddr)
+		if err != nil {
+			return nil, err
+		}
+		fallback = cl
+	}
+
+	if len(cfg.AccrualRoutes) == 0 {
+		return fallback, nil
+	}
+
+	routes := make([]accrual.Route, 0, len(cfg.AccrualRoutes))
+	for _, r := range cfg.AccrualRoutes {
+		prefix, addr, ok := strings.Cut(r, "=")
+		if !ok || prefix == "" || addr == "" {
+			return nil, fmt.Errorf("invalid accrual route %q, want prefix=url", r)
+		}
+		cl, err := newAccrualClient(cfg, addr)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, accrual.Route{Prefix: prefix, Provider: cl})
+	}
+	return accrual.NewRouter(routes, fallback), nil
+}
+
+func newAccrualClient(cfg *config.Config, addr string) (*accrual.Client, error) {
+	return accrual.NewWithOptions(addr, accrual.Options{
+		Retry:            accrual.RetryPolicy{Retries: cfg.AccrualRetries, Backoff: cfg.AccrualRetryBackoff},
+		BreakerThreshold: cfg.AccrualBreakerThreshold,
+		BreakerCooldown:  cfg.AccrualBreakerCooldown,
+	})
+}
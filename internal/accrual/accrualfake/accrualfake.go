@@ -0,0 +1,342 @@
+package accrualfake
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gophermart/internal/accrual"
+	"gophermart/internal/money"
+)
+
+var (
+	ErrRuleExists   = errors.New("reward rule already registered")
+	ErrOrderExists  = errors.New("order already registered")
+	ErrInvalidRule  = errors.New("invalid reward rule")
+	ErrInvalidOrder = errors.New("invalid order")
+)
+
+type RewardType string
+
+const (
+	RewardPercent RewardType = "%"
+	RewardPoints  RewardType = "pt"
+)
+
+// Rule rewards goods whose description contains Match.
+type Rule struct {
+	Match      string       `json:"match"`
+	Reward     money.Amount `json:"reward"`
+	RewardType RewardType   `json:"reward_type"`
+}
+
+type Good struct {
+	Description string       `json:"description"`
+	Price       money.Amount `json:"price"`
+}
+
+type Order struct {
+	Order string `json:"order"`
+	Goods []Good `json:"goods"`
+}
+
+type Options struct {
+	// Latency is added to every request.
+	Latency time.Duration
+	// ErrorRate is the fraction of order queries answered with 500.
+	ErrorRate float64
+	// RateLimit is the number of order queries allowed per minute, 0 for no
+	// limit. Further queries get 429.
+	RateLimit int
+	// RetryAfter is sent with 429; by default the rest of the current window.
+	RetryAfter time.Duration
+	// RateWindow is the window RateLimit applies to, a minute by default.
+	// Tests shorten it; the 429 body then advertises the equivalent limit per
+	// minute.
+	RateWindow time.Duration
+	// RegisteredFor and ProcessingFor are how long a new order stays in
+	// REGISTERED and then in PROCESSING before it is calculated.
+	RegisteredFor time.Duration
+	ProcessingFor time.Duration
+	// AutoAccrual registers unknown orders on their first query and rewards
+	// them with this many points; 0 answers 204 for them.
+	AutoAccrual money.Amount
+}
+
+// Server implements the accrual system protocol in memory. An order is
+// PROCESSED with the sum of its rewards when at least one of its goods
+// matches a rule, INVALID otherwise.
+type Server struct {
+	opts Options
+	mux  *http.ServeMux
+	now  func() time.Time
+
+	mu          sync.Mutex
+	rules       []Rule
+	orders      map[string]*order
+	windowStart time.Time
+	windowCount int
+}
+
+type order struct {
+	goods        []Good
+	fixed        *money.Amount
+	registeredAt time.Time
+	status       accrual.OrderStatus
+	accrual      *money.Amount
+}
+
+func New(opts Options) *Server {
+	s := &Server{
+		opts:   opts,
+		mux:    http.NewServeMux(),
+		now:    time.Now,
+		orders: map[string]*order{},
+	}
+	s.mux.HandleFunc("/api/orders/{number}", s.handleGetOrder)
+	s.mux.HandleFunc("/api/orders", s.handleRegisterOrder)
+	s.mux.HandleFunc("/api/goods", s.handleAddRule)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Latency > 0 {
+		select {
+		case <-time.After(s.opts.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) AddRule(rule Rule) error {
+	rule.Match = strings.TrimSpace(rule.Match)
+	if rule.Match == "" || rule.Reward.Sign() <= 0 || (rule.RewardType != RewardPercent && rule.RewardType != RewardPoints) {
+		return ErrInvalidRule
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.rules {
+		if strings.EqualFold(existing.Match, rule.Match) {
+			return ErrRuleExists
+		}
+	}
+	s.rules = append(s.rules, rule)
+	return nil
+}
+
+func (s *Server) RegisterOrder(o Order) error {
+	if !isValidOrderNumber(o.Order) || len(o.Goods) == 0 {
+		return ErrInvalidOrder
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.orders[o.Order]; ok {
+		return ErrOrderExists
+	}
+	s.orders[o.Order] = &order{goods: o.Goods, registeredAt: s.now()}
+	return nil
+}
+
+func (s *Server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	if retryAfter, limited := s.takeLocked(); limited {
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "No more than %d requests per minute allowed", s.perMinute())
+		return
+	}
+	if s.opts.ErrorRate > 0 && rand.Float64() < s.opts.ErrorRate {
+		s.mu.Unlock()
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	number := r.PathValue("number")
+	o, ok := s.orders[number]
+	if !ok && s.opts.AutoAccrual.Sign() > 0 && isValidOrderNumber(number) {
+		points := s.opts.AutoAccrual
+		o = &order{fixed: &points, registeredAt: s.now()}
+		s.orders[number] = o
+	}
+	if o == nil {
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	resp := accrual.OrderAccrual{Order: number}
+	resp.Status, resp.Accrual = s.statusLocked(o)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleRegisterOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var o Order
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	switch err := s.RegisterOrder(o); {
+	case errors.Is(err, ErrOrderExists):
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+	case err != nil:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (s *Server) handleAddRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var rule Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	switch err := s.AddRule(rule); {
+	case errors.Is(err, ErrRuleExists):
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+	case err != nil:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Server) perMinute() int {
+	if s.opts.RateWindow <= 0 {
+		return s.opts.RateLimit
+	}
+	return int(float64(s.opts.RateLimit) * float64(time.Minute) / float64(s.opts.RateWindow))
+}
+
+// takeLocked counts an order query against the current window and reports
+// how long to wait when it is over the limit.
+func (s *Server) takeLocked() (time.Duration, bool) {
+	if s.opts.RateLimit <= 0 {
+		return 0, false
+	}
+
+	window := s.opts.RateWindow
+	if window <= 0 {
+		window = time.Minute
+	}
+	now := s.now()
+	if now.Sub(s.windowStart) >= window {
+		s.windowStart, s.windowCount = now, 0
+	}
+	s.windowCount++
+	if s.windowCount <= s.opts.RateLimit {
+		return 0, false
+	}
+
+	if s.opts.RetryAfter > 0 {
+		return s.opts.RetryAfter, true
+	}
+	return max(s.windowStart.Add(window).Sub(now), time.Second), true
+}
+
+// statusLocked moves the order along REGISTERED → PROCESSING → final by its
+// age. The final result is kept so later rules do not change it.
+func (s *Server) statusLocked(o *order) (accrual.OrderStatus, *money.Amount) {
+	if o.status == accrual.StatusProcessed || o.status == accrual.StatusInvalid {
+		return o.status, o.accrual
+	}
+
+	age := s.now().Sub(o.registeredAt)
+	switch {
+	case age < s.opts.RegisteredFor:
+		return accrual.StatusRegistered, nil
+	case age < s.opts.RegisteredFor+s.opts.ProcessingFor:
+		return accrual.StatusProcessing, nil
+	}
+
+	if o.fixed != nil {
+		o.status, o.accrual = accrual.StatusProcessed, o.fixed
+		return o.status, o.accrual
+	}
+
+	var (
+		sum     money.Amount
+		matched bool
+		err     error
+	)
+	for _, g := range o.goods {
+		for _, rule := range s.rules {
+			if !strings.Contains(strings.ToLower(g.Description), strings.ToLower(rule.Match)) {
+				continue
+			}
+			matched = true
+			reward := rule.Reward
+			if rule.RewardType == RewardPercent {
+				reward = g.Price.Percent(rule.Reward)
+			}
+			if sum, err = sum.Add(reward); err != nil {
+				// No reward this large can be paid out.
+				o.status = accrual.StatusInvalid
+				return o.status, nil
+			}
+			break
+		}
+	}
+
+	if !matched {
+		o.status = accrual.StatusInvalid
+		return o.status, nil
+	}
+	o.status, o.accrual = accrual.StatusProcessed, &sum
+	return o.status, o.accrual
+}
+
+func isValidOrderNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	var sum int
+	double := false
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+		d := int(s[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
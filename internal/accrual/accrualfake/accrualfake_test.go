@@ -0,0 +1,143 @@
+package accrualfake
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gophermart/internal/accrual"
+	"gophermart/internal/money"
+)
+
+func newTestClient(t *testing.T, s *Server) *accrual.Client {
+	t.Helper()
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	cl, err := accrual.New(ts.URL)
+	if err != nil {
+		t.Fatalf("accrual.New() error = %v", err)
+	}
+	return cl
+}
+
+func TestServer_statusProgression(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	s := New(Options{RegisteredFor: time.Second, ProcessingFor: time.Second})
+	s.now = func() time.Time { return now }
+
+	if err := s.AddRule(Rule{Match: "Bork", Reward: money.FromInt(10), RewardType: RewardPercent}); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	if err := s.AddRule(Rule{Match: "mug", Reward: money.FromInt(5), RewardType: RewardPoints}); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	if err := s.RegisterOrder(Order{Order: "79927398713", Goods: []Good{
+		{Description: "Чайник Bork", Price: money.FromInt(7000)},
+		{Description: "Big mug", Price: money.FromInt(300)},
+	}}); err != nil {
+		t.Fatalf("RegisterOrder() error = %v", err)
+	}
+	if err := s.RegisterOrder(Order{Order: "2377225624", Goods: []Good{{Description: "Socks", Price: money.FromInt(100)}}}); err != nil {
+		t.Fatalf("RegisterOrder() error = %v", err)
+	}
+
+	cl := newTestClient(t, s)
+	steps := []struct {
+		at          time.Duration
+		number      string
+		wantStatus  accrual.OrderStatus
+		wantAccrual money.Amount
+	}{
+		{at: 0, number: "79927398713", wantStatus: accrual.StatusRegistered},
+		{at: 1500 * time.Millisecond, number: "79927398713", wantStatus: accrual.StatusProcessing},
+		{at: 2 * time.Second, number: "79927398713", wantStatus: accrual.StatusProcessed, wantAccrual: money.FromInt(705)},
+		{at: 2 * time.Second, number: "2377225624", wantStatus: accrual.StatusInvalid},
+	}
+	start := now
+	for _, step := range steps {
+		now = start.Add(step.at)
+		got, err := cl.GetOrderInfo(context.Background(), step.number)
+		if err != nil || got == nil {
+			t.Fatalf("GetOrderInfo(%s) at %v = %+v, %v", step.number, step.at, got, err)
+		}
+		if got.Status != step.wantStatus {
+			t.Errorf("GetOrderInfo(%s) at %v status = %s, want %s", step.number, step.at, got.Status, step.wantStatus)
+		}
+		if step.wantAccrual.Sign() != 0 && (got.Accrual == nil || *got.Accrual != step.wantAccrual) {
+			t.Errorf("GetOrderInfo(%s) accrual = %v, want %v", step.number, got.Accrual, step.wantAccrual)
+		}
+	}
+
+	if got, err := cl.GetOrderInfo(context.Background(), "12345678903"); got != nil || err != nil {
+		t.Errorf("GetOrderInfo() for unknown order = %+v, %v, want not registered", got, err)
+	}
+}
+
+func TestServer_rateLimit(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	s := New(Options{RateLimit: 2, AutoAccrual: money.FromInt(100)})
+	s.now = func() time.Time { return now }
+	cl := newTestClient(t, s)
+
+	for i := 0; i < 2; i++ {
+		if _, err := cl.GetOrderInfo(context.Background(), "79927398713"); err != nil {
+			t.Fatalf("GetOrderInfo() #%d error = %v", i+1, err)
+		}
+	}
+
+	now = now.Add(20 * time.Second)
+	_, err := cl.GetOrderInfo(context.Background(), "79927398713")
+	var rl *accrual.RateLimitError
+	if !errors.As(err, &rl) {
+		t.Fatalf("GetOrderInfo() over the limit error = %v, want RateLimitError", err)
+	}
+	if rl.RetryAfter != 40*time.Second || rl.Limit != 2 {
+		t.Errorf("RateLimitError = %+v, want RetryAfter 40s and Limit 2", rl)
+	}
+
+	now = now.Add(40 * time.Second)
+	if _, err := cl.GetOrderInfo(context.Background(), "79927398713"); err != nil {
+		t.Errorf("GetOrderInfo() in the next window error = %v", err)
+	}
+}
+
+func TestServer_errorInjection(t *testing.T) {
+	cl := newTestClient(t, New(Options{ErrorRate: 1, AutoAccrual: money.FromInt(100)}))
+
+	var se *accrual.StatusError
+	if _, err := cl.GetOrderInfo(context.Background(), "79927398713"); !errors.As(err, &se) || se.Code != http.StatusInternalServerError {
+		t.Errorf("GetOrderInfo() error = %v, want 500", err)
+	}
+}
+
+func TestServer_registration(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		wantStatusCode int
+	}{
+		{name: "rule", path: "/api/goods", body: `{"match": "Bork", "reward": 10, "reward_type": "%"}`, wantStatusCode: http.StatusOK},
+		{name: "duplicate rule", path: "/api/goods", body: `{"match": "bork", "reward": 5, "reward_type": "pt"}`, wantStatusCode: http.StatusConflict},
+		{name: "bad reward type", path: "/api/goods", body: `{"match": "Mug", "reward": 5, "reward_type": "x"}`, wantStatusCode: http.StatusBadRequest},
+		{name: "order", path: "/api/orders", body: `{"order": "79927398713", "goods": [{"description": "Чайник Bork", "price": 7000}]}`, wantStatusCode: http.StatusAccepted},
+		{name: "duplicate order", path: "/api/orders", body: `{"order": "79927398713", "goods": [{"description": "Mug", "price": 1}]}`, wantStatusCode: http.StatusConflict},
+		{name: "bad order number", path: "/api/orders", body: `{"order": "79927398710", "goods": [{"description": "Mug", "price": 1}]}`, wantStatusCode: http.StatusBadRequest},
+		{name: "malformed", path: "/api/orders", body: `{`, wantStatusCode: http.StatusBadRequest},
+	}
+
+	s := New(Options{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("POST %s status = %v, want %v", tt.path, w.Code, tt.wantStatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package accrual
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// halfOpenRetry is what callers are told to wait while the single half-open
+// probe is still in flight.
+const halfOpenRetry = time.Second
+
+// CircuitOpenError is returned without contacting the accrual system while the
+// breaker is open.
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("accrual system unavailable, circuit open, retry after %s", e.RetryAfter)
+}
+
+// Breaker opens after threshold consecutive failures and rejects calls for
+// cooldown. After that a single probe is let through: its success closes the
+// breaker, its failure opens it for another cooldown.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     BreakerState
+	failures  int
+	opens     int64
+	openedAt  time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+// BreakerStats is a snapshot of a Breaker for diagnostics.
+type BreakerStats struct {
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	Opens               int64        `json:"opens"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether a call may go out. Every allowed call must be followed
+// by Success, Failure or Abandon.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if wait := b.openedAt.Add(b.cooldown).Sub(b.now()); wait > 0 {
+			return &CircuitOpenError{RetryAfter: wait}
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			return &CircuitOpenError{RetryAfter: halfOpenRetry}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.state = BreakerClosed
+	b.probing = false
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		if b.state != BreakerOpen {
+			b.opens++
+		}
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+		b.probing = false
+	}
+}
+
+// Abandon ends a call that says nothing about the accrual system, e.g. one
+// cancelled by the caller, so a half-open breaker may send another probe.
+func (b *Breaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *Breaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st := BreakerStats{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		Opens:               b.opens,
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		st.OpenedAt = &openedAt
+	}
+	return st
+}
@@ -0,0 +1,65 @@
+package accrual
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	b := NewBreaker(2, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() below threshold error = %v", err)
+	}
+	b.Failure()
+
+	var open *CircuitOpenError
+	if err := b.Allow(); !errors.As(err, &open) || open.RetryAfter != 10*time.Second {
+		t.Fatalf("Allow() after threshold error = %v, want CircuitOpenError for 10s", err)
+	}
+	if st := b.Stats(); st.State != BreakerOpen || st.Opens != 1 || st.OpenedAt == nil {
+		t.Errorf("Stats() = %+v, want open", st)
+	}
+
+	now = now.Add(10 * time.Second)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() after cooldown error = %v, want a probe", err)
+	}
+	if err := b.Allow(); !errors.As(err, &open) {
+		t.Errorf("Allow() during probe error = %v, want CircuitOpenError", err)
+	}
+
+	b.Failure()
+	if st := b.Stats(); st.State != BreakerOpen || st.Opens != 2 {
+		t.Errorf("Stats() after failed probe = %+v, want open again", st)
+	}
+
+	now = now.Add(10 * time.Second)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() after second cooldown error = %v", err)
+	}
+	b.Success()
+	if st := b.Stats(); st.State != BreakerClosed || st.ConsecutiveFailures != 0 || st.OpenedAt != nil {
+		t.Errorf("Stats() after successful probe = %+v, want closed", st)
+	}
+}
+
+func TestBreaker_Abandon(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	b := NewBreaker(1, time.Second)
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	now = now.Add(time.Second)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() probe error = %v", err)
+	}
+	b.Abandon()
+	if err := b.Allow(); err != nil {
+		t.Errorf("Allow() after abandoned probe error = %v, want another probe", err)
+	}
+}
@@ -3,17 +3,51 @@ package accrual
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
 	"path"
+	"regexp"
 	"strconv"
+	"sync/atomic"
 	"time"
+
+	"gophermart/internal/money"
 )
 
 type Client struct {
 	baseURL *url.URL
 	client  *http.Client
+	retry   RetryPolicy
+	breaker *Breaker
+	retries atomic.Int64
+}
+
+// RetryPolicy retries requests that failed with a network error or a 5xx
+// status. The delay starts at Backoff and doubles up to MaxBackoff.
+type RetryPolicy struct {
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+type Options struct {
+	Retry RetryPolicy
+	// BreakerThreshold consecutive failed calls open the circuit for
+	// BreakerCooldown. 0 disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// ClientStats is a snapshot of a Client for health checks and metrics. For a
+// Router it adds up its routes, which are listed in Routes.
+type ClientStats struct {
+	Breaker *BreakerStats          `json:"breaker,omitempty"`
+	Retries int64                  `json:"retries"`
+	Routes  map[string]ClientStats `json:"routes,omitempty"`
 }
 
 type OrderStatus string
@@ -26,31 +60,148 @@ const (
 )
 
 type OrderAccrual struct {
-	Order   string      `json:"order"`
-	Status  OrderStatus `json:"status"`
-	Accrual *float64    `json:"accrual,omitempty"`
+	Order   string        `json:"order"`
+	Status  OrderStatus   `json:"status"`
+	Accrual *money.Amount `json:"accrual,omitempty"`
 }
 
+// RateLimitError is returned when the accrual system answers 429. Limit is the
+// number of requests per minute it advertised in the body, 0 if it did not.
 type RateLimitError struct {
 	RetryAfter time.Duration
+	Limit      int
 }
 
 func (e *RateLimitError) Error() string {
 	return fmt.Sprintf("rate limit exceeded, retry after %s", e.RetryAfter)
 }
 
+// StatusError is returned for statuses the accrual system is not documented
+// to answer with.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d from accrual system", e.Code)
+}
+
 func New(rawURL string) (*Client, error) {
+	return NewWithOptions(rawURL, Options{})
+}
+
+func NewWithOptions(rawURL string, opts Options) (*Client, error) {
 	u, err := url.Parse(rawURL)
 	if err != nil {
 		return nil, fmt.Errorf("parse accrual url: %w", err)
 	}
-	return &Client{
+	c := &Client{
 		baseURL: u,
 		client:  &http.Client{Timeout: 5 * time.Second},
-	}, nil
+		retry:   opts.Retry,
+	}
+	if opts.BreakerThreshold > 0 {
+		c.breaker = NewBreaker(opts.BreakerThreshold, opts.BreakerCooldown)
+	}
+	return c, nil
+}
+
+func (c *Client) Stats() ClientStats {
+	st := ClientStats{Retries: c.retries.Load()}
+	if c.breaker != nil {
+		bs := c.breaker.Stats()
+		st.Breaker = &bs
+	}
+	return st
 }
 
+// GetOrderInfo asks for the accrual of one order. Transient failures are
+// retried according to the retry policy, and a call that still fails counts
+// towards opening the breaker. 429 means the system is up and is not a
+// failure.
 func (c *Client) GetOrderInfo(ctx context.Context, number string) (*OrderAccrual, error) {
+	if c.breaker != nil {
+		if err := c.breaker.Allow(); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := c.getWithRetry(ctx, number)
+
+	if c.breaker != nil {
+		var rl *RateLimitError
+		switch {
+		case err == nil || errors.As(err, &rl):
+			c.breaker.Success()
+		case ctx.Err() != nil:
+			c.breaker.Abandon()
+		default:
+			c.breaker.Failure()
+		}
+	}
+	return info, err
+}
+
+func (c *Client) getWithRetry(ctx context.Context, number string) (*OrderAccrual, error) {
+	for attempt := 0; ; attempt++ {
+		info, err := c.getOrderInfo(ctx, number)
+		if err == nil || attempt >= c.retry.Retries || !retryable(ctx, err) {
+			return info, err
+		}
+
+		t := time.NewTimer(c.retry.delay(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, err
+		case <-t.C:
+		}
+		c.retries.Add(1)
+	}
+}
+
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500
+	}
+	var ne *networkError
+	return errors.As(err, &ne)
+}
+
+// delay returns the pause before retry attempt+1, randomized over its upper
+// half so callers failing together do not retry in lockstep.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	base, max := p.Backoff, p.MaxBackoff
+	if base <= 0 {
+		base = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+	d := base
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// networkError marks failures to get any response at all.
+type networkError struct {
+	err error
+}
+
+func (e *networkError) Error() string { return "do request: " + e.err.Error() }
+func (e *networkError) Unwrap() error { return e.err }
+
+func (c *Client) getOrderInfo(ctx context.Context, number string) (*OrderAccrual, error) {
 	u := *c.baseURL
 	u.Path = path.Join(c.baseURL.Path, "/api/orders", number)
 
@@ -61,7 +212,7 @@ func (c *Client) GetOrderInfo(ctx context.Context, number string) (*OrderAccrual
 
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("do request: %w", err)
+		return nil, &networkError{err: err}
 	}
 	defer resp.Body.Close()
 
@@ -76,9 +227,10 @@ func (c *Client) GetOrderInfo(ctx context.Context, number string) (*OrderAccrual
 		return nil, nil
 	case http.StatusTooManyRequests:
 		ra := parseRetryAfter(resp.Header.Get("Retry-After"))
-		return nil, &RateLimitError{RetryAfter: ra}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &RateLimitError{RetryAfter: ra, Limit: parseRateLimit(string(body))}
 	default:
-		return nil, fmt.Errorf("unexpected status code %d from accrual system", resp.StatusCode)
+		return nil, &StatusError{Code: resp.StatusCode}
 	}
 }
 
@@ -92,3 +244,19 @@ func parseRetryAfter(v string) time.Duration {
 	}
 	return time.Duration(sec) * time.Second
 }
+
+var rateLimitBody = regexp.MustCompile(`(?i)no more than (\d+) requests per minute`)
+
+// parseRateLimit extracts N from the "No more than N requests per minute
+// allowed" body the accrual system sends along with 429.
+func parseRateLimit(body string) int {
+	m := rateLimitBody.FindStringSubmatch(body)
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
@@ -2,10 +2,14 @@ package accrual
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"gophermart/internal/money"
 )
 
 func TestClient_GetOrderInfo(t *testing.T) {
@@ -17,6 +21,7 @@ func TestClient_GetOrderInfo(t *testing.T) {
 		wantAccrual   *OrderAccrual
 		wantErr       bool
 		wantRateLimit bool
+		wantLimit     int
 	}{
 		{
 			name:       "success processed order",
@@ -29,7 +34,7 @@ func TestClient_GetOrderInfo(t *testing.T) {
 			wantAccrual: &OrderAccrual{
 				Order:   "12345678903",
 				Status:  StatusProcessed,
-				Accrual: floatPtr(500.5),
+				Accrual: amountPtr("500.5"),
 			},
 			wantErr: false,
 		},
@@ -61,6 +66,16 @@ func TestClient_GetOrderInfo(t *testing.T) {
 			wantErr:       true,
 			wantRateLimit: true,
 		},
+		{
+			name:          "rate limit with advertised limit",
+			statusCode:    http.StatusTooManyRequests,
+			retryAfter:    "60",
+			responseBody:  "No more than 10 requests per minute allowed",
+			wantAccrual:   nil,
+			wantErr:       true,
+			wantRateLimit: true,
+			wantLimit:     10,
+		},
 		{
 			name:        "server error",
 			statusCode:  http.StatusInternalServerError,
@@ -104,6 +119,9 @@ func TestClient_GetOrderInfo(t *testing.T) {
 				if rateLimitErr.RetryAfter != 60*time.Second {
 					t.Errorf("GetOrderInfo() RetryAfter = %v, want %v", rateLimitErr.RetryAfter, 60*time.Second)
 				}
+				if rateLimitErr.Limit != tt.wantLimit {
+					t.Errorf("GetOrderInfo() Limit = %v, want %v", rateLimitErr.Limit, tt.wantLimit)
+				}
 				return
 			}
 
@@ -179,8 +197,9 @@ func TestRateLimitError_Error(t *testing.T) {
 	}
 }
 
-func floatPtr(f float64) *float64 {
-	return &f
+func amountPtr(s string) *money.Amount {
+	a := money.MustParse(s)
+	return &a
 }
 
 func contains(s, substr string) bool {
@@ -197,3 +216,78 @@ func containsMiddle(s, substr string) bool {
 	}
 	return false
 }
+
+func TestClient_GetOrderInfo_retry(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		retries     int
+		wantErr     bool
+		wantCalls   int32
+		wantRetries int64
+	}{
+		{name: "recovers after 5xx", statuses: []int{500, 503, 204}, retries: 2, wantCalls: 3, wantRetries: 2},
+		{name: "gives up", statuses: []int{500, 500, 500}, retries: 1, wantErr: true, wantCalls: 2, wantRetries: 1},
+		{name: "4xx is not retried", statuses: []int{404, 204}, retries: 2, wantErr: true, wantCalls: 1},
+		{name: "429 is not retried", statuses: []int{429, 204}, retries: 2, wantErr: true, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := calls.Add(1)
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer server.Close()
+
+			client, err := NewWithOptions(server.URL, Options{Retry: RetryPolicy{Retries: tt.retries, Backoff: time.Millisecond}})
+			if err != nil {
+				t.Fatalf("NewWithOptions() error = %v", err)
+			}
+
+			_, err = client.GetOrderInfo(context.Background(), "12345678903")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetOrderInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("requests = %d, want %d", got, tt.wantCalls)
+			}
+			if got := client.Stats().Retries; got != tt.wantRetries {
+				t.Errorf("Stats().Retries = %d, want %d", got, tt.wantRetries)
+			}
+		})
+	}
+}
+
+func TestClient_GetOrderInfo_breaker(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client, err := NewWithOptions(server.URL, Options{BreakerThreshold: 2, BreakerCooldown: time.Minute})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		var se *StatusError
+		if _, err := client.GetOrderInfo(context.Background(), "12345678903"); !errors.As(err, &se) {
+			t.Fatalf("GetOrderInfo() #%d error = %v, want StatusError", i+1, err)
+		}
+	}
+
+	var open *CircuitOpenError
+	if _, err := client.GetOrderInfo(context.Background(), "12345678903"); !errors.As(err, &open) {
+		t.Fatalf("GetOrderInfo() with open breaker error = %v, want CircuitOpenError", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("requests = %d, want 2", got)
+	}
+	if st := client.Stats(); st.Breaker == nil || st.Breaker.State != BreakerOpen {
+		t.Errorf("Stats() = %+v, want open breaker", st)
+	}
+}
@@ -0,0 +1,316 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limiter wraps a Provider with a token bucket shared by all callers. It pauses
+// every caller when the accrual system answers 429 and switches to the limit
+// the system advertised in the response body. With a Coordinator the bucket
+// and the pause are shared by all instances instead of kept in memory. An open
+// circuit breaker pauses the callers of this instance until its cooldown ends.
+//
+// When the provider routes orders to several accrual systems, as a Router
+// does, each route has a bucket, pause and breaker cooldown of its own, so a
+// system that is rate limited or down does not hold up the others.
+type Limiter struct {
+	provider Provider
+	coord    Coordinator
+
+	mu        sync.Mutex
+	perMinute int
+	burst     int
+	routes    map[string]*routeLimit
+	now       func() time.Time
+}
+
+// routeLimit is what a Limiter keeps for one route.
+type routeLimit struct {
+	perMinute   int
+	learned     bool
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	openUntil   time.Time
+}
+
+// LimiterState is a snapshot of a Limiter for diagnostics. The top level
+// fields describe DefaultRoute; Routes has every other route used so far.
+type LimiterState struct {
+	PerMinute        int                     `json:"per_minute"`
+	Burst            int                     `json:"burst"`
+	Learned          bool                    `json:"learned"`
+	Tokens           float64                 `json:"tokens"`
+	PausedUntil      *time.Time              `json:"paused_until,omitempty"`
+	CircuitOpenUntil *time.Time              `json:"circuit_open_until,omitempty"`
+	Shared           bool                    `json:"shared"`
+	Routes           map[string]LimiterState `json:"routes,omitempty"`
+}
+
+// Coordinator keeps the limiter state somewhere all instances can see it,
+// separately for every route.
+type Coordinator interface {
+	// Reserve takes one token from the shared bucket of route.
+	Reserve(ctx context.Context, route string, perMinute, burst int) (Reservation, error)
+	// Pause stops all instances from calling route for d and records the
+	// advertised limit, perMinute is 0 when none was advertised.
+	Pause(ctx context.Context, route string, d time.Duration, perMinute int) error
+}
+
+// Reservation is the outcome of Coordinator.Reserve.
+type Reservation struct {
+	// Delay is how long the caller has to wait before using its token,
+	// including any pause.
+	Delay time.Duration
+	// Paused is the remaining shared pause.
+	Paused time.Duration
+	// PerMinute is the limit learned by any instance, 0 if none yet.
+	PerMinute int
+	// Tokens is left in the shared bucket, negative while callers queue.
+	Tokens float64
+}
+
+// NewLimiter limits provider to perMinute requests with bursts of up to burst.
+// perMinute 0 leaves requests unlimited until the accrual system advertises
+// a limit.
+func NewLimiter(provider Provider, perMinute, burst int, coord Coordinator) *Limiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &Limiter{
+		provider:  provider,
+		coord:     coord,
+		perMinute: perMinute,
+		burst:     burst,
+		routes:    map[string]*routeLimit{},
+		now:       time.Now,
+	}
+}
+
+func (l *Limiter) GetOrderInfo(ctx context.Context, number string) (*OrderAccrual, error) {
+	route := routeOf(l.provider, number)
+	if err := l.waitCircuit(ctx, route); err != nil {
+		return nil, err
+	}
+	if err := l.Wait(ctx, route); err != nil {
+		return nil, err
+	}
+
+	info, err := l.provider.GetOrderInfo(ctx, number)
+	var (
+		rl   *RateLimitError
+		open *CircuitOpenError
+	)
+	switch {
+	case errors.As(err, &rl):
+		l.throttle(ctx, route, rl)
+	case errors.As(err, &open):
+		l.mu.Lock()
+		r := l.routeLocked(route)
+		if until := l.now().Add(open.RetryAfter); until.After(r.openUntil) {
+			r.openUntil = until
+		}
+		l.mu.Unlock()
+	}
+	return info, err
+}
+
+// Wait blocks until the caller may send one request to route. When ctx
+// expires before that it returns a RateLimitError right away instead of
+// sleeping in vain.
+func (l *Limiter) Wait(ctx context.Context, route string) error {
+	d := l.reserve(ctx, route)
+	if d <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && l.now().Add(d).After(deadline) {
+		return &RateLimitError{RetryAfter: d}
+	}
+	return sleep(ctx, d)
+}
+
+// waitCircuit blocks while the breaker of route is open. Like Wait it returns
+// right away when ctx expires before the cooldown ends. No token is taken, so
+// callers of other routes are not held up.
+func (l *Limiter) waitCircuit(ctx context.Context, route string) error {
+	l.mu.Lock()
+	d := l.routeLocked(route).openUntil.Sub(l.now())
+	l.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && l.now().Add(d).After(deadline) {
+		return &CircuitOpenError{RetryAfter: d}
+	}
+	return sleep(ctx, d)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (l *Limiter) State() LimiterState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st := l.stateLocked(l.routeLocked(DefaultRoute))
+	names := make([]string, 0, len(l.routes))
+	for name := range l.routes {
+		if name != DefaultRoute {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if st.Routes == nil {
+			st.Routes = map[string]LimiterState{}
+		}
+		st.Routes[name] = l.stateLocked(l.routes[name])
+	}
+	return st
+}
+
+func (l *Limiter) stateLocked(r *routeLimit) LimiterState {
+	now := l.now()
+	st := LimiterState{
+		PerMinute: r.perMinute,
+		Burst:     l.effectiveBurst(r.perMinute),
+		Learned:   r.learned,
+		Tokens:    r.tokens,
+		Shared:    l.coord != nil,
+	}
+	if r.pausedUntil.After(now) {
+		until := r.pausedUntil
+		st.PausedUntil = &until
+	}
+	if r.openUntil.After(now) {
+		until := r.openUntil
+		st.CircuitOpenUntil = &until
+	}
+	return st
+}
+
+// routeLocked returns the state of route, starting it with a full bucket the
+// first time the route is used.
+func (l *Limiter) routeLocked(route string) *routeLimit {
+	r, ok := l.routes[route]
+	if !ok {
+		r = &routeLimit{perMinute: l.perMinute, tokens: float64(l.burst)}
+		l.routes[route] = r
+	}
+	return r
+}
+
+func (l *Limiter) reserve(ctx context.Context, route string) time.Duration {
+	if l.coord != nil {
+		l.mu.Lock()
+		r := l.routeLocked(route)
+		perMinute, burst := r.perMinute, l.effectiveBurst(r.perMinute)
+		l.mu.Unlock()
+
+		res, err := l.coord.Reserve(ctx, route, perMinute, burst)
+		if err == nil {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if res.PerMinute > 0 {
+				r.perMinute, r.learned = res.PerMinute, true
+			}
+			if until := l.now().Add(res.Paused); res.Paused > 0 && until.After(r.pausedUntil) {
+				r.pausedUntil = until
+			}
+			r.tokens = res.Tokens
+			// A pause this instance saw before the others still holds.
+			if local := r.pausedUntil.Sub(l.now()); local > res.Delay {
+				return local
+			}
+			return res.Delay
+		}
+		log.Printf("accrual: shared rate limit unavailable, using local limit: %v", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reserveLocked(l.routeLocked(route))
+}
+
+// reserveLocked takes a token even when the bucket is empty; the debt is
+// what the caller has to wait. Nothing refills during a pause, so callers
+// queued behind it are still spread out once it ends.
+func (l *Limiter) reserveLocked(r *routeLimit) time.Duration {
+	now := l.now()
+	start := now
+	if r.pausedUntil.After(start) {
+		start = r.pausedUntil
+	}
+
+	if r.perMinute <= 0 {
+		return start.Sub(now)
+	}
+
+	rate := float64(r.perMinute) / 60
+	burst := float64(l.effectiveBurst(r.perMinute))
+	if start.After(r.last) {
+		if !r.last.IsZero() {
+			r.tokens += start.Sub(r.last).Seconds() * rate
+		}
+		r.last = start
+	}
+	if r.tokens > burst {
+		r.tokens = burst
+	}
+	r.tokens--
+
+	wait := start.Sub(now)
+	if r.tokens < 0 {
+		wait += time.Duration(-r.tokens / rate * float64(time.Second))
+	}
+	return wait
+}
+
+// throttle pauses all callers of route for the advertised Retry-After and
+// adopts the advertised limit. The bucket is emptied so requests resume one
+// at a time.
+func (l *Limiter) throttle(ctx context.Context, route string, rl *RateLimitError) {
+	l.mu.Lock()
+	r := l.routeLocked(route)
+	if rl.Limit > 0 {
+		r.perMinute, r.learned = rl.Limit, true
+	}
+	l.pauseLocked(r, rl.RetryAfter)
+	l.mu.Unlock()
+
+	if l.coord != nil {
+		if err := l.coord.Pause(ctx, route, rl.RetryAfter, rl.Limit); err != nil {
+			log.Printf("accrual: share rate limit pause: %v", err)
+		}
+	}
+}
+
+func (l *Limiter) pauseLocked(r *routeLimit, d time.Duration) {
+	if until := l.now().Add(d); until.After(r.pausedUntil) {
+		r.pausedUntil = until
+	}
+	if r.tokens > 0 {
+		r.tokens = 0
+	}
+	r.last = r.pausedUntil
+}
+
+func (l *Limiter) effectiveBurst(perMinute int) int {
+	if perMinute > 0 && l.burst > perMinute {
+		return perMinute
+	}
+	return l.burst
+}
@@ -0,0 +1,273 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiter_reserveLocked(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := NewLimiter(nil, 60, 2, nil)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if d := l.reserveLocked(l.routeLocked(DefaultRoute)); d != 0 {
+			t.Fatalf("reserveLocked() #%d = %v, want 0 within burst", i+1, d)
+		}
+	}
+	if d := l.reserveLocked(l.routeLocked(DefaultRoute)); d != time.Second {
+		t.Errorf("reserveLocked() after burst = %v, want %v", d, time.Second)
+	}
+	if d := l.reserveLocked(l.routeLocked(DefaultRoute)); d != 2*time.Second {
+		t.Errorf("reserveLocked() queued = %v, want %v", d, 2*time.Second)
+	}
+
+	now = now.Add(time.Minute)
+	if d := l.reserveLocked(l.routeLocked(DefaultRoute)); d != 0 {
+		t.Errorf("reserveLocked() after refill = %v, want 0", d)
+	}
+}
+
+func TestLimiter_unlimitedUntilLearned(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := NewLimiter(nil, 0, 5, nil)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		if d := l.reserveLocked(l.routeLocked(DefaultRoute)); d != 0 {
+			t.Fatalf("reserveLocked() without a limit = %v, want 0", d)
+		}
+	}
+
+	l.throttle(context.Background(), DefaultRoute, &RateLimitError{RetryAfter: 10 * time.Second, Limit: 30})
+
+	st := l.State()
+	if st.PerMinute != 30 || !st.Learned || st.PausedUntil == nil || !st.PausedUntil.Equal(now.Add(10*time.Second)) {
+		t.Fatalf("State() after 429 = %+v", st)
+	}
+
+	// Nothing refills during the pause, so the first caller after it waits
+	// for one token at the learned rate.
+	if d := l.reserveLocked(l.routeLocked(DefaultRoute)); d != 12*time.Second {
+		t.Errorf("reserveLocked() after 429 = %v, want %v", d, 12*time.Second)
+	}
+	if d := l.reserveLocked(l.routeLocked(DefaultRoute)); d != 14*time.Second {
+		t.Errorf("reserveLocked() queued after 429 = %v, want %v", d, 14*time.Second)
+	}
+}
+
+func TestLimiter_throttleKeepsLongestPause(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := NewLimiter(nil, 0, 1, nil)
+	l.now = func() time.Time { return now }
+
+	l.throttle(context.Background(), DefaultRoute, &RateLimitError{RetryAfter: time.Minute})
+	l.throttle(context.Background(), DefaultRoute, &RateLimitError{RetryAfter: time.Second})
+
+	if st := l.State(); st.PausedUntil == nil || !st.PausedUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("State().PausedUntil = %v, want the longer pause to win", st.PausedUntil)
+	}
+}
+
+func TestLimiter_throttleKeepsRoutesApart(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := NewLimiter(nil, 60, 1, nil)
+	l.now = func() time.Time { return now }
+
+	l.throttle(context.Background(), "799", &RateLimitError{RetryAfter: time.Minute, Limit: 30})
+
+	if d := l.reserveLocked(l.routeLocked(DefaultRoute)); d != 0 {
+		t.Errorf("reserveLocked() on the default route = %v, want 0", d)
+	}
+	st := l.State()
+	if st.PausedUntil != nil || st.PerMinute != 60 {
+		t.Errorf("State() = %+v, want the default route untouched", st)
+	}
+	if rs := st.Routes["799"]; rs.PausedUntil == nil || !rs.PausedUntil.Equal(now.Add(time.Minute)) || rs.PerMinute != 30 {
+		t.Errorf("State().Routes[799] = %+v, want paused with the advertised limit", rs)
+	}
+}
+
+func TestLimiter_WaitDeadline(t *testing.T) {
+	l := NewLimiter(nil, 0, 1, nil)
+	l.throttle(context.Background(), DefaultRoute, &RateLimitError{RetryAfter: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err := l.Wait(ctx, DefaultRoute)
+	var rl *RateLimitError
+	if !errors.As(err, &rl) {
+		t.Fatalf("Wait() error = %v, want RateLimitError", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("Wait() slept although the pause outlasts the deadline")
+	}
+}
+
+func TestLimiter_GetOrderInfo_pausesAllCallers(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte("No more than 600 requests per minute allowed"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	cl, err := New(ts.URL)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	l := NewLimiter(cl, 0, 1, nil)
+
+	var rl *RateLimitError
+	if _, err := l.GetOrderInfo(context.Background(), "79927398713"); !errors.As(err, &rl) {
+		t.Fatalf("GetOrderInfo() error = %v, want RateLimitError", err)
+	}
+
+	start := time.Now()
+	if _, err := l.GetOrderInfo(context.Background(), "79927398713"); err != nil {
+		t.Fatalf("GetOrderInfo() after pause error = %v", err)
+	}
+	if waited := time.Since(start); waited < 900*time.Millisecond {
+		t.Errorf("GetOrderInfo() after %v, want to honour Retry-After", waited)
+	}
+	if st := l.State(); st.PerMinute != 600 || !st.Learned {
+		t.Errorf("State() = %+v, want the advertised limit", st)
+	}
+}
+
+type fakeCoordinator struct {
+	reservation Reservation
+	err         error
+	paused      time.Duration
+	perMinute   int
+}
+
+func (c *fakeCoordinator) Reserve(ctx context.Context, route string, perMinute, burst int) (Reservation, error) {
+	return c.reservation, c.err
+}
+
+func (c *fakeCoordinator) Pause(ctx context.Context, route string, d time.Duration, perMinute int) error {
+	c.paused, c.perMinute = d, perMinute
+	return c.err
+}
+
+func TestLimiter_coordinated(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	coord := &fakeCoordinator{reservation: Reservation{Delay: 3 * time.Second, Paused: 2 * time.Second, PerMinute: 60, Tokens: -1}}
+	l := NewLimiter(nil, 0, 5, coord)
+	l.now = func() time.Time { return now }
+
+	if d := l.reserve(context.Background(), DefaultRoute); d != 3*time.Second {
+		t.Errorf("reserve() = %v, want the shared delay", d)
+	}
+	st := l.State()
+	if !st.Shared || st.PerMinute != 60 || st.Tokens != -1 || st.PausedUntil == nil || !st.PausedUntil.Equal(now.Add(2*time.Second)) {
+		t.Errorf("State() = %+v, want the shared state", st)
+	}
+
+	l.throttle(context.Background(), DefaultRoute, &RateLimitError{RetryAfter: time.Minute, Limit: 10})
+	if coord.paused != time.Minute || coord.perMinute != 10 {
+		t.Errorf("Pause() got (%v, %d), want (1m, 10)", coord.paused, coord.perMinute)
+	}
+
+	coord.err = errors.New("database is down")
+	if d := l.reserve(context.Background(), DefaultRoute); d <= 0 {
+		t.Errorf("reserve() with coordinator down = %v, want the local pause", d)
+	}
+}
+
+func TestLimiter_GetOrderInfo_openCircuitPauses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	cl, err := NewWithOptions(ts.URL, Options{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	l := NewLimiter(cl, 0, 1, nil)
+
+	_, _ = l.GetOrderInfo(context.Background(), "79927398713")
+	var open *CircuitOpenError
+	if _, err := l.GetOrderInfo(context.Background(), "79927398713"); !errors.As(err, &open) {
+		t.Fatalf("GetOrderInfo() error = %v, want CircuitOpenError", err)
+	}
+
+	st := l.State()
+	if until := st.CircuitOpenUntil; until == nil || time.Until(*until) < 50*time.Second {
+		t.Errorf("State().CircuitOpenUntil = %v, want the breaker cooldown", st.CircuitOpenUntil)
+	}
+	if st.PausedUntil != nil {
+		t.Errorf("State().PausedUntil = %v, want no rate limit pause", st.PausedUntil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := l.GetOrderInfo(ctx, "79927398713"); !errors.As(err, &open) {
+		t.Fatalf("GetOrderInfo() during cooldown error = %v, want CircuitOpenError", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("GetOrderInfo() slept although the cooldown outlasts the deadline")
+	}
+}
+
+func TestLimiter_GetOrderInfo_openCircuitPausesOnlyItsRoute(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	var upCalls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upCalls.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer up.Close()
+
+	downClient, err := NewWithOptions(down.URL, Options{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	upClient, err := New(up.URL)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	l := NewLimiter(NewRouter([]Route{{Prefix: "7", Provider: downClient}}, upClient), 0, 1, nil)
+
+	_, _ = l.GetOrderInfo(context.Background(), "79927398713")
+	var open *CircuitOpenError
+	if _, err := l.GetOrderInfo(context.Background(), "79927398713"); !errors.As(err, &open) {
+		t.Fatalf("GetOrderInfo() error = %v, want CircuitOpenError", err)
+	}
+
+	start := time.Now()
+	if _, err := l.GetOrderInfo(context.Background(), "2377225624"); err != nil {
+		t.Fatalf("GetOrderInfo() on the other route error = %v", err)
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("GetOrderInfo() on the other route waited %v for the open breaker", waited)
+	}
+	if got := upCalls.Load(); got != 1 {
+		t.Errorf("calls to the other route = %d, want 1", got)
+	}
+	st := l.State()
+	if st.Routes["7"].CircuitOpenUntil == nil {
+		t.Errorf("State().Routes = %+v, want route 7 waiting for its breaker", st.Routes)
+	}
+	if st.CircuitOpenUntil != nil {
+		t.Errorf("State().CircuitOpenUntil = %v, want no cooldown on the default route", st.CircuitOpenUntil)
+	}
+}
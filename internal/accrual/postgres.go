@@ -0,0 +1,103 @@
+package accrual
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PostgresCoordinator shares the limiter between instances through the row of
+// each route in accrual_rate_limit. Every reservation is one UPDATE, so the
+// row lock serializes instances and the database clock is the only one that
+// matters. The row of a route is added the first time the route is used.
+type PostgresCoordinator struct {
+	db *sql.DB
+}
+
+func NewPostgresCoordinator(db *sql.DB) *PostgresCoordinator {
+	return &PostgresCoordinator{db: db}
+}
+
+func (c *PostgresCoordinator) Reserve(ctx context.Context, route string, perMinute, burst int) (Reservation, error) {
+	r, err := c.reserve(ctx, route, perMinute, burst)
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := c.addRoute(ctx, route); err != nil {
+			return Reservation{}, err
+		}
+		r, err = c.reserve(ctx, route, perMinute, burst)
+	}
+	return r, err
+}
+
+func (c *PostgresCoordinator) reserve(ctx context.Context, route string, perMinute, burst int) (Reservation, error) {
+	var (
+		r       Reservation
+		rate    int
+		learned sql.NullInt64
+		paused  float64
+	)
+	err := c.db.QueryRowContext(
+		ctx,
+		`UPDATE accrual_rate_limit
+		 SET tokens = CASE WHEN COALESCE(per_minute, $1::int) > 0
+		         THEN LEAST($2::float8,
+		                    tokens + GREATEST(EXTRACT(EPOCH FROM GREATEST(now(), paused_until) - updated_at)::float8, 0)
+		                             * COALESCE(per_minute, $1::int) / 60.0) - 1
+		         ELSE tokens END,
+		     updated_at = GREATEST(updated_at, now(), paused_until)
+		 WHERE route = $3
+		 RETURNING tokens, per_minute, COALESCE(per_minute, $1::int),
+		           EXTRACT(EPOCH FROM GREATEST(paused_until - now(), interval '0'))::float8`,
+		perMinute, burst, route,
+	).Scan(&r.Tokens, &learned, &rate, &paused)
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	r.PerMinute = int(learned.Int64)
+	r.Paused = time.Duration(paused * float64(time.Second))
+	r.Delay = r.Paused
+	if rate > 0 && r.Tokens < 0 {
+		r.Delay += time.Duration(-r.Tokens / (float64(rate) / 60) * float64(time.Second))
+	}
+	return r, nil
+}
+
+func (c *PostgresCoordinator) Pause(ctx context.Context, route string, d time.Duration, perMinute int) error {
+	paused, err := c.pause(ctx, route, d, perMinute)
+	if err == nil && !paused {
+		if err := c.addRoute(ctx, route); err != nil {
+			return err
+		}
+		_, err = c.pause(ctx, route, d, perMinute)
+	}
+	return err
+}
+
+func (c *PostgresCoordinator) pause(ctx context.Context, route string, d time.Duration, perMinute int) (bool, error) {
+	res, err := c.db.ExecContext(
+		ctx,
+		`UPDATE accrual_rate_limit
+		 SET paused_until = GREATEST(paused_until, now() + make_interval(secs => $1)),
+		     updated_at = GREATEST(paused_until, now() + make_interval(secs => $1)),
+		     per_minute = COALESCE(NULLIF($2::int, 0), per_minute),
+		     tokens = LEAST(tokens, 0)
+		 WHERE route = $3`,
+		d.Seconds(), perMinute, route,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (c *PostgresCoordinator) addRoute(ctx context.Context, route string) error {
+	_, err := c.db.ExecContext(
+		ctx,
+		`INSERT INTO accrual_rate_limit (route) VALUES ($1) ON CONFLICT DO NOTHING`,
+		route,
+	)
+	return err
+}
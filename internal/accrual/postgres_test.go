@@ -0,0 +1,94 @@
+package accrual
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPostgresCoordinator_Reserve(t *testing.T) {
+	tests := []struct {
+		name      string
+		row       []driver.Value
+		wantDelay time.Duration
+		wantLimit int
+	}{
+		{name: "token available", row: []driver.Value{2.0, nil, 60, 0.0}},
+		{name: "queued behind others", row: []driver.Value{-2.0, nil, 60, 0.0}, wantDelay: 2 * time.Second},
+		{name: "paused with learned limit", row: []driver.Value{-1.0, 30, 30, 5.0}, wantDelay: 7 * time.Second, wantLimit: 30},
+		{name: "unlimited", row: []driver.Value{-5.0, nil, 0, 0.0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery(`UPDATE accrual_rate_limit(.|\n)*WHERE route = \$3(.|\n)*RETURNING tokens, per_minute`).
+				WithArgs(60, 10, DefaultRoute).
+				WillReturnRows(sqlmock.NewRows([]string{"tokens", "per_minute", "rate", "paused"}).AddRow(tt.row...))
+
+			r, err := NewPostgresCoordinator(db).Reserve(context.Background(), DefaultRoute, 60, 10)
+			if err != nil {
+				t.Fatalf("Reserve() error = %v", err)
+			}
+			if r.Delay != tt.wantDelay || r.PerMinute != tt.wantLimit {
+				t.Errorf("Reserve() = %+v, want delay %v and limit %d", r, tt.wantDelay, tt.wantLimit)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestPostgresCoordinator_newRoute(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`UPDATE accrual_rate_limit`).
+		WithArgs(60, 10, "799").
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "per_minute", "rate", "paused"}))
+	mock.ExpectExec(`INSERT INTO accrual_rate_limit \(route\) VALUES \(\$1\) ON CONFLICT DO NOTHING`).
+		WithArgs("799").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`UPDATE accrual_rate_limit`).
+		WithArgs(60, 10, "799").
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "per_minute", "rate", "paused"}).AddRow(-1.0, nil, 60, 0.0))
+
+	mock.ExpectExec(`UPDATE accrual_rate_limit\s+SET paused_until`).
+		WithArgs(float64(30), 0, "42").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO accrual_rate_limit`).
+		WithArgs("42").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE accrual_rate_limit\s+SET paused_until`).
+		WithArgs(float64(30), 0, "42").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	c := NewPostgresCoordinator(db)
+	r, err := c.Reserve(context.Background(), "799", 60, 10)
+	if err != nil {
+		t.Fatalf("Reserve() error = %v", err)
+	}
+	if r.Delay != time.Second {
+		t.Errorf("Reserve() delay = %v, want %v", r.Delay, time.Second)
+	}
+	if err := c.Pause(context.Background(), "42", 30*time.Second, 0); err != nil {
+		t.Fatalf("Pause() error = %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package accrual
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Provider answers accrual queries for orders. It returns nil info when the
+// order is not registered, like the accrual system's 204.
+type Provider interface {
+	GetOrderInfo(ctx context.Context, number string) (*OrderAccrual, error)
+}
+
+// Route sends order numbers starting with Prefix to Provider.
+type Route struct {
+	Prefix   string
+	Provider Provider
+}
+
+// Router picks the provider of the longest matching prefix and falls back to
+// fallback for numbers no route matches.
+type Router struct {
+	routes   []Route
+	fallback Provider
+}
+
+func NewRouter(routes []Route, fallback Provider) *Router {
+	sorted := append([]Route(nil), routes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+	return &Router{routes: sorted, fallback: fallback}
+}
+
+// DefaultRoute names the fallback provider of a Router, or the only provider
+// when there are no routes, in limiter state and statistics.
+const DefaultRoute = "default"
+
+// Stats adds up the statistics of the route providers that keep them, such
+// as *Client, and lists them by route. The breaker state is the worst of the
+// routes, so one route being down shows at the top level.
+func (r *Router) Stats() ClientStats {
+	var st ClientStats
+	add := func(route string, p Provider) {
+		sp, ok := p.(interface{ Stats() ClientStats })
+		if !ok {
+			return
+		}
+		rs := sp.Stats()
+		if st.Routes == nil {
+			st.Routes = map[string]ClientStats{}
+		}
+		st.Routes[route] = rs
+		st.Retries += rs.Retries
+		if rs.Breaker != nil {
+			st.Breaker = mergeBreakerStats(st.Breaker, *rs.Breaker)
+		}
+	}
+	for _, route := range r.routes {
+		add(route.Prefix, route.Provider)
+	}
+	if r.fallback != nil {
+		add(DefaultRoute, r.fallback)
+	}
+	return st
+}
+
+var breakerSeverity = map[BreakerState]int{BreakerClosed: 0, BreakerHalfOpen: 1, BreakerOpen: 2}
+
+func mergeBreakerStats(acc *BreakerStats, b BreakerStats) *BreakerStats {
+	if acc == nil {
+		return &b
+	}
+	merged := *acc
+	merged.Opens += b.Opens
+	if b.ConsecutiveFailures > merged.ConsecutiveFailures {
+		merged.ConsecutiveFailures = b.ConsecutiveFailures
+	}
+	if breakerSeverity[b.State] > breakerSeverity[merged.State] {
+		merged.State = b.State
+		merged.OpenedAt = b.OpenedAt
+	}
+	return &merged
+}
+
+// router is implemented by providers that send orders to several backends,
+// so state about one backend is not applied to the others.
+type router interface {
+	route(number string) string
+}
+
+// routeOf returns the route p sends number to.
+func routeOf(p Provider, number string) string {
+	if r, ok := p.(router); ok {
+		return r.route(number)
+	}
+	return DefaultRoute
+}
+
+func (r *Router) GetOrderInfo(ctx context.Context, number string) (*OrderAccrual, error) {
+	p := r.provider(number)
+	if p == nil {
+		return nil, fmt.Errorf("no accrual provider for order %s", number)
+	}
+	return p.GetOrderInfo(ctx, number)
+}
+
+func (r *Router) provider(number string) Provider {
+	for _, route := range r.routes {
+		if strings.HasPrefix(number, route.Prefix) {
+			return route.Provider
+		}
+	}
+	return r.fallback
+}
+
+// route names the route of number by its prefix.
+func (r *Router) route(number string) string {
+	for _, route := range r.routes {
+		if strings.HasPrefix(number, route.Prefix) {
+			return route.Prefix
+		}
+	}
+	return DefaultRoute
+}
@@ -0,0 +1,116 @@
+package accrual
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gophermart/internal/money"
+)
+
+func TestRouter_GetOrderInfo(t *testing.T) {
+	short := NewStaticProvider([]OrderAccrual{{Order: "79927398713", Status: StatusProcessing}})
+	long := NewStaticProvider([]OrderAccrual{{Order: "79927398713", Status: StatusProcessed, Accrual: amountPtr("10")}})
+	fallback := NewStaticProvider([]OrderAccrual{{Order: "2377225624", Status: StatusInvalid}})
+
+	tests := []struct {
+		name       string
+		fallback   Provider
+		number     string
+		wantStatus OrderStatus
+		wantNil    bool
+		wantErr    bool
+	}{
+		{name: "longest prefix wins", fallback: fallback, number: "79927398713", wantStatus: StatusProcessed},
+		{name: "fallback", fallback: fallback, number: "2377225624", wantStatus: StatusInvalid},
+		{name: "not registered", fallback: fallback, number: "12345678903", wantNil: true},
+		{name: "no provider", number: "12345678903", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter([]Route{{Prefix: "7", Provider: short}, {Prefix: "799", Provider: long}}, tt.fallback)
+
+			got, err := r.GetOrderInfo(context.Background(), tt.number)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetOrderInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.wantNil {
+				if got != nil {
+					t.Errorf("GetOrderInfo() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.Status != tt.wantStatus {
+				t.Errorf("GetOrderInfo() = %+v, want status %s", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRouter_Stats(t *testing.T) {
+	down, err := NewWithOptions("http://127.0.0.1:1", Options{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	_, _ = down.GetOrderInfo(context.Background(), "79927398713")
+	up, err := NewWithOptions("http://127.0.0.1:1", Options{BreakerThreshold: 5})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	static := NewStaticProvider(nil)
+
+	st := NewRouter([]Route{{Prefix: "7", Provider: down}, {Prefix: "2", Provider: static}}, up).Stats()
+
+	if st.Breaker == nil || st.Breaker.State != BreakerOpen || st.Breaker.Opens != 1 {
+		t.Errorf("Stats().Breaker = %+v, want the open breaker of route 7", st.Breaker)
+	}
+	if len(st.Routes) != 2 {
+		t.Fatalf("Stats().Routes = %+v, want routes 7 and %s", st.Routes, DefaultRoute)
+	}
+	if b := st.Routes["7"].Breaker; b == nil || b.State != BreakerOpen {
+		t.Errorf("Stats().Routes[7].Breaker = %+v, want open", b)
+	}
+	if b := st.Routes[DefaultRoute].Breaker; b == nil || b.State != BreakerClosed {
+		t.Errorf("Stats().Routes[%s].Breaker = %+v, want closed", DefaultRoute, b)
+	}
+}
+
+func TestLoadStaticProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid", content: `[{"order": "79927398713", "status": "PROCESSED", "accrual": 500}]`},
+		{name: "unknown status", content: `[{"order": "79927398713", "status": "DONE"}]`, wantErr: true},
+		{name: "not json", content: `79927398713`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "accruals.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatalf("write file: %v", err)
+			}
+
+			p, err := LoadStaticProvider(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadStaticProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			got, err := p.GetOrderInfo(context.Background(), "79927398713")
+			if err != nil || got == nil || got.Accrual == nil || *got.Accrual != money.FromInt(500) {
+				t.Errorf("GetOrderInfo() = %+v, %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// StaticProvider answers from a fixed set of orders, for demos and local
+// runs without an accrual system. Orders missing from the set are reported
+// as not registered.
+type StaticProvider struct {
+	orders map[string]OrderAccrual
+}
+
+func NewStaticProvider(orders []OrderAccrual) *StaticProvider {
+	p := &StaticProvider{orders: make(map[string]OrderAccrual, len(orders))}
+	for _, o := range orders {
+		p.orders[o.Order] = o
+	}
+	return p
+}
+
+// LoadStaticProvider reads a JSON array in the accrual system's response
+// format, e.g. [{"order": "79927398713", "status": "PROCESSED", "accrual": 500}].
+func LoadStaticProvider(path string) (*StaticProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read accrual file: %w", err)
+	}
+	var orders []OrderAccrual
+	if err := json.Unmarshal(data, &orders); err != nil {
+		return nil, fmt.Errorf("parse accrual file: %w", err)
+	}
+	for _, o := range orders {
+		switch o.Status {
+		case StatusRegistered, StatusProcessing, StatusInvalid, StatusProcessed:
+		default:
+			return nil, fmt.Errorf("parse accrual file: order %s has unknown status %q", o.Order, o.Status)
+		}
+	}
+	return NewStaticProvider(orders), nil
+}
+
+func (p *StaticProvider) GetOrderInfo(ctx context.Context, number string) (*OrderAccrual, error) {
+	o, ok := p.orders[number]
+	if !ok {
+		return nil, nil
+	}
+	if o.Accrual != nil {
+		v := *o.Accrual
+		o.Accrual = &v
+	}
+	return &o, nil
+}
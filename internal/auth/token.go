@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformedToken   = errors.New("malformed token")
+	ErrInvalidSignature = errors.New("invalid token signature")
+	ErrTokenExpired     = errors.New("token expired")
+)
+
+type Claims struct {
+	UserID    int64  `json:"uid"`
+	SessionID string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Signer issues and verifies HMAC-SHA256 signed tokens. The first key signs
+// new tokens; every key is accepted for verification so keys can be rotated
+// without invalidating tokens that are already out there.
+type Signer struct {
+	keys [][]byte
+	ttl  time.Duration
+	now  func() time.Time
+}
+
+func NewSigner(keys []string, ttl time.Duration) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one signing key is required")
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("token ttl must be positive, got %s", ttl)
+	}
+
+	s := &Signer{ttl: ttl, now: time.Now}
+	for i, k := range keys {
+		if k == "" {
+			return nil, fmt.Errorf("signing key %d is empty", i)
+		}
+		s.keys = append(s.keys, []byte(k))
+	}
+	return s, nil
+}
+
+func (s *Signer) TTL() time.Duration {
+	return s.ttl
+}
+
+func (s *Signer) Issue(userID int64, sessionID string) (string, error) {
+	now := s.now()
+	return s.Sign(Claims{
+		UserID:    userID,
+		SessionID: sessionID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.ttl).Unix(),
+	})
+}
+
+func (s *Signer) Sign(c Claims) (string, error) {
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("marshal claims: %w", err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	sig := sign(s.keys[0], encoded)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (s *Signer) Parse(token string) (*Claims, error) {
+	encoded, rawSig, ok := strings.Cut(token, ".")
+	if !ok || encoded == "" || rawSig == "" {
+		return nil, ErrMalformedToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(rawSig)
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	valid := false
+	for _, k := range s.keys {
+		if hmac.Equal(sig, sign(k, encoded)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, ErrInvalidSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, ErrMalformedToken
+	}
+	if c.UserID <= 0 {
+		return nil, ErrMalformedToken
+	}
+	if !s.now().Before(time.Unix(c.ExpiresAt, 0)) {
+		return nil, ErrTokenExpired
+	}
+
+	return &c, nil
+}
+
+func sign(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
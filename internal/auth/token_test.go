@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigner_IssueParse(t *testing.T) {
+	s, err := NewSigner([]string{"current"}, time.Hour)
+	if err != nil {
+		t.Fatalf("NewSigner() error = %v", err)
+	}
+
+	token, err := s.Issue(42, "s1")
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+
+	claims, err := s.Parse(token)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if claims.UserID != 42 {
+		t.Errorf("Parse().UserID = %v, want 42", claims.UserID)
+	}
+	if claims.SessionID != "s1" {
+		t.Errorf("Parse().SessionID = %v, want s1", claims.SessionID)
+	}
+	if claims.ExpiresAt-claims.IssuedAt != int64(time.Hour.Seconds()) {
+		t.Errorf("Parse() lifetime = %ds, want %ds", claims.ExpiresAt-claims.IssuedAt, int64(time.Hour.Seconds()))
+	}
+}
+
+func TestSigner_Parse(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+
+	old, _ := NewSigner([]string{"old"}, time.Hour)
+	old.now = func() time.Time { return now }
+	rotated, _ := NewSigner([]string{"new", "old"}, time.Hour)
+	rotated.now = func() time.Time { return now }
+	unrelated, _ := NewSigner([]string{"unrelated"}, time.Hour)
+	unrelated.now = func() time.Time { return now }
+
+	oldToken, _ := old.Issue(1, "s1")
+	unrelatedToken, _ := unrelated.Issue(1, "s1")
+	expiredToken, _ := rotated.Sign(Claims{UserID: 1, IssuedAt: now.Add(-2 * time.Hour).Unix(), ExpiresAt: now.Unix()})
+	zeroUserToken, _ := rotated.Sign(Claims{UserID: 0, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+
+	payload, sig, _ := strings.Cut(oldToken, ".")
+	tampered := payload[:len(payload)-1] + "A." + sig
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "token signed with previous key", token: oldToken},
+		{name: "unknown key", token: unrelatedToken, wantErr: ErrInvalidSignature},
+		{name: "tampered payload", token: tampered, wantErr: ErrInvalidSignature},
+		{name: "expired", token: expiredToken, wantErr: ErrTokenExpired},
+		{name: "zero user id", token: zeroUserToken, wantErr: ErrMalformedToken},
+		{name: "no separator", token: "abc", wantErr: ErrMalformedToken},
+		{name: "empty", token: "", wantErr: ErrMalformedToken},
+		{name: "bad signature encoding", token: payload + ".!!!", wantErr: ErrMalformedToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := rotated.Parse(tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Parse() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		ttl     time.Duration
+		wantErr bool
+	}{
+		{name: "single key", keys: []string{"k"}, ttl: time.Minute},
+		{name: "no keys", keys: nil, ttl: time.Minute, wantErr: true},
+		{name: "empty key", keys: []string{"k", ""}, ttl: time.Minute, wantErr: true},
+		{name: "zero ttl", keys: []string{"k"}, ttl: 0, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSigner(tt.keys, tt.ttl)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewSigner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
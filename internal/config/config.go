@@ -3,23 +3,152 @@ package config
 import (
 	"flag"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
 	RunAddress        string
 	DatabaseURI       string
 	AccrualSystemAddr string
+	AccrualStaticFile string
+	AccrualRoutes     []string
+
+	ShutdownTimeout time.Duration
+
+	AccrualWorkers     int
+	AccrualLease       time.Duration
+	AccrualBackoff     time.Duration
+	AccrualBackoffMax  time.Duration
+	AccrualMaxAttempts int
+	AccrualMaxAge      time.Duration
+	InstanceID         string
+
+	AccrualRateLimit  int
+	AccrualRateBurst  int
+	AccrualRateShared bool
+
+	AccrualCallbackSecret string
+	AccrualCallbackWindow time.Duration
+	AccrualCallbackSkew   time.Duration
+
+	AccrualRetries          int
+	AccrualRetryBackoff     time.Duration
+	AccrualBreakerThreshold int
+	AccrualBreakerCooldown  time.Duration
+
+	AuthSigningKey string
+	AuthVerifyKeys []string
+	AuthTokenTTL   time.Duration
+
+	SessionIdleTimeout time.Duration
+
+	PasswordResetTTL  time.Duration
+	PasswordResetFile string
+	// Reset requests per login and per client IP before further ones are
+	// refused for a while; they share the login lockout window and durations.
+	PasswordResetMaxRequests   int
+	PasswordResetIPMaxRequests int
+
+	LoginMaxFailures   int
+	LoginIPMaxFailures int
+	LoginFailureWindow time.Duration
+	LoginLockoutBase   time.Duration
+	LoginLockoutMax    time.Duration
+
+	PasswordMinLength    int
+	PasswordClasses      []string
+	PasswordDenyListFile string
+	LoginMinLength       int
+	LoginMaxLength       int
+
+	TOTPEncryptionKey string
+	TOTPIssuer        string
+
+	APIKeyRateLimit int
+	APIKeyRateBurst int
+
+	IdempotencyKeyRetention time.Duration
+
+	AdminLogins []string
+
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCSkipTOTP     bool
 }
 
 func Load() *Config {
 	var cfg Config
 
+	var verifyKeys, passwordClasses, adminLogins, accrualRoutes string
+
 	flag.StringVar(&cfg.RunAddress, "a", getEnvDefault("RUN_ADDRESS", "localhost:8080"), "HTTP listen address")
 	flag.StringVar(&cfg.DatabaseURI, "d", getEnvDefault("DATABASE_URI", ""), "PostgreSQL DSN")
 	flag.StringVar(&cfg.AccrualSystemAddr, "r", getEnvDefault("ACCRUAL_SYSTEM_ADDRESS", ""), "accrual system base URL")
+	flag.StringVar(&cfg.AccrualStaticFile, "accrual-static-file", getEnvDefault("ACCRUAL_STATIC_FILE", ""), "JSON file with fixed order accruals, used instead of an accrual system for demos")
+	flag.StringVar(&accrualRoutes, "accrual-routes", getEnvDefault("ACCRUAL_ROUTES", ""), "comma-separated prefix=url pairs sending matching order numbers to other accrual systems")
+
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second), "how long to wait for in-flight requests and accrual polls on shutdown")
+
+	flag.IntVar(&cfg.AccrualWorkers, "accrual-workers", getEnvInt("ACCRUAL_WORKERS", 4), "number of orders polled from the accrual system concurrently")
+	flag.DurationVar(&cfg.AccrualLease, "accrual-lease", getEnvDuration("ACCRUAL_LEASE", 2*time.Minute), "how long an instance owns the orders it claimed for polling")
+	flag.DurationVar(&cfg.AccrualBackoff, "accrual-backoff", getEnvDuration("ACCRUAL_BACKOFF", time.Second), "delay before polling an unfinished order again, doubled on every attempt")
+	flag.DurationVar(&cfg.AccrualBackoffMax, "accrual-backoff-max", getEnvDuration("ACCRUAL_BACKOFF_MAX", 10*time.Minute), "maximum delay between polls of one order")
+	flag.IntVar(&cfg.AccrualMaxAttempts, "accrual-max-attempts", getEnvInt("ACCRUAL_MAX_ATTEMPTS", 50), "polls after which an unresolved order is parked, 0 disables the limit")
+	flag.DurationVar(&cfg.AccrualMaxAge, "accrual-max-age", getEnvDuration("ACCRUAL_MAX_AGE", 72*time.Hour), "age after which an unresolved order is parked, 0 disables the limit")
+	flag.IntVar(&cfg.AccrualRateLimit, "accrual-rate-limit", getEnvInt("ACCRUAL_RATE_LIMIT", 0), "requests per minute sent to each accrual system, 0 until it advertises a limit")
+	flag.IntVar(&cfg.AccrualRateBurst, "accrual-rate-burst", getEnvInt("ACCRUAL_RATE_BURST", 10), "burst size for requests to the accrual system")
+	flag.BoolVar(&cfg.AccrualRateShared, "accrual-rate-shared", getEnvBool("ACCRUAL_RATE_SHARED", false), "share the accrual rate limit between instances through the database")
+	flag.StringVar(&cfg.AccrualCallbackSecret, "accrual-callback-secret", getEnvDefault("ACCRUAL_CALLBACK_SECRET", ""), "key the accrual system signs status callbacks with, empty disables callbacks")
+	flag.DurationVar(&cfg.AccrualCallbackWindow, "accrual-callback-window", getEnvDuration("ACCRUAL_CALLBACK_WINDOW", 5*time.Minute), "how long to wait for a callback before polling an order")
+	flag.DurationVar(&cfg.AccrualCallbackSkew, "accrual-callback-skew", getEnvDuration("ACCRUAL_CALLBACK_SKEW", 5*time.Minute), "maximum age of a callback timestamp")
+	flag.IntVar(&cfg.AccrualRetries, "accrual-retries", getEnvInt("ACCRUAL_RETRIES", 2), "retries of an accrual request after a network error or 5xx")
+	flag.DurationVar(&cfg.AccrualRetryBackoff, "accrual-retry-backoff", getEnvDuration("ACCRUAL_RETRY_BACKOFF", 200*time.Millisecond), "delay before the first retry, doubled on every further one")
+	flag.IntVar(&cfg.AccrualBreakerThreshold, "accrual-breaker-threshold", getEnvInt("ACCRUAL_BREAKER_THRESHOLD", 5), "consecutive failed accrual calls that open the circuit breaker, 0 disables it")
+	flag.DurationVar(&cfg.AccrualBreakerCooldown, "accrual-breaker-cooldown", getEnvDuration("ACCRUAL_BREAKER_COOLDOWN", 30*time.Second), "how long an open circuit breaker rejects accrual calls before probing")
+	flag.StringVar(&cfg.InstanceID, "instance-id", getEnvDefault("INSTANCE_ID", ""), "name of this replica in order leases, defaults to hostname plus a random suffix")
+
+	flag.StringVar(&cfg.AuthSigningKey, "k", getEnvDefault("AUTH_SIGNING_KEY", ""), "key used to sign auth tokens")
+	flag.StringVar(&verifyKeys, "auth-verify-keys", getEnvDefault("AUTH_VERIFY_KEYS", ""), "comma-separated previous keys still accepted for token verification")
+	flag.DurationVar(&cfg.AuthTokenTTL, "auth-token-ttl", getEnvDuration("AUTH_TOKEN_TTL", 24*time.Hour), "auth token and session absolute lifetime")
+	flag.DurationVar(&cfg.SessionIdleTimeout, "session-idle-timeout", getEnvDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute), "session inactivity timeout")
+	flag.DurationVar(&cfg.PasswordResetTTL, "password-reset-ttl", getEnvDuration("PASSWORD_RESET_TTL", time.Hour), "password reset token lifetime")
+	flag.StringVar(&cfg.PasswordResetFile, "password-reset-file", getEnvDefault("PASSWORD_RESET_FILE", ""), "file to write password reset notifications to, logs them when empty")
+	flag.IntVar(&cfg.PasswordResetMaxRequests, "password-reset-max-requests", getEnvInt("PASSWORD_RESET_MAX_REQUESTS", 3), "password reset requests per login before they are throttled")
+	flag.IntVar(&cfg.PasswordResetIPMaxRequests, "password-reset-ip-max-requests", getEnvInt("PASSWORD_RESET_IP_MAX_REQUESTS", 10), "password reset requests per client IP before they are throttled")
+	flag.IntVar(&cfg.LoginMaxFailures, "login-max-failures", getEnvInt("LOGIN_MAX_FAILURES", 5), "failed logins per account before lockout")
+	flag.IntVar(&cfg.LoginIPMaxFailures, "login-ip-max-failures", getEnvInt("LOGIN_IP_MAX_FAILURES", 20), "failed logins per client IP before lockout")
+	flag.DurationVar(&cfg.LoginFailureWindow, "login-failure-window", getEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute), "quiet period after which failed login counters reset")
+	flag.DurationVar(&cfg.LoginLockoutBase, "login-lockout-base", getEnvDuration("LOGIN_LOCKOUT_BASE", time.Minute), "first lockout duration, doubled on every further failure")
+	flag.DurationVar(&cfg.LoginLockoutMax, "login-lockout-max", getEnvDuration("LOGIN_LOCKOUT_MAX", time.Hour), "maximum lockout duration")
+	flag.IntVar(&cfg.PasswordMinLength, "password-min-length", getEnvInt("PASSWORD_MIN_LENGTH", 8), "minimum password length")
+	flag.StringVar(&passwordClasses, "password-classes", getEnvDefault("PASSWORD_CLASSES", ""), "comma-separated character classes every password must contain: upper, lower, digit, symbol")
+	flag.StringVar(&cfg.PasswordDenyListFile, "password-deny-list", getEnvDefault("PASSWORD_DENY_LIST", ""), "file with one forbidden password per line")
+	flag.IntVar(&cfg.LoginMinLength, "login-min-length", getEnvInt("LOGIN_MIN_LENGTH", 3), "minimum login length")
+	flag.IntVar(&cfg.LoginMaxLength, "login-max-length", getEnvInt("LOGIN_MAX_LENGTH", 64), "maximum login length")
+	flag.StringVar(&cfg.TOTPEncryptionKey, "totp-key", getEnvDefault("TOTP_ENCRYPTION_KEY", ""), "key used to encrypt TOTP secrets at rest, empty disables 2FA enrollment")
+	flag.StringVar(&cfg.TOTPIssuer, "totp-issuer", getEnvDefault("TOTP_ISSUER", "Gophermart"), "issuer shown in authenticator apps")
+	flag.IntVar(&cfg.APIKeyRateLimit, "api-key-rate-limit", getEnvInt("API_KEY_RATE_LIMIT", 60), "requests per minute allowed for each API key, 0 disables the limit")
+	flag.IntVar(&cfg.APIKeyRateBurst, "api-key-rate-burst", getEnvInt("API_KEY_RATE_BURST", 20), "burst size for each API key")
+	flag.DurationVar(&cfg.IdempotencyKeyRetention, "idempotency-key-retention", getEnvDuration("IDEMPOTENCY_KEY_RETENTION", 24*time.Hour), "how long a stored Idempotency-Key response is replayed")
+	flag.StringVar(&adminLogins, "admin-logins", getEnvDefault("ADMIN_LOGINS", ""), "comma-separated logins promoted to admin on startup")
+
+	flag.StringVar(&cfg.OIDCIssuer, "oidc-issuer", getEnvDefault("OIDC_ISSUER", ""), "OpenID Connect issuer URL, empty disables SSO login")
+	flag.StringVar(&cfg.OIDCClientID, "oidc-client-id", getEnvDefault("OIDC_CLIENT_ID", ""), "OpenID Connect client id")
+	flag.StringVar(&cfg.OIDCClientSecret, "oidc-client-secret", getEnvDefault("OIDC_CLIENT_SECRET", ""), "OpenID Connect client secret, empty for public clients")
+	flag.StringVar(&cfg.OIDCRedirectURL, "oidc-redirect-url", getEnvDefault("OIDC_REDIRECT_URL", ""), "callback URL registered with the provider, e.g. https://host/api/user/oidc/callback")
+	flag.BoolVar(&cfg.OIDCSkipTOTP, "oidc-skip-totp", getEnvBool("OIDC_SKIP_TOTP", false), "trust the provider's own second factor and skip the local TOTP challenge on SSO logins")
 
 	flag.Parse()
 
+	cfg.AuthVerifyKeys = splitList(verifyKeys)
+	cfg.PasswordClasses = splitList(passwordClasses)
+	cfg.AdminLogins = splitList(adminLogins)
+	cfg.AccrualRoutes = splitList(accrualRoutes)
+
 	return &cfg
 }
 
@@ -29,3 +158,40 @@ func getEnvDefault(key, def string) string {
 	}
 	return def
 }
+
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+func getEnvBool(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func getEnvInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/pressly/goose/v3"
 )
 
+//go:embed sql/*.sql
 var embedMigrations embed.FS
 
 func Apply(ctx context.Context, db *sql.DB) error {
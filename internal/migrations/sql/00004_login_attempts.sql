@@ -0,0 +1,25 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS login_attempts (
+    scope TEXT NOT NULL CHECK (scope IN ('login', 'ip')),
+    key TEXT NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_until TIMESTAMPTZ,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE TABLE IF NOT EXISTS login_lockouts (
+    id BIGSERIAL PRIMARY KEY,
+    scope TEXT NOT NULL,
+    key TEXT NOT NULL,
+    failures INTEGER NOT NULL,
+    locked_until TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_lockouts_created_at ON login_lockouts(created_at);
+
+-- +goose Down
+
+DROP TABLE IF EXISTS login_lockouts;
+DROP TABLE IF EXISTS login_attempts;
@@ -0,0 +1,51 @@
+-- +goose Up
+-- Logins that differ only in case would fail the unique index below. The
+-- oldest account keeps its login; the others are renamed to "<login>#<id>",
+-- which new signups cannot produce, and the renames are kept so support can
+-- tell the owners how to sign in.
+CREATE TABLE IF NOT EXISTS login_case_renames (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    old_login TEXT NOT NULL,
+    new_login TEXT NOT NULL,
+    renamed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO login_case_renames (user_id, old_login, new_login)
+SELECT u.id, u.login, u.login || '#' || u.id
+FROM users u
+WHERE EXISTS (
+    SELECT 1 FROM users e
+    WHERE lower(e.login) = lower(u.login)
+      AND e.id < u.id
+);
+
+UPDATE users u
+SET login = r.new_login
+FROM login_case_renames r
+WHERE r.user_id = u.id;
+
+-- +goose StatementBegin
+DO $$
+DECLARE
+    renamed INTEGER;
+BEGIN
+    SELECT count(*) INTO renamed FROM login_case_renames;
+    IF renamed > 0 THEN
+        RAISE NOTICE 'renamed % logins that differed from another only in case, see login_case_renames', renamed;
+    END IF;
+END
+$$;
+-- +goose StatementEnd
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_login_lower ON users (lower(login));
+
+-- +goose Down
+
+DROP INDEX IF EXISTS idx_users_login_lower;
+
+UPDATE users u
+SET login = r.old_login
+FROM login_case_renames r
+WHERE r.user_id = u.id AND u.login = r.new_login;
+
+DROP TABLE IF EXISTS login_case_renames;
@@ -0,0 +1,20 @@
+-- +goose Up
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'user'
+    CHECK (role IN ('user', 'support', 'admin'));
+
+CREATE TABLE IF NOT EXISTS admin_audit (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id INTEGER NOT NULL REFERENCES users(id),
+    action TEXT NOT NULL,
+    target_user_id INTEGER,
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_admin_audit_target_user_id ON admin_audit(target_user_id);
+
+-- +goose Down
+
+DROP TABLE IF EXISTS admin_audit;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
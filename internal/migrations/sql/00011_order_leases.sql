@@ -0,0 +1,12 @@
+-- +goose Up
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS claimed_by TEXT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS lease_until TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_orders_pending ON orders(uploaded_at)
+    WHERE status IN ('NEW', 'PROCESSING');
+
+-- +goose Down
+
+DROP INDEX IF EXISTS idx_orders_pending;
+ALTER TABLE orders DROP COLUMN IF EXISTS lease_until;
+ALTER TABLE orders DROP COLUMN IF EXISTS claimed_by;
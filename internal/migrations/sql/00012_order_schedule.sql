@@ -0,0 +1,15 @@
+-- +goose Up
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS next_check_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS attempt_count INTEGER NOT NULL DEFAULT 0;
+
+DROP INDEX IF EXISTS idx_orders_pending;
+CREATE INDEX IF NOT EXISTS idx_orders_due ON orders(next_check_at)
+    WHERE status IN ('NEW', 'PROCESSING');
+
+-- +goose Down
+
+DROP INDEX IF EXISTS idx_orders_due;
+CREATE INDEX IF NOT EXISTS idx_orders_pending ON orders(uploaded_at)
+    WHERE status IN ('NEW', 'PROCESSING');
+ALTER TABLE orders DROP COLUMN IF EXISTS attempt_count;
+ALTER TABLE orders DROP COLUMN IF EXISTS next_check_at;
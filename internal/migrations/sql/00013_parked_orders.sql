@@ -0,0 +1,21 @@
+-- +goose Up
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_status_check;
+ALTER TABLE orders
+    ADD CONSTRAINT orders_status_check
+    CHECK (status IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED', 'PARKED'));
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS last_error TEXT;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS parked_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_orders_parked ON orders(parked_at) WHERE status = 'PARKED';
+
+-- +goose Down
+
+DROP INDEX IF EXISTS idx_orders_parked;
+UPDATE orders SET status = 'NEW' WHERE status = 'PARKED';
+ALTER TABLE orders DROP COLUMN IF EXISTS parked_at;
+ALTER TABLE orders DROP COLUMN IF EXISTS last_error;
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_status_check;
+ALTER TABLE orders
+    ADD CONSTRAINT orders_status_check
+    CHECK (status IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED'));
@@ -0,0 +1,14 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS accrual_rate_limit (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+    tokens DOUBLE PRECISION NOT NULL DEFAULT 0,
+    per_minute INT,
+    paused_until TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO accrual_rate_limit (id) VALUES (TRUE) ON CONFLICT DO NOTHING;
+
+-- +goose Down
+
+DROP TABLE IF EXISTS accrual_rate_limit;
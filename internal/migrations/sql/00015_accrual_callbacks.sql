@@ -0,0 +1,11 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS accrual_callback_nonces (
+    nonce TEXT PRIMARY KEY,
+    seen_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_accrual_callback_nonces_seen_at ON accrual_callback_nonces(seen_at);
+
+-- +goose Down
+
+DROP TABLE IF EXISTS accrual_callback_nonces;
@@ -0,0 +1,11 @@
+-- +goose Up
+-- Points are stored with exactly two decimal places, matching money.Amount.
+-- Values written through float64 earlier are rounded to the kopeck; a
+-- withdrawal below half a kopeck keeps the smallest sum the CHECK allows.
+ALTER TABLE orders ALTER COLUMN accrual TYPE NUMERIC(19, 2);
+ALTER TABLE withdrawals ALTER COLUMN sum TYPE NUMERIC(19, 2) USING GREATEST(ROUND(sum, 2), 0.01);
+
+-- +goose Down
+
+ALTER TABLE withdrawals ALTER COLUMN sum TYPE NUMERIC;
+ALTER TABLE orders ALTER COLUMN accrual TYPE NUMERIC;
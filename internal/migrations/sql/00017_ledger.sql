@@ -0,0 +1,95 @@
+-- +goose Up
+-- Every change of a user's points is a ledger transaction with entries that
+-- sum to zero: the user's account on one side, a program account (issued,
+-- redeemed, expired, adjustments) on the other. Balances are derived from
+-- the entries, which are never updated or deleted; mistakes are reversed.
+CREATE TABLE IF NOT EXISTS ledger_transactions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE RESTRICT,
+    kind TEXT NOT NULL CHECK (kind IN ('accrual', 'withdrawal', 'reversal', 'adjustment', 'expiry')),
+    order_id INTEGER REFERENCES orders(id) ON DELETE RESTRICT,
+    withdrawal_id INTEGER REFERENCES withdrawals(id) ON DELETE RESTRICT,
+    reverses_id BIGINT UNIQUE REFERENCES ledger_transactions(id) ON DELETE RESTRICT,
+    note TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (kind <> 'accrual' OR order_id IS NOT NULL),
+    CHECK (kind <> 'withdrawal' OR withdrawal_id IS NOT NULL),
+    CHECK ((kind = 'reversal') = (reverses_id IS NOT NULL)),
+    CHECK (kind <> 'adjustment' OR note IS NOT NULL)
+);
+
+CREATE INDEX IF NOT EXISTS idx_ledger_transactions_user_id ON ledger_transactions(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_ledger_transactions_order_id ON ledger_transactions(order_id) WHERE order_id IS NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_ledger_transactions_withdrawal
+    ON ledger_transactions(withdrawal_id) WHERE kind = 'withdrawal';
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id BIGSERIAL PRIMARY KEY,
+    transaction_id BIGINT NOT NULL REFERENCES ledger_transactions(id) ON DELETE RESTRICT,
+    account TEXT NOT NULL CHECK (account IN ('user', 'issued', 'redeemed', 'expired', 'adjustments')),
+    amount NUMERIC(19, 2) NOT NULL CHECK (amount <> 0),
+    UNIQUE (transaction_id, account)
+);
+
+INSERT INTO ledger_transactions (user_id, kind, order_id, created_at)
+SELECT user_id, 'accrual', id, uploaded_at
+FROM orders
+WHERE status = 'PROCESSED' AND accrual > 0;
+
+INSERT INTO ledger_entries (transaction_id, account, amount)
+SELECT t.id, e.account, e.amount
+FROM ledger_transactions t
+JOIN orders o ON o.id = t.order_id
+CROSS JOIN LATERAL (VALUES ('user', o.accrual), ('issued', -o.accrual)) AS e(account, amount)
+WHERE t.kind = 'accrual';
+
+INSERT INTO ledger_transactions (user_id, kind, withdrawal_id, created_at)
+SELECT user_id, 'withdrawal', id, processed_at
+FROM withdrawals;
+
+INSERT INTO ledger_entries (transaction_id, account, amount)
+SELECT t.id, e.account, e.amount
+FROM ledger_transactions t
+JOIN withdrawals w ON w.id = t.withdrawal_id
+CROSS JOIN LATERAL (VALUES ('user', -w.sum), ('redeemed', w.sum)) AS e(account, amount)
+WHERE t.kind = 'withdrawal';
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION ledger_check_balanced() RETURNS trigger AS $$
+BEGIN
+    IF (SELECT SUM(amount) FROM ledger_entries WHERE transaction_id = NEW.transaction_id) <> 0 THEN
+        RAISE EXCEPTION 'ledger transaction % does not balance', NEW.transaction_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- Checked at commit, once all entries of a transaction are in.
+CREATE CONSTRAINT TRIGGER ledger_entries_balanced
+    AFTER INSERT ON ledger_entries
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION ledger_check_balanced();
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION ledger_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'ledger is append-only: % on % is not allowed', TG_OP, TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER ledger_transactions_append_only
+    BEFORE UPDATE OR DELETE ON ledger_transactions
+    FOR EACH ROW EXECUTE FUNCTION ledger_append_only();
+
+CREATE TRIGGER ledger_entries_append_only
+    BEFORE UPDATE OR DELETE ON ledger_entries
+    FOR EACH ROW EXECUTE FUNCTION ledger_append_only();
+
+-- +goose Down
+
+DROP TABLE IF EXISTS ledger_entries;
+DROP TABLE IF EXISTS ledger_transactions;
+DROP FUNCTION IF EXISTS ledger_append_only();
+DROP FUNCTION IF EXISTS ledger_check_balanced();
@@ -0,0 +1,50 @@
+-- +goose Up
+-- balances holds each user's ledger totals. It is kept up to date by a
+-- trigger on ledger_entries, so it cannot drift from the ledger, and its row
+-- is what withdrawals lock to serialize with each other.
+CREATE TABLE IF NOT EXISTS balances (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE RESTRICT,
+    current NUMERIC(19, 2) NOT NULL DEFAULT 0,
+    withdrawn NUMERIC(19, 2) NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO balances (user_id, current, withdrawn)
+SELECT t.user_id,
+       COALESCE(SUM(e.amount) FILTER (WHERE e.account = 'user'), 0),
+       COALESCE(SUM(e.amount) FILTER (WHERE e.account = 'redeemed'), 0)
+FROM ledger_entries e
+JOIN ledger_transactions t ON t.id = e.transaction_id
+GROUP BY t.user_id
+ON CONFLICT (user_id) DO NOTHING;
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION ledger_apply_balance() RETURNS trigger AS $$
+BEGIN
+    IF NEW.account NOT IN ('user', 'redeemed') THEN
+        RETURN NULL;
+    END IF;
+    INSERT INTO balances (user_id, current, withdrawn)
+    SELECT t.user_id,
+           CASE WHEN NEW.account = 'user' THEN NEW.amount ELSE 0 END,
+           CASE WHEN NEW.account = 'redeemed' THEN NEW.amount ELSE 0 END
+    FROM ledger_transactions t
+    WHERE t.id = NEW.transaction_id
+    ON CONFLICT (user_id) DO UPDATE
+    SET current = balances.current + EXCLUDED.current,
+        withdrawn = balances.withdrawn + EXCLUDED.withdrawn,
+        updated_at = now();
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER ledger_entries_balance
+    AFTER INSERT ON ledger_entries
+    FOR EACH ROW EXECUTE FUNCTION ledger_apply_balance();
+
+-- +goose Down
+
+DROP TRIGGER IF EXISTS ledger_entries_balance ON ledger_entries;
+DROP FUNCTION IF EXISTS ledger_apply_balance();
+DROP TABLE IF EXISTS balances;
@@ -0,0 +1,66 @@
+-- +goose Up
+-- A withdrawal order number is used once and never matches an uploaded order.
+-- Withdrawals that already break either rule are kept, since the ledger
+-- refers to them, but flagged and left out of the unique index.
+ALTER TABLE withdrawals ADD COLUMN IF NOT EXISTS legacy_duplicate BOOLEAN NOT NULL DEFAULT false;
+
+UPDATE withdrawals w
+SET legacy_duplicate = true
+WHERE EXISTS (SELECT 1 FROM orders o WHERE o.number = w."order")
+   OR EXISTS (
+       SELECT 1 FROM withdrawals e
+       WHERE e."order" = w."order"
+         AND (e.processed_at, e.id) < (w.processed_at, w.id)
+   );
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_withdrawals_order_unique
+    ON withdrawals("order") WHERE NOT legacy_duplicate;
+
+-- orders.number and withdrawals."order" share one namespace. Both sides take
+-- the same transaction lock on the number before looking at the other table,
+-- so two concurrent inserts cannot both miss each other.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION order_number_exclusive() RETURNS trigger AS $$
+DECLARE
+    num TEXT;
+BEGIN
+    IF TG_TABLE_NAME = 'orders' THEN
+        num := NEW.number;
+    ELSE
+        IF NEW.legacy_duplicate THEN
+            RETURN NEW;
+        END IF;
+        num := NEW."order";
+    END IF;
+
+    PERFORM pg_advisory_xact_lock(hashtextextended('order_number:' || num, 0));
+
+    IF TG_TABLE_NAME = 'orders' THEN
+        PERFORM 1 FROM withdrawals WHERE "order" = num;
+    ELSE
+        PERFORM 1 FROM orders WHERE number = num;
+    END IF;
+    IF FOUND THEN
+        RAISE EXCEPTION 'order number % is already used', num
+            USING ERRCODE = 'unique_violation';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+CREATE TRIGGER orders_number_exclusive
+    BEFORE INSERT OR UPDATE OF number ON orders
+    FOR EACH ROW EXECUTE FUNCTION order_number_exclusive();
+
+CREATE TRIGGER withdrawals_order_exclusive
+    BEFORE INSERT OR UPDATE OF "order", legacy_duplicate ON withdrawals
+    FOR EACH ROW EXECUTE FUNCTION order_number_exclusive();
+
+-- +goose Down
+
+DROP TRIGGER IF EXISTS withdrawals_order_exclusive ON withdrawals;
+DROP TRIGGER IF EXISTS orders_number_exclusive ON orders;
+DROP FUNCTION IF EXISTS order_number_exclusive();
+DROP INDEX IF EXISTS idx_withdrawals_order_unique;
+ALTER TABLE withdrawals DROP COLUMN IF EXISTS legacy_duplicate;
@@ -0,0 +1,69 @@
+-- +goose Up
+-- A debit may not leave the user's balance below zero. Credits are always
+-- accepted, so a balance that is already negative (reprocessed orders could
+-- cause that before) can still be paid back; such balances are reported
+-- below.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION ledger_apply_balance() RETURNS trigger AS $$
+DECLARE
+    balance NUMERIC(19, 2);
+BEGIN
+    IF NEW.account NOT IN ('user', 'redeemed') THEN
+        RETURN NULL;
+    END IF;
+    INSERT INTO balances (user_id, current, withdrawn)
+    SELECT t.user_id,
+           CASE WHEN NEW.account = 'user' THEN NEW.amount ELSE 0 END,
+           CASE WHEN NEW.account = 'redeemed' THEN NEW.amount ELSE 0 END
+    FROM ledger_transactions t
+    WHERE t.id = NEW.transaction_id
+    ON CONFLICT (user_id) DO UPDATE
+    SET current = balances.current + EXCLUDED.current,
+        withdrawn = balances.withdrawn + EXCLUDED.withdrawn,
+        updated_at = now()
+    RETURNING current INTO balance;
+
+    IF NEW.account = 'user' AND NEW.amount < 0 AND balance < 0 THEN
+        RAISE EXCEPTION 'ledger transaction % would overdraw the balance', NEW.transaction_id
+            USING ERRCODE = 'check_violation';
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DO $$
+DECLARE
+    overdrawn INTEGER;
+BEGIN
+    SELECT count(*) INTO overdrawn FROM balances WHERE current < 0;
+    IF overdrawn > 0 THEN
+        RAISE NOTICE '% balances are already negative', overdrawn;
+    END IF;
+END
+$$;
+-- +goose StatementEnd
+
+-- +goose Down
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION ledger_apply_balance() RETURNS trigger AS $$
+BEGIN
+    IF NEW.account NOT IN ('user', 'redeemed') THEN
+        RETURN NULL;
+    END IF;
+    INSERT INTO balances (user_id, current, withdrawn)
+    SELECT t.user_id,
+           CASE WHEN NEW.account = 'user' THEN NEW.amount ELSE 0 END,
+           CASE WHEN NEW.account = 'redeemed' THEN NEW.amount ELSE 0 END
+    FROM ledger_transactions t
+    WHERE t.id = NEW.transaction_id
+    ON CONFLICT (user_id) DO UPDATE
+    SET current = balances.current + EXCLUDED.current,
+        withdrawn = balances.withdrawn + EXCLUDED.withdrawn,
+        updated_at = now();
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- An in-progress claim is only held until locked_until; after that a retry of
+-- the same request may take it over, so a crash between the handler and
+-- storing its response does not block the key for the whole retention.
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ;
+
+UPDATE idempotency_keys SET locked_until = created_at WHERE status_code IS NULL;
+
+-- +goose Down
+
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS locked_until;
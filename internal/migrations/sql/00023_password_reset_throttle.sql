@@ -0,0 +1,15 @@
+-- +goose Up
+-- Password reset requests are throttled with the same counters as failed
+-- logins, under their own scopes.
+ALTER TABLE login_attempts DROP CONSTRAINT IF EXISTS login_attempts_scope_check;
+ALTER TABLE login_attempts
+    ADD CONSTRAINT login_attempts_scope_check
+    CHECK (scope IN ('login', 'ip', 'reset_login', 'reset_ip'));
+
+-- +goose Down
+
+DELETE FROM login_attempts WHERE scope IN ('reset_login', 'reset_ip');
+ALTER TABLE login_attempts DROP CONSTRAINT IF EXISTS login_attempts_scope_check;
+ALTER TABLE login_attempts
+    ADD CONSTRAINT login_attempts_scope_check
+    CHECK (scope IN ('login', 'ip'));
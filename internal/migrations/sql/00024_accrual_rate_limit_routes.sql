@@ -0,0 +1,18 @@
+-- +goose Up
+-- The shared limiter keeps a row per accrual route, so a route that is rate
+-- limited does not hold up the others. The existing row becomes the default
+-- route, which is also the only one without accrual routes configured.
+ALTER TABLE accrual_rate_limit ADD COLUMN IF NOT EXISTS route TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE accrual_rate_limit DROP CONSTRAINT IF EXISTS accrual_rate_limit_pkey;
+ALTER TABLE accrual_rate_limit DROP COLUMN IF EXISTS id;
+ALTER TABLE accrual_rate_limit ADD PRIMARY KEY (route);
+ALTER TABLE accrual_rate_limit ALTER COLUMN route DROP DEFAULT;
+
+-- +goose Down
+
+DELETE FROM accrual_rate_limit WHERE route <> 'default';
+ALTER TABLE accrual_rate_limit DROP CONSTRAINT IF EXISTS accrual_rate_limit_pkey;
+ALTER TABLE accrual_rate_limit DROP COLUMN IF EXISTS route;
+ALTER TABLE accrual_rate_limit ADD COLUMN IF NOT EXISTS id BOOLEAN NOT NULL DEFAULT TRUE CHECK (id);
+ALTER TABLE accrual_rate_limit ADD PRIMARY KEY (id);
+INSERT INTO accrual_rate_limit (id) VALUES (TRUE) ON CONFLICT DO NOTHING;
@@ -0,0 +1,240 @@
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Amount is an exact number of points with two decimal places, stored as
+// hundredths. The zero value is 0.
+type Amount struct {
+	cents int64
+}
+
+// Zero is 0 points.
+var Zero Amount
+
+var ErrRange = errors.New("amount out of range")
+
+// maxExponent bounds the exponent Parse accepts so huge exponents cannot be
+// used to make it allocate.
+const maxExponent = 30
+
+func FromCents(cents int64) Amount {
+	return Amount{cents: cents}
+}
+
+// FromInt is n whole points.
+func FromInt(n int64) Amount {
+	return Amount{cents: n * 100}
+}
+
+// Parse reads a decimal such as "500", "-12.5" or "7.2998e2". It fails
+// rather than rounds when s has more than two decimal places, and with
+// ErrRange when s does not fit in an Amount.
+func Parse(s string) (Amount, error) {
+	mantissa, neg := strings.CutPrefix(s, "-")
+
+	exp := 0
+	if i := strings.IndexAny(mantissa, "eE"); i >= 0 {
+		e, err := strconv.Atoi(mantissa[i+1:])
+		if err != nil || e > maxExponent || e < -maxExponent {
+			return Amount{}, fmt.Errorf("parse amount %q: invalid exponent", s)
+		}
+		mantissa, exp = mantissa[:i], e
+	}
+
+	intPart, fracPart, _ := strings.Cut(mantissa, ".")
+	digits := intPart + fracPart
+	if intPart == "" || strings.Trim(digits, "0123456789") != "" {
+		return Amount{}, fmt.Errorf("parse amount %q: invalid syntax", s)
+	}
+
+	// digits holds the value times 10^(len(fracPart)-exp); shift it to
+	// hundredths.
+	switch shift := 2 - len(fracPart) + exp; {
+	case shift > 0:
+		digits += strings.Repeat("0", shift)
+	case shift < 0:
+		cut := len(digits) + shift
+		if cut < 0 || strings.Trim(digits[cut:], "0") != "" {
+			return Amount{}, fmt.Errorf("parse amount %q: more than two decimal places", s)
+		}
+		digits = digits[:cut]
+	}
+
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		return Amount{}, nil
+	}
+	cents, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Amount{}, fmt.Errorf("parse amount %q: %w", s, ErrRange)
+	}
+	if neg {
+		cents = -cents
+	}
+	return Amount{cents: cents}, nil
+}
+
+// MustParse is Parse for constants; it panics on error.
+func MustParse(s string) Amount {
+	a, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func (a Amount) Cents() int64 {
+	return a.cents
+}
+
+// Add returns a + b, or ErrRange when the sum does not fit.
+func (a Amount) Add(b Amount) (Amount, error) {
+	sum := a.cents + b.cents
+	// The sum of two numbers of the same sign has that sign unless it
+	// wrapped around.
+	if (a.cents > 0 && b.cents > 0 && sum < 0) || (a.cents < 0 && b.cents < 0 && sum >= 0) {
+		return Amount{}, fmt.Errorf("%s + %s: %w", a, b, ErrRange)
+	}
+	return Amount{cents: sum}, nil
+}
+
+// Sub returns a - b, or ErrRange when the difference does not fit.
+func (a Amount) Sub(b Amount) (Amount, error) {
+	diff := a.cents - b.cents
+	if (a.cents >= 0 && b.cents < 0 && diff < 0) || (a.cents < 0 && b.cents > 0 && diff >= 0) {
+		return Amount{}, fmt.Errorf("%s - %s: %w", a, b, ErrRange)
+	}
+	return Amount{cents: diff}, nil
+}
+
+func (a Amount) Neg() Amount {
+	return Amount{cents: -a.cents}
+}
+
+// Cmp returns -1, 0 or +1 when a is less than, equal to or greater than b.
+func (a Amount) Cmp(b Amount) int {
+	switch {
+	case a.cents < b.cents:
+		return -1
+	case a.cents > b.cents:
+		return 1
+	}
+	return 0
+}
+
+// Sign returns -1, 0 or +1 for a negative, zero or positive a.
+func (a Amount) Sign() int {
+	return a.Cmp(Zero)
+}
+
+// Percent is rate percent of a, rounded half away from zero to hundredths.
+func (a Amount) Percent(rate Amount) Amount {
+	n := new(big.Int).Mul(big.NewInt(a.cents), big.NewInt(rate.cents))
+	q, r := new(big.Int).QuoRem(n, big.NewInt(100*100), new(big.Int))
+	if r.Abs(r).Cmp(big.NewInt(100*100/2)) >= 0 {
+		q.Add(q, big.NewInt(int64(n.Sign())))
+	}
+	if !q.IsInt64() {
+		if q.Sign() < 0 {
+			return Amount{cents: math.MinInt64}
+		}
+		return Amount{cents: math.MaxInt64}
+	}
+	return Amount{cents: q.Int64()}
+}
+
+// String formats a with as few decimals as needed: "500", "500.5", "729.98".
+func (a Amount) String() string {
+	abs := uint64(a.cents)
+	sign := ""
+	if a.cents < 0 {
+		abs, sign = -abs, "-"
+	}
+	units, cents := abs/100, abs%100
+	switch {
+	case cents == 0:
+		return fmt.Sprintf("%s%d", sign, units)
+	case cents%10 == 0:
+		return fmt.Sprintf("%s%d.%d", sign, units, cents/10)
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, units, cents)
+}
+
+// MarshalJSON writes a as a JSON number without going through float64.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON accepts JSON numbers only; null leaves a unchanged.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		return fmt.Errorf("parse amount %s: want a number", s)
+	}
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+func (a Amount) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Amount) UnmarshalText(text []byte) error {
+	v, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Scan reads a NUMERIC column. Use sql.Null[Amount] for nullable ones.
+func (a *Amount) Scan(src any) error {
+	var (
+		v   Amount
+		err error
+	)
+	switch src := src.(type) {
+	case string:
+		v, err = Parse(src)
+	case []byte:
+		v, err = Parse(string(src))
+	case int64:
+		if src > math.MaxInt64/100 || src < math.MinInt64/100 {
+			return fmt.Errorf("scan amount %d: %w", src, ErrRange)
+		}
+		v = FromInt(src)
+	case float64:
+		v, err = Parse(strconv.FormatFloat(src, 'f', -1, 64))
+	case nil:
+		return errors.New("scan amount: NULL")
+	default:
+		return fmt.Errorf("scan amount: unsupported type %T", src)
+	}
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Value stores a as a decimal string, which PostgreSQL reads into NUMERIC
+// exactly.
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
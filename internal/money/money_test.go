@@ -0,0 +1,210 @@
+package money
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "500", want: 50000},
+		{in: "500.5", want: 50050},
+		{in: "729.98", want: 72998},
+		{in: "729.980", want: 72998},
+		{in: "-12.3", want: -1230},
+		{in: "0.01", want: 1},
+		{in: "7.2998e2", want: 72998},
+		{in: "5E-2", want: 5},
+		{in: "1e2", want: 10000},
+		{in: "0.1e1", want: 100},
+		{in: "92233720368547758.07", want: 9223372036854775807},
+		{in: "-92233720368547758.07", want: -9223372036854775807},
+		{in: "0.001", wantErr: true},
+		{in: "1e-3", wantErr: true},
+		{in: "92233720368547758.08", wantErr: true},
+		{in: "-92233720368547758.08", wantErr: true},
+		{in: "1e100", wantErr: true},
+		{in: "", wantErr: true},
+		{in: ".5", wantErr: true},
+		{in: "1.2.3", wantErr: true},
+		{in: "+1", wantErr: true},
+		{in: "1/3", wantErr: true},
+		{in: "NaN", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.in, err)
+			continue
+		}
+		if got.Cents() != tt.want {
+			t.Errorf("Parse(%q) = %d cents, want %d", tt.in, got.Cents(), tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		cents int64
+		want  string
+	}{
+		{cents: 0, want: "0"},
+		{cents: 50000, want: "500"},
+		{cents: 50050, want: "500.5"},
+		{cents: 72998, want: "729.98"},
+		{cents: 5, want: "0.05"},
+		{cents: -1230, want: "-12.3"},
+		{cents: -9223372036854775808, want: "-92233720368547758.08"},
+	}
+
+	for _, tt := range tests {
+		if got := FromCents(tt.cents).String(); got != tt.want {
+			t.Errorf("FromCents(%d).String() = %v, want %v", tt.cents, got, tt.want)
+		}
+	}
+}
+
+// Summing 0.1 ten times drifts with float64 but not with Amount.
+func TestAdd_exact(t *testing.T) {
+	var sum Amount
+	for i := 0; i < 10; i++ {
+		sum, _ = sum.Add(MustParse("0.1"))
+	}
+	if sum != FromInt(1) {
+		t.Errorf("sum = %v, want 1", sum)
+	}
+	if got, _ := sum.Sub(MustParse("0.3")); got != MustParse("0.7") {
+		t.Errorf("1 - 0.3 = %v, want 0.7", got)
+	}
+	if MustParse("729.98").Cmp(MustParse("729.99")) != -1 || FromInt(1).Neg().Sign() != -1 {
+		t.Error("Cmp/Sign mismatch")
+	}
+}
+
+func TestAdd_overflow(t *testing.T) {
+	top := MustParse("92233720368547758.07")
+	cent := MustParse("0.01")
+
+	if _, err := top.Add(cent); !errors.Is(err, ErrRange) {
+		t.Errorf("max + 0.01 error = %v, want ErrRange", err)
+	}
+	if _, err := top.Neg().Sub(MustParse("0.02")); !errors.Is(err, ErrRange) {
+		t.Errorf("-max - 0.02 error = %v, want ErrRange", err)
+	}
+	if _, err := top.Neg().Add(top.Neg()); !errors.Is(err, ErrRange) {
+		t.Errorf("-max + -max error = %v, want ErrRange", err)
+	}
+	if _, err := (Amount{}).Sub(top.Neg()); err != nil {
+		t.Errorf("0 - -max error = %v", err)
+	}
+	if _, err := top.Sub(top.Neg()); !errors.Is(err, ErrRange) {
+		t.Errorf("max - -max error = %v, want ErrRange", err)
+	}
+	if got, err := top.Add(top.Neg()); err != nil || got.Sign() != 0 {
+		t.Errorf("max + -max = %v, %v, want 0", got, err)
+	}
+	if _, err := Parse("92233720368547758.08"); !errors.Is(err, ErrRange) {
+		t.Errorf("Parse error = %v, want ErrRange", err)
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		amount, rate, want string
+	}{
+		{amount: "7000", rate: "10", want: "700"},
+		{amount: "100", rate: "7.5", want: "7.5"},
+		{amount: "0.05", rate: "10", want: "0.01"},
+		{amount: "0.04", rate: "10", want: "0"},
+		{amount: "-0.05", rate: "10", want: "-0.01"},
+		{amount: "333.33", rate: "33.33", want: "111.1"},
+	}
+
+	for _, tt := range tests {
+		if got := MustParse(tt.amount).Percent(MustParse(tt.rate)); got != MustParse(tt.want) {
+			t.Errorf("%s.Percent(%s) = %v, want %v", tt.amount, tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		Sum     Amount  `json:"sum"`
+		Accrual *Amount `json:"accrual,omitempty"`
+	}
+	if err := json.Unmarshal([]byte(`{"sum": 751.1, "accrual": 729.98}`), &v); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if v.Sum != MustParse("751.1") || v.Accrual == nil || *v.Accrual != MustParse("729.98") {
+		t.Fatalf("Unmarshal() = %+v", v)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if got, want := string(data), `{"sum":751.1,"accrual":729.98}`; got != want {
+		t.Errorf("Marshal() = %s, want %s", got, want)
+	}
+
+	for _, in := range []string{`{"sum": "10"}`, `{"sum": 0.001}`, `{"sum": true}`} {
+		if err := json.Unmarshal([]byte(in), &v); err == nil {
+			t.Errorf("Unmarshal(%s) error = nil, want error", in)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		src     any
+		want    Amount
+		wantErr bool
+	}{
+		{src: "729.98", want: MustParse("729.98")},
+		{src: []byte("500"), want: FromInt(500)},
+		{src: int64(12), want: FromInt(12)},
+		{src: float64(0.3), want: MustParse("0.3")},
+		{src: nil, wantErr: true},
+		{src: "abc", wantErr: true},
+		{src: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var got Amount
+		err := got.Scan(tt.src)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Scan(%v) error = %v, wantErr %v", tt.src, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Scan(%v) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+
+	var null sql.Null[Amount]
+	if err := null.Scan(nil); err != nil || null.Valid {
+		t.Errorf("Null.Scan(nil) = %+v, %v", null, err)
+	}
+	if err := null.Scan("1.5"); err != nil || !null.Valid || null.V != MustParse("1.5") {
+		t.Errorf("Null.Scan(1.5) = %+v, %v", null, err)
+	}
+
+	v, err := MustParse("500.5").Value()
+	if err != nil || v != "500.5" {
+		t.Errorf("Value() = %v, %v, want 500.5", v, err)
+	}
+}
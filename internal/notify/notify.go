@@ -0,0 +1,66 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type Notifier interface {
+	SendPasswordReset(ctx context.Context, login, token string) error
+}
+
+type LogNotifier struct{}
+
+func (LogNotifier) SendPasswordReset(_ context.Context, login, token string) error {
+	log.Printf("notify: password reset token for %q: %s", login, token)
+	return nil
+}
+
+// FileNotifier appends one JSON line per message to a file. It is meant for
+// local development and tests where there is no real delivery channel.
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+type fileMessage struct {
+	Kind   string    `json:"kind"`
+	Login  string    `json:"login"`
+	Token  string    `json:"token"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+func (n *FileNotifier) SendPasswordReset(_ context.Context, login, token string) error {
+	line, err := json.Marshal(fileMessage{
+		Kind:   "password_reset",
+		Login:  login,
+		Token:  token,
+		SentAt: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("marshal message: %w", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open notification file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write notification: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileNotifier_SendPasswordReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	n := NewFileNotifier(path)
+
+	ctx := context.Background()
+	if err := n.SendPasswordReset(ctx, "alice", "token-1"); err != nil {
+		t.Fatalf("SendPasswordReset() error = %v", err)
+	}
+	if err := n.SendPasswordReset(ctx, "bob", "token-2"); err != nil {
+		t.Fatalf("SendPasswordReset() error = %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open outbox: %v", err)
+	}
+	defer f.Close()
+
+	var got []fileMessage
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var m fileMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			t.Fatalf("decode line %q: %v", sc.Text(), err)
+		}
+		got = append(got, m)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("outbox has %d messages, want 2", len(got))
+	}
+	if got[0].Login != "alice" || got[0].Token != "token-1" || got[0].Kind != "password_reset" {
+		t.Errorf("first message = %+v", got[0])
+	}
+	if got[1].Login != "bob" || got[1].Token != "token-2" {
+		t.Errorf("second message = %+v", got[1])
+	}
+}
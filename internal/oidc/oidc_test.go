@@ -0,0 +1,160 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gophermart/internal/oidc/oidctest"
+)
+
+const testClientID = "gophermart"
+
+func newTestProvider(t *testing.T) (*oidctest.Provider, *Provider) {
+	t.Helper()
+
+	fake, err := oidctest.NewProvider(testClientID)
+	if err != nil {
+		t.Fatalf("oidctest.NewProvider() error = %v", err)
+	}
+	t.Cleanup(fake.Close)
+
+	p, err := Discover(context.Background(), Options{
+		Issuer:      fake.Issuer(),
+		ClientID:    testClientID,
+		RedirectURL: "http://localhost/api/user/oidc/callback",
+	})
+	if err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+	return fake, p
+}
+
+// authorize follows the provider's authorize endpoint and returns the code and
+// state it redirects back with.
+func authorize(t *testing.T, authURL string) (code, state string) {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize status = %v, want %v", resp.StatusCode, http.StatusFound)
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parse redirect: %v", err)
+	}
+	return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+func TestProvider_codeFlow(t *testing.T) {
+	fake, p := newTestProvider(t)
+	fake.SetUser(oidctest.User{Subject: "u-42", Email: "alice@example.com", PreferredUsername: "alice"})
+
+	verifier, challenge, err := NewPKCE()
+	if err != nil {
+		t.Fatalf("NewPKCE() error = %v", err)
+	}
+
+	code, state := authorize(t, p.AuthCodeURL("st", "n0nce", challenge))
+	if state != "st" {
+		t.Errorf("state = %q, want %q", state, "st")
+	}
+
+	if _, err := p.Exchange(context.Background(), code, "wrong-verifier"); err == nil {
+		t.Fatal("Exchange() with wrong verifier succeeded")
+	}
+
+	code, _ = authorize(t, p.AuthCodeURL("st", "n0nce", challenge))
+	raw, err := p.Exchange(context.Background(), code, verifier)
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+
+	tok, err := p.Verify(context.Background(), raw, "n0nce", time.Now())
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if tok.Subject != "u-42" || tok.Email != "alice@example.com" || tok.PreferredUsername != "alice" {
+		t.Errorf("Verify() = %+v", tok)
+	}
+
+	if _, err := p.Verify(context.Background(), raw, "other", time.Now()); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify() with wrong nonce error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestProvider_Verify(t *testing.T) {
+	fake, p := newTestProvider(t)
+	now := time.Now()
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss":   fake.Issuer(),
+			"sub":   "u-1",
+			"aud":   testClientID,
+			"iat":   now.Unix(),
+			"exp":   now.Add(5 * time.Minute).Unix(),
+			"nonce": "n",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c map[string]any)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(map[string]any) {}},
+		{name: "audience list", modify: func(c map[string]any) { c["aud"] = []string{"other", testClientID} }},
+		{name: "wrong audience", modify: func(c map[string]any) { c["aud"] = "other" }, wantErr: true},
+		{name: "wrong issuer", modify: func(c map[string]any) { c["iss"] = "https://evil.example" }, wantErr: true},
+		{name: "expired", modify: func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() }, wantErr: true},
+		{name: "missing subject", modify: func(c map[string]any) { delete(c, "sub") }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.modify(c)
+			raw, err := fake.SignIDToken(c)
+			if err != nil {
+				t.Fatalf("SignIDToken() error = %v", err)
+			}
+
+			_, err = p.Verify(context.Background(), raw, "n", now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("tampered payload", func(t *testing.T) {
+		raw, _ := fake.SignIDToken(valid())
+		other, _ := fake.SignIDToken(map[string]any{"sub": "admin"})
+		forged := other[:strings.LastIndex(other, ".")] + raw[strings.LastIndex(raw, "."):]
+		if _, err := p.Verify(context.Background(), forged, "n", now); err == nil {
+			t.Error("Verify() accepted a token with a foreign signature")
+		}
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		if err := fake.RotateKey(); err != nil {
+			t.Fatalf("RotateKey() error = %v", err)
+		}
+		raw, _ := fake.SignIDToken(valid())
+		if _, err := p.Verify(context.Background(), raw, "n", now); err != nil {
+			t.Errorf("Verify() after rotation error = %v", err)
+		}
+	})
+}
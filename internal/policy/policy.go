@@ -0,0 +1,223 @@
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	ClassUpper  = "upper"
+	ClassLower  = "lower"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+// bcrypt silently ignores everything past 72 bytes.
+const maxPasswordBytes = 72
+
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type Options struct {
+	PasswordMinLength int
+	PasswordClasses   []string
+	DenyListFile      string
+
+	LoginMinLength int
+	LoginMaxLength int
+}
+
+// Policy validates new logins and passwords. A nil *Policy accepts anything
+// that is non-empty.
+type Policy struct {
+	passwordMinLength int
+	passwordClasses   []string
+	denied            map[string]struct{}
+
+	loginMinLength int
+	loginMaxLength int
+}
+
+func New(opts Options) (*Policy, error) {
+	p := &Policy{
+		passwordMinLength: opts.PasswordMinLength,
+		loginMinLength:    opts.LoginMinLength,
+		loginMaxLength:    opts.LoginMaxLength,
+		denied:            map[string]struct{}{},
+	}
+
+	for _, c := range opts.PasswordClasses {
+		switch c {
+		case ClassUpper, ClassLower, ClassDigit, ClassSymbol:
+			p.passwordClasses = append(p.passwordClasses, c)
+		default:
+			return nil, fmt.Errorf("unknown password character class %q", c)
+		}
+	}
+
+	if opts.DenyListFile != "" {
+		if err := p.loadDenyList(opts.DenyListFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Policy) loadDenyList(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open password deny-list: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p.denied[strings.ToLower(line)] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("read password deny-list: %w", err)
+	}
+	return nil
+}
+
+func (p *Policy) CheckLogin(login string) []Violation {
+	var v []Violation
+
+	n := utf8.RuneCountInString(login)
+	if n == 0 {
+		return []Violation{{Rule: "login_required", Message: "login must not be empty"}}
+	}
+	if p == nil {
+		return nil
+	}
+
+	if p.loginMinLength > 0 && n < p.loginMinLength {
+		v = append(v, Violation{
+			Rule:    "login_min_length",
+			Message: fmt.Sprintf("login must be at least %d characters long", p.loginMinLength),
+		})
+	}
+	if p.loginMaxLength > 0 && n > p.loginMaxLength {
+		v = append(v, Violation{
+			Rule:    "login_max_length",
+			Message: fmt.Sprintf("login must be at most %d characters long", p.loginMaxLength),
+		})
+	}
+	for _, r := range login {
+		if !isLoginRune(r) {
+			v = append(v, Violation{
+				Rule:    "login_charset",
+				Message: "login may contain only letters, digits and . _ - @",
+			})
+			break
+		}
+	}
+
+	return v
+}
+
+func (p *Policy) CheckPassword(password, login string) []Violation {
+	if password == "" {
+		return []Violation{{Rule: "password_required", Message: "password must not be empty"}}
+	}
+	if p == nil {
+		return nil
+	}
+
+	var v []Violation
+
+	if p.passwordMinLength > 0 && utf8.RuneCountInString(password) < p.passwordMinLength {
+		v = append(v, Violation{
+			Rule:    "password_min_length",
+			Message: fmt.Sprintf("password must be at least %d characters long", p.passwordMinLength),
+		})
+	}
+	if len(password) > maxPasswordBytes {
+		v = append(v, Violation{
+			Rule:    "password_max_length",
+			Message: fmt.Sprintf("password must be at most %d bytes long", maxPasswordBytes),
+		})
+	}
+
+	for _, c := range p.passwordClasses {
+		if !hasClass(password, c) {
+			v = append(v, Violation{
+				Rule:    "password_class_" + c,
+				Message: fmt.Sprintf("password must contain at least one %s character", className(c)),
+			})
+		}
+	}
+
+	if _, ok := p.denied[strings.ToLower(password)]; ok {
+		v = append(v, Violation{Rule: "password_denied", Message: "password is too common"})
+	}
+	if login != "" && strings.EqualFold(password, login) {
+		v = append(v, Violation{Rule: "password_equals_login", Message: "password must differ from login"})
+	}
+
+	return v
+}
+
+// NormalizeLogin returns the form used for case-insensitive comparisons.
+func NormalizeLogin(login string) string {
+	return strings.ToLower(login)
+}
+
+func isLoginRune(r rune) bool {
+	if unicode.IsLetter(r) || unicode.IsDigit(r) {
+		return true
+	}
+	switch r {
+	case '.', '_', '-', '@':
+		return true
+	}
+	return false
+}
+
+func hasClass(s, class string) bool {
+	for _, r := range s {
+		switch class {
+		case ClassUpper:
+			if unicode.IsUpper(r) {
+				return true
+			}
+		case ClassLower:
+			if unicode.IsLower(r) {
+				return true
+			}
+		case ClassDigit:
+			if unicode.IsDigit(r) {
+				return true
+			}
+		case ClassSymbol:
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func className(class string) string {
+	switch class {
+	case ClassUpper:
+		return "upper-case"
+	case ClassLower:
+		return "lower-case"
+	case ClassDigit:
+		return "digit"
+	default:
+		return "symbol"
+	}
+}
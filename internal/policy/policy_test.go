@@ -0,0 +1,108 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func rules(v []Violation) []string {
+	var out []string
+	for _, x := range v {
+		out = append(out, x.Rule)
+	}
+	return out
+}
+
+func TestPolicy_CheckPassword(t *testing.T) {
+	denyList := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(denyList, []byte("# common passwords\nPassword1!\nqwerty\n"), 0o600); err != nil {
+		t.Fatalf("write deny-list: %v", err)
+	}
+
+	p, err := New(Options{
+		PasswordMinLength: 8,
+		PasswordClasses:   []string{ClassUpper, ClassDigit},
+		DenyListFile:      denyList,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		login    string
+		want     []string
+	}{
+		{name: "strong", password: "Correct7Horse", login: "alice"},
+		{name: "empty", password: "", want: []string{"password_required"}},
+		{name: "too short", password: "Ab1", want: []string{"password_min_length"}},
+		{name: "missing classes", password: "lowercaseonly", want: []string{"password_class_upper", "password_class_digit"}},
+		{name: "denied case-insensitive", password: "password1!", want: []string{"password_class_upper", "password_denied"}},
+		{name: "equals login", password: "Alice12345", login: "alice12345", want: []string{"password_equals_login"}},
+		{name: "longer than bcrypt accepts", password: "A1" + string(make([]byte, 80)), want: []string{"password_max_length"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rules(p.CheckPassword(tt.password, tt.login))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CheckPassword() rules = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicy_CheckLogin(t *testing.T) {
+	p, err := New(Options{LoginMinLength: 3, LoginMaxLength: 10})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		login string
+		want  []string
+	}{
+		{name: "valid", login: "alice.b-1"},
+		{name: "email-like", login: "a@b.io"},
+		{name: "empty", login: "", want: []string{"login_required"}},
+		{name: "too short", login: "ab", want: []string{"login_min_length"}},
+		{name: "too long", login: "abcdefghijk", want: []string{"login_max_length"}},
+		{name: "whitespace", login: "ali ce", want: []string{"login_charset"}},
+		{name: "control character", login: "ali\x00ce", want: []string{"login_charset"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rules(p.CheckLogin(tt.login))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CheckLogin() rules = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	var p *Policy
+	if v := p.CheckPassword("x", "x"); v != nil {
+		t.Errorf("nil CheckPassword() = %v, want nil", v)
+	}
+	if v := p.CheckLogin("a b"); v != nil {
+		t.Errorf("nil CheckLogin() = %v, want nil", v)
+	}
+	if v := p.CheckLogin(""); len(v) != 1 {
+		t.Errorf("nil CheckLogin(\"\") = %v, want login_required", v)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(Options{PasswordClasses: []string{"emoji"}}); err == nil {
+		t.Error("New() with unknown class: want error")
+	}
+	if _, err := New(Options{DenyListFile: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("New() with missing deny-list: want error")
+	}
+}
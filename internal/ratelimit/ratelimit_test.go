@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := New(60, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("Allow() #%d = false, want true within burst", i+1)
+		}
+	}
+
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatal("Allow() after burst = true, want false")
+	}
+	if wait != time.Second {
+		t.Errorf("Allow() wait = %v, want %v", wait, time.Second)
+	}
+
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("Allow() for another key = false, want independent bucket")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("Allow() after refill = false, want true")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Error("Allow() second call after one refill = true, want false")
+	}
+}
+
+func TestLimiter_Unlimited(t *testing.T) {
+	l := New(0, 0)
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatal("Allow() with zero rate = false, want unlimited")
+		}
+	}
+}
+
+func TestLimiter_prune(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	l := New(60, 1)
+	l.now = func() time.Time { return now }
+
+	l.Allow("idle")
+	now = now.Add(time.Minute)
+	l.pruneLocked(now)
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("pruneLocked() kept a fully refilled bucket")
+	}
+}
@@ -0,0 +1,60 @@
+package secretbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var ErrDecrypt = errors.New("secretbox: decryption failed")
+
+// Box encrypts small secrets with AES-256-GCM. The configured key string is
+// stretched with SHA-256, so any non-empty passphrase is accepted.
+type Box struct {
+	aead cipher.AEAD
+}
+
+func New(key string) (*Box, error) {
+	if key == "" {
+		return nil, errors.New("secretbox: empty key")
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, fmt.Errorf("secretbox: create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("secretbox: create gcm: %w", err)
+	}
+	return &Box{aead: aead}, nil
+}
+
+func (b *Box) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("secretbox: generate nonce: %w", err)
+	}
+	out := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+func (b *Box) Open(sealed string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	ns := b.aead.NonceSize()
+	if len(raw) < ns {
+		return "", ErrDecrypt
+	}
+	plain, err := b.aead.Open(nil, raw[:ns], raw[ns:], nil)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,64 @@
+package secretbox
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBox_SealOpen(t *testing.T) {
+	b, err := New("passphrase")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	sealed, err := b.Seal("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	if sealed == "JBSWY3DPEHPK3PXP" {
+		t.Fatal("Seal() returned plaintext")
+	}
+
+	again, _ := b.Seal("JBSWY3DPEHPK3PXP")
+	if again == sealed {
+		t.Error("Seal() is deterministic, want a fresh nonce per call")
+	}
+
+	got, err := b.Open(sealed)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if got != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("Open() = %v, want JBSWY3DPEHPK3PXP", got)
+	}
+}
+
+func TestBox_OpenRejects(t *testing.T) {
+	b, _ := New("passphrase")
+	other, _ := New("another passphrase")
+
+	sealed, _ := b.Seal("secret")
+
+	tests := []struct {
+		name   string
+		box    *Box
+		sealed string
+	}{
+		{name: "wrong key", box: other, sealed: sealed},
+		{name: "not base64", box: b, sealed: "%%%"},
+		{name: "too short", box: b, sealed: "AAAA"},
+		{name: "tampered", box: b, sealed: sealed[:len(sealed)-4] + "AAAA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.box.Open(tt.sealed); !errors.Is(err, ErrDecrypt) {
+				t.Errorf("Open() error = %v, want ErrDecrypt", err)
+			}
+		})
+	}
+
+	if _, err := New(""); err == nil {
+		t.Error("New(\"\") error = nil, want error")
+	}
+}
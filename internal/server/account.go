@@ -0,0 +1,411 @@
+package server
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gophermart/internal/money"
+	"gophermart/internal/policy"
+)
+
+type exportProfile struct {
+	ID               int64            `json:"id"`
+	Login            string           `json:"login"`
+	Role             string           `json:"role"`
+	CreatedAt        string           `json:"created_at"`
+	TwoFactorEnabled bool             `json:"two_factor_enabled"`
+	Identities       []exportIdentity `json:"identities"`
+}
+
+type exportIdentity struct {
+	Issuer    string  `json:"issuer"`
+	Subject   string  `json:"subject"`
+	Email     *string `json:"email,omitempty"`
+	CreatedAt string  `json:"created_at"`
+}
+
+type exportOrder struct {
+	Number     string        `json:"number"`
+	Status     string        `json:"status"`
+	Accrual    *money.Amount `json:"accrual,omitempty"`
+	UploadedAt string        `json:"uploaded_at"`
+}
+
+type exportWithdrawal struct {
+	Order       string       `json:"order"`
+	Sum         money.Amount `json:"sum"`
+	ProcessedAt string       `json:"processed_at"`
+}
+
+type exportSession struct {
+	CreatedAt  string  `json:"created_at"`
+	LastSeenAt string  `json:"last_seen_at"`
+	ExpiresAt  string  `json:"expires_at"`
+	RevokedAt  *string `json:"revoked_at,omitempty"`
+}
+
+type exportBundle struct {
+	ExportedAt  string             `json:"exported_at"`
+	Profile     exportProfile      `json:"profile"`
+	Orders      []exportOrder      `json:"orders"`
+	Withdrawals []exportWithdrawal `json:"withdrawals"`
+	Sessions    []exportSession    `json:"sessions"`
+	APIKeys     []apiKeyResponse   `json:"api_keys"`
+}
+
+// handleExport returns everything stored about the caller. With ?format=zip
+// every section is written to its own file in a ZIP archive.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "zip" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := s.currentUserID(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	bundle, err := s.loadExport(ctx, userID)
+	if err != nil {
+		log.Printf("export user %d: %v", userID, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	name := "gophermart-export-" + strconv.FormatInt(userID, 10)
+
+	if format != "zip" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+		if err := json.NewEncoder(w).Encode(bundle); err != nil {
+			log.Printf("write export: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.zip"`)
+	if err := writeExportZip(w, bundle); err != nil {
+		log.Printf("write export: %v", err)
+	}
+}
+
+func writeExportZip(w http.ResponseWriter, bundle *exportBundle) error {
+	zw := zip.NewWriter(w)
+
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", bundle.Profile},
+		{"orders.json", bundle.Orders},
+		{"withdrawals.json", bundle.Withdrawals},
+		{"sessions.json", bundle.Sessions},
+		{"api_keys.json", bundle.APIKeys},
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			return fmt.Errorf("create %s: %w", f.name, err)
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.data); err != nil {
+			return fmt.Errorf("write %s: %w", f.name, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+// loadExport reads all sections in one read-only snapshot so they are
+// consistent with each other.
+func (s *Server) loadExport(ctx context.Context, userID int64) (*exportBundle, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	bundle := &exportBundle{
+		ExportedAt:  time.Now().UTC().Format(time.RFC3339),
+		Orders:      []exportOrder{},
+		Withdrawals: []exportWithdrawal{},
+		Sessions:    []exportSession{},
+		APIKeys:     []apiKeyResponse{},
+	}
+
+	if err := loadExportProfile(ctx, tx, userID, &bundle.Profile); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT number, status, accrual, uploaded_at FROM orders WHERE user_id = $1 ORDER BY uploaded_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select orders: %w", err)
+	}
+	for rows.Next() {
+		var (
+			o          exportOrder
+			accrual    sql.Null[money.Amount]
+			uploadedAt time.Time
+		)
+		if err := rows.Scan(&o.Number, &o.Status, &accrual, &uploadedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan order: %w", err)
+		}
+		if accrual.Valid {
+			o.Accrual = &accrual.V
+		}
+		o.UploadedAt = uploadedAt.Format(time.RFC3339)
+		bundle.Orders = append(bundle.Orders, o)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, fmt.Errorf("select orders: %w", err)
+	}
+
+	rows, err = tx.QueryContext(
+		ctx,
+		`SELECT "order", sum, processed_at FROM withdrawals WHERE user_id = $1 ORDER BY processed_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select withdrawals: %w", err)
+	}
+	for rows.Next() {
+		var (
+			wd          exportWithdrawal
+			processedAt time.Time
+		)
+		if err := rows.Scan(&wd.Order, &wd.Sum, &processedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan withdrawal: %w", err)
+		}
+		wd.ProcessedAt = processedAt.Format(time.RFC3339)
+		bundle.Withdrawals = append(bundle.Withdrawals, wd)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, fmt.Errorf("select withdrawals: %w", err)
+	}
+
+	rows, err = tx.QueryContext(
+		ctx,
+		`SELECT created_at, last_seen_at, expires_at, revoked_at FROM sessions WHERE user_id = $1 ORDER BY created_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select sessions: %w", err)
+	}
+	for rows.Next() {
+		var (
+			createdAt, lastSeenAt, expiresAt time.Time
+			revokedAt                        sql.NullTime
+		)
+		if err := rows.Scan(&createdAt, &lastSeenAt, &expiresAt, &revokedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan session: %w", err)
+		}
+		sess := exportSession{
+			CreatedAt:  createdAt.Format(time.RFC3339),
+			LastSeenAt: lastSeenAt.Format(time.RFC3339),
+			ExpiresAt:  expiresAt.Format(time.RFC3339),
+		}
+		if revokedAt.Valid {
+			v := revokedAt.Time.Format(time.RFC3339)
+			sess.RevokedAt = &v
+		}
+		bundle.Sessions = append(bundle.Sessions, sess)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, fmt.Errorf("select sessions: %w", err)
+	}
+
+	rows, err = tx.QueryContext(
+		ctx,
+		`SELECT id, name, prefix, scope, created_at, last_used_at FROM api_keys WHERE user_id = $1 ORDER BY created_at`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select api keys: %w", err)
+	}
+	for rows.Next() {
+		var (
+			k          apiKeyResponse
+			createdAt  time.Time
+			lastUsedAt sql.NullTime
+		)
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Scope, &createdAt, &lastUsedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan api key: %w", err)
+		}
+		k.Prefix = apiKeyPrefix + k.Prefix
+		k.CreatedAt = createdAt.Format(time.RFC3339)
+		if lastUsedAt.Valid {
+			v := lastUsedAt.Time.Format(time.RFC3339)
+			k.LastUsedAt = &v
+		}
+		bundle.APIKeys = append(bundle.APIKeys, k)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, fmt.Errorf("select api keys: %w", err)
+	}
+
+	return bundle, nil
+}
+
+func loadExportProfile(ctx context.Context, tx *sql.Tx, userID int64, p *exportProfile) error {
+	var createdAt time.Time
+	if err := tx.QueryRowContext(
+		ctx,
+		`SELECT u.id, u.login, u.role, u.created_at,
+		        EXISTS (SELECT 1 FROM user_totp t WHERE t.user_id = u.id AND t.confirmed_at IS NOT NULL)
+		 FROM users u
+		 WHERE u.id = $1`,
+		userID,
+	).Scan(&p.ID, &p.Login, &p.Role, &createdAt, &p.TwoFactorEnabled); err != nil {
+		return fmt.Errorf("select profile: %w", err)
+	}
+	p.CreatedAt = createdAt.Format(time.RFC3339)
+	p.Identities = []exportIdentity{}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT issuer, subject, email, created_at FROM user_identities WHERE user_id = $1 ORDER BY created_at`,
+		userID,
+	)
+	if err != nil {
+		return fmt.Errorf("select identities: %w", err)
+	}
+	for rows.Next() {
+		var (
+			id        exportIdentity
+			email     sql.NullString
+			createdAt time.Time
+		)
+		if err := rows.Scan(&id.Issuer, &id.Subject, &email, &createdAt); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan identity: %w", err)
+		}
+		if email.Valid {
+			id.Email = &email.String
+		}
+		id.CreatedAt = createdAt.Format(time.RFC3339)
+		p.Identities = append(p.Identities, id)
+	}
+	if err := closeRows(rows); err != nil {
+		return fmt.Errorf("select identities: %w", err)
+	}
+	return nil
+}
+
+func closeRows(rows *sql.Rows) error {
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	return rows.Close()
+}
+
+// handleDeleteAccount erases the caller's personal data. The users row itself
+// is kept, with an anonymized login, because orders and withdrawals reference
+// it and have to be retained for accounting.
+func (s *Server) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := s.currentUserID(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	err := s.deleteAccount(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("delete user %d: %v", userID, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	clearAuthCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deleteAccount(ctx context.Context, userID int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	var login string
+	if err := tx.QueryRowContext(
+		ctx,
+		`SELECT login FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`,
+		userID,
+	).Scan(&login); err != nil {
+		return err
+	}
+
+	// ':' is not allowed in logins, so the placeholder can never collide with
+	// a registered account.
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE users
+		 SET login = 'deleted:' || id, password_hash = $2, role = 'user', deleted_at = now()
+		 WHERE id = $1`,
+		userID, unusablePasswordHash,
+	); err != nil {
+		return fmt.Errorf("anonymize user: %w", err)
+	}
+
+	statements := []string{
+		`UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`,
+		`UPDATE api_keys SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`,
+		`DELETE FROM user_totp WHERE user_id = $1`,
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+		`DELETE FROM login_challenges WHERE user_id = $1`,
+		`DELETE FROM password_resets WHERE user_id = $1`,
+		`DELETE FROM user_identities WHERE user_id = $1`,
+		`DELETE FROM oidc_login_states WHERE link_user_id = $1`,
+		`DELETE FROM idempotency_keys WHERE user_id = $1`,
+		`DELETE FROM login_case_renames WHERE user_id = $1`,
+	}
+	for _, q := range statements {
+		if _, err := tx.ExecContext(ctx, q, userID); err != nil {
+			return fmt.Errorf("erase user data: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`DELETE FROM login_attempts WHERE scope = $1 AND key = $2`,
+		lockoutScopeLogin, policy.NormalizeLogin(login),
+	); err != nil {
+		return fmt.Errorf("erase login attempts: %w", err)
+	}
+
+	return tx.Commit()
+}
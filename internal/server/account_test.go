@@ -0,0 +1,212 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/config"
+)
+
+func expectExport(mock sqlmock.Sqlmock) {
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT u.id, u.login, u.role, u.created_at`).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "login", "role", "created_at", "exists"}).
+			AddRow(1, "alice", roleUser, now, true))
+	mock.ExpectQuery(`SELECT issuer, subject, email, created_at FROM user_identities`).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"issuer", "subject", "email", "created_at"}))
+	mock.ExpectQuery(`SELECT number, status, accrual, uploaded_at FROM orders`).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"number", "status", "accrual", "uploaded_at"}).
+			AddRow("79927398713", "PROCESSED", "500", now))
+	mock.ExpectQuery(`SELECT "order", sum, processed_at FROM withdrawals`).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"order", "sum", "processed_at"}).
+			AddRow("2377225624", 100.0, now))
+	mock.ExpectQuery(`SELECT created_at, last_seen_at, expires_at, revoked_at FROM sessions`).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at", "last_seen_at", "expires_at", "revoked_at"}).
+			AddRow(now, now, now.Add(time.Hour), nil))
+	mock.ExpectQuery(`SELECT id, name, prefix, scope, created_at, last_used_at FROM api_keys`).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "prefix", "scope", "created_at", "last_used_at"}))
+	mock.ExpectRollback()
+}
+
+func TestServer_handleExport(t *testing.T) {
+	tests := []struct {
+		name            string
+		query           string
+		wantStatusCode  int
+		wantContentType string
+	}{
+		{name: "json", wantStatusCode: http.StatusOK, wantContentType: "application/json"},
+		{name: "zip", query: "?format=zip", wantStatusCode: http.StatusOK, wantContentType: "application/zip"},
+		{name: "unknown format", query: "?format=xml", wantStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			if tt.wantStatusCode == http.StatusOK {
+				expectExport(mock)
+			}
+
+			s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux()}
+
+			req := withTestUser(httptest.NewRequest(http.MethodGet, "/api/user/export"+tt.query, nil), 1)
+			w := httptest.NewRecorder()
+
+			s.handleExport(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Fatalf("handleExport() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+			if got := w.Header().Get("Content-Type"); tt.wantContentType != "" && got != tt.wantContentType {
+				t.Errorf("handleExport() content type = %q, want %q", got, tt.wantContentType)
+			}
+
+			switch tt.wantContentType {
+			case "application/json":
+				var bundle exportBundle
+				if err := json.NewDecoder(w.Body).Decode(&bundle); err != nil {
+					t.Fatalf("decode export: %v", err)
+				}
+				if bundle.Profile.Login != "alice" || len(bundle.Orders) != 1 || len(bundle.Withdrawals) != 1 ||
+					len(bundle.Sessions) != 1 || bundle.APIKeys == nil {
+					t.Errorf("handleExport() bundle = %+v", bundle)
+				}
+			case "application/zip":
+				zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+				if err != nil {
+					t.Fatalf("open zip: %v", err)
+				}
+				var names []string
+				for _, f := range zr.File {
+					names = append(names, f.Name)
+				}
+				sort.Strings(names)
+				want := []string{"api_keys.json", "orders.json", "profile.json", "sessions.json", "withdrawals.json"}
+				if len(names) != len(want) {
+					t.Fatalf("zip files = %v, want %v", names, want)
+				}
+				for i := range want {
+					if names[i] != want[i] {
+						t.Errorf("zip files = %v, want %v", names, want)
+						break
+					}
+				}
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_handleDeleteAccount(t *testing.T) {
+	tests := []struct {
+		name           string
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+	}{
+		{
+			name: "anonymizes and keeps financial records",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT login FROM users WHERE id = \$1 AND deleted_at IS NULL FOR UPDATE`).
+					WithArgs(int64(1)).
+					WillReturnRows(sqlmock.NewRows([]string{"login"}).AddRow("Alice"))
+				mock.ExpectExec(`UPDATE users\s+SET login = 'deleted:' \|\| id`).
+					WithArgs(int64(1), unusablePasswordHash).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				for _, q := range []string{
+					`UPDATE sessions SET revoked_at`,
+					`UPDATE api_keys SET revoked_at`,
+					`DELETE FROM user_totp`,
+					`DELETE FROM recovery_codes`,
+					`DELETE FROM login_challenges`,
+					`DELETE FROM password_resets`,
+					`DELETE FROM user_identities`,
+					`DELETE FROM oidc_login_states`,
+					`DELETE FROM idempotency_keys`,
+					`DELETE FROM login_case_renames`,
+				} {
+					mock.ExpectExec(q).WithArgs(int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				mock.ExpectExec(`DELETE FROM login_attempts`).
+					WithArgs(lockoutScopeLogin, "alice").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusNoContent,
+		},
+		{
+			name: "already deleted",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT login FROM users`).
+					WithArgs(int64(1)).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			tt.setupMock(mock)
+
+			s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux()}
+
+			req := withTestUser(httptest.NewRequest(http.MethodDelete, "/api/user", nil), 1)
+			w := httptest.NewRecorder()
+
+			s.handleDeleteAccount(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleDeleteAccount() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+			if w.Code == http.StatusNoContent {
+				cleared := false
+				for _, c := range w.Result().Cookies() {
+					if c.Name == authCookieName && c.MaxAge < 0 {
+						cleared = true
+					}
+				}
+				if !cleared {
+					t.Error("handleDeleteAccount() did not clear the auth cookie")
+				}
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
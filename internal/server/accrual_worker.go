@@ -0,0 +1,434 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"gophermart/internal/accrual"
+	"gophermart/internal/money"
+)
+
+type accrualJob struct {
+	id         int64
+	number     string
+	userID     int64
+	attempts   int
+	uploadedAt time.Time
+	done       func()
+}
+
+type accrualOutcome int
+
+const (
+	// accrualFinal means the order reached INVALID or PROCESSED.
+	accrualFinal accrualOutcome = iota
+	// accrualRetry means the order is still pending and is polled again after
+	// its backoff, or parked once it ran out of attempts.
+	accrualRetry
+	// accrualThrottled means the request was not answered because of the rate
+	// limit; it does not count as an attempt.
+	accrualThrottled
+)
+
+func newInstanceID(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "gophermart"
+	}
+	suffix, err := newRandomID()
+	if err != nil {
+		return "", err
+	}
+	return host + "-" + suffix[:8], nil
+}
+
+func (s *Server) accrualLease() time.Duration {
+	if s.cfg.AccrualLease > 0 {
+		return s.cfg.AccrualLease
+	}
+	return 2 * time.Minute
+}
+
+func (s *Server) accrualWorkerCount() int {
+	if s.cfg.AccrualWorkers > 0 {
+		return s.cfg.AccrualWorkers
+	}
+	return 1
+}
+
+// accrualWorker feeds unfinished orders to a fixed pool of workers. The jobs
+// channel is unbuffered, so the dispatcher only gets ahead of the workers by
+// one order and stalls together with them while they wait for the limiter.
+// Once ctx is cancelled it stops claiming orders, releases the ones it could
+// not finish and returns after every worker has exited.
+func (s *Server) accrualWorker(ctx context.Context) {
+	if s.accrualLimiter == nil {
+		return
+	}
+
+	var workers sync.WaitGroup
+	jobs := make(chan accrualJob)
+	for i := 0; i < s.accrualWorkerCount(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.runAccrualWorker(ctx, jobs)
+		}()
+	}
+	defer func() {
+		close(jobs)
+		workers.Wait()
+	}()
+
+	for ctx.Err() == nil {
+		batch, err := s.fetchAccrualBatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("accrualWorker: %v", err)
+		}
+
+		if len(batch) == 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		s.dispatchAccrualBatch(ctx, jobs, batch)
+	}
+}
+
+func (s *Server) runAccrualWorker(ctx context.Context, jobs <-chan accrualJob) {
+	for job := range jobs {
+		outcome, reason := accrualThrottled, ""
+		if deadline, ok := s.renewAccrualLease(ctx, job); ok {
+			outcome, reason = s.processAccrualOrder(ctx, job.number, deadline)
+		}
+		s.finishAccrualOrder(job, outcome, reason)
+		job.done()
+	}
+}
+
+// renewAccrualLease extends the claim on an order right before it is polled,
+// since it may have waited in the queue for most of its lease. An order whose
+// lease already lapsed may be polled by another instance by now, so it is
+// dropped. The returned deadline leaves time to store the answer before the
+// renewed lease runs out.
+func (s *Server) renewAccrualLease(ctx context.Context, job accrualJob) (time.Time, bool) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	lease := s.accrualLease()
+	start := time.Now()
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE orders SET lease_until = now() + make_interval(secs => $3)
+		 WHERE id = $1 AND claimed_by = $2 AND lease_until > now()`,
+		job.id, s.instanceID, lease.Seconds(),
+	)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("accrualWorker: renew lease: %v", err)
+		}
+		return time.Time{}, false
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		log.Printf("accrualWorker: lease on order %s lapsed, skipping it", job.number)
+		return time.Time{}, false
+	}
+
+	budget := lease - 5*time.Second
+	if budget < lease/2 {
+		budget = lease / 2
+	}
+	return start.Add(budget), true
+}
+
+// dispatchAccrualBatch hands out a batch and waits until every order in it was
+// processed and released before the next batch is claimed. Orders still
+// undispatched when ctx is cancelled are released right away.
+func (s *Server) dispatchAccrualBatch(ctx context.Context, jobs chan<- accrualJob, batch []accrualJob) {
+	var wg sync.WaitGroup
+	wg.Add(len(batch))
+	for _, job := range batch {
+		job.done = wg.Done
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			s.finishAccrualOrder(job, accrualThrottled, "")
+			job.done()
+		}
+	}
+	wg.Wait()
+}
+
+// fetchAccrualBatch claims a batch of unfinished orders for this instance.
+// SKIP LOCKED keeps replicas from blocking on each other's claims, and the
+// lease lets another instance take the orders over if this one dies before
+// releasing them. The batch is kept small relative to the worker count so it
+// is processed well within the lease.
+func (s *Server) fetchAccrualBatch(ctx context.Context) ([]accrualJob, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`UPDATE orders
+		 SET claimed_by = $1, lease_until = now() + make_interval(secs => $2)
+		 WHERE id IN (
+		     SELECT id
+		     FROM orders
+		     WHERE status IN ('NEW', 'PROCESSING')
+		       AND next_check_at <= now()
+		       AND (lease_until IS NULL OR lease_until < now())
+		     ORDER BY next_check_at
+		     LIMIT $3
+		     FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING id, number, user_id, attempt_count, uploaded_at`,
+		s.instanceID, s.accrualLease().Seconds(), s.accrualWorkerCount()*10,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []accrualJob
+	for rows.Next() {
+		var job accrualJob
+		if err := rows.Scan(&job.id, &job.number, &job.userID, &job.attempts, &job.uploadedAt); err != nil {
+			log.Printf("accrualWorker: scan row: %v", err)
+			continue
+		}
+		batch = append(batch, job)
+	}
+	return batch, rows.Err()
+}
+
+// finishAccrualOrder releases the claim and, for orders that are still
+// pending, schedules the next poll or parks the order when it ran out of
+// attempts or time. reason is kept as the order's last error. It does not
+// take the worker context so claims are still released during shutdown.
+func (s *Server) finishAccrualOrder(job accrualJob, outcome accrualOutcome, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var err error
+	switch {
+	case outcome == accrualRetry && s.shouldParkOrder(job, time.Now()):
+		log.Printf("accrualWorker: parking order %s after %d attempts: %s", job.number, job.attempts+1, reason)
+		_, err = s.db.ExecContext(
+			ctx,
+			`UPDATE orders
+			 SET status = 'PARKED', parked_at = now(), last_error = NULLIF($3, ''),
+			     claimed_by = NULL, lease_until = NULL,
+			     attempt_count = attempt_count + 1
+			 WHERE id = $1 AND claimed_by = $2 AND status IN ('NEW', 'PROCESSING')`,
+			job.id, s.instanceID, reason,
+		)
+	case outcome == accrualRetry:
+		delay := accrualBackoff(job.attempts, s.cfg.AccrualBackoff, s.cfg.AccrualBackoffMax)
+		_, err = s.db.ExecContext(
+			ctx,
+			`UPDATE orders
+			 SET claimed_by = NULL, lease_until = NULL,
+			     attempt_count = attempt_count + 1,
+			     next_check_at = now() + make_interval(secs => $3),
+			     last_error = NULLIF($4, '')
+			 WHERE id = $1 AND claimed_by = $2`,
+			job.id, s.instanceID, delay.Seconds(), reason,
+		)
+	default:
+		_, err = s.db.ExecContext(
+			ctx,
+			`UPDATE orders SET claimed_by = NULL, lease_until = NULL WHERE id = $1 AND claimed_by = $2`,
+			job.id, s.instanceID,
+		)
+	}
+	if err != nil {
+		log.Printf("accrualWorker: release order: %v", err)
+	}
+}
+
+func (s *Server) shouldParkOrder(job accrualJob, now time.Time) bool {
+	if s.cfg.AccrualMaxAttempts > 0 && job.attempts+1 >= s.cfg.AccrualMaxAttempts {
+		return true
+	}
+	return s.cfg.AccrualMaxAge > 0 && !job.uploadedAt.IsZero() && now.Sub(job.uploadedAt) > s.cfg.AccrualMaxAge
+}
+
+// accrualBackoff returns the delay before the next poll of an order that has
+// been polled attempts times: base doubled per attempt, capped at max, with
+// the upper half randomized so orders uploaded together spread out.
+func accrualBackoff(attempts int, base, max time.Duration) time.Duration {
+	if base <= 0 {
+		base = time.Second
+	}
+	if max <= 0 {
+		max = 10 * time.Minute
+	}
+	d := max
+	if attempts < 30 {
+		if exp := time.Duration(float64(base) * math.Pow(2, float64(attempts))); exp > 0 && exp < max {
+			d = exp
+		}
+	}
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// processAccrualOrder polls the accrual system once. For orders that stay
+// pending it also returns a short reason, stored as the order's last error.
+// Workers queue behind a limiter pause until deadline, which keeps the poll
+// within the order's lease; an order that could not be polled by then is
+// released without counting an attempt. An answer that arrived is stored even
+// if workerCtx is cancelled meanwhile.
+func (s *Server) processAccrualOrder(workerCtx context.Context, number string, deadline time.Time) (accrualOutcome, string) {
+	if s.accrualLimiter == nil {
+		return accrualRetry, "accrual system is not configured"
+	}
+
+	pollCtx, cancelPoll := context.WithDeadline(workerCtx, deadline)
+	info, err := s.accrualLimiter.GetOrderInfo(pollCtx, number)
+	cancelPoll()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(workerCtx), 5*time.Second)
+	defer cancel()
+
+	if err != nil {
+		if workerCtx.Err() != nil {
+			return accrualThrottled, ""
+		}
+		if errors.Is(err, context.DeadlineExceeded) && !time.Now().Before(deadline) {
+			log.Printf("accrualWorker: lease on order %s ran out before it was polled", number)
+			return accrualThrottled, ""
+		}
+		var (
+			rl   *accrual.RateLimitError
+			open *accrual.CircuitOpenError
+		)
+		if errors.As(err, &rl) {
+			log.Printf("accrualWorker: rate limit reached for order %s, pausing its route for %s", number, rl.RetryAfter)
+			return accrualThrottled, ""
+		}
+		if errors.As(err, &open) {
+			log.Printf("accrualWorker: accrual system unavailable for order %s, pausing its route for %s", number, open.RetryAfter)
+			return accrualThrottled, ""
+		}
+		log.Printf("accrualWorker: get order info: %v", err)
+		return accrualRetry, err.Error()
+	}
+
+	if info == nil {
+		return accrualRetry, "order is not registered in the accrual system"
+	}
+
+	return s.applyAccrualStatus(ctx, number, info, s.instanceID)
+}
+
+// applyAccrualStatus stores a status reported by the accrual system, whether
+// polled or pushed through the callback. Only pending and parked orders move,
+// so a result that arrives both ways is applied once and a final status is
+// never overwritten. claimedBy fences updates of a poller to the orders it
+// still owns; callbacks pass "".
+func (s *Server) applyAccrualStatus(ctx context.Context, number string, info *accrual.OrderAccrual, claimedBy string) (accrualOutcome, string) {
+	switch info.Status {
+	case accrual.StatusRegistered, accrual.StatusProcessing:
+		// A parked order that comes back starts over with a fresh set of
+		// attempts, like one requeued by an admin.
+		if _, err := s.db.ExecContext(
+			ctx,
+			`UPDATE orders
+			 SET status = 'PROCESSING', parked_at = NULL,
+			     attempt_count = CASE WHEN status = 'PARKED' THEN 0 ELSE attempt_count END,
+			     next_check_at = CASE WHEN status = 'PARKED' THEN now() ELSE next_check_at END,
+			     last_error = CASE WHEN status = 'PARKED' THEN NULL ELSE last_error END
+			 WHERE number = $1 AND status IN ('NEW', 'PROCESSING', 'PARKED')
+			   AND ($2 = '' OR claimed_by = $2)`,
+			number, claimedBy,
+		); err != nil {
+			log.Printf("accrualWorker: update order PROCESSING: %v", err)
+		}
+		return accrualRetry, "accrual status " + string(info.Status)
+	case accrual.StatusInvalid:
+		if _, err := s.db.ExecContext(
+			ctx,
+			`UPDATE orders SET status = 'INVALID', parked_at = NULL
+			 WHERE number = $1 AND status IN ('NEW', 'PROCESSING', 'PARKED')
+			   AND ($2 = '' OR claimed_by = $2)`,
+			number, claimedBy,
+		); err != nil {
+			log.Printf("accrualWorker: update order INVALID: %v", err)
+			return accrualRetry, "store status: " + err.Error()
+		}
+		return accrualFinal, ""
+	case accrual.StatusProcessed:
+		var accrualVal money.Amount
+		if info.Accrual != nil {
+			accrualVal = *info.Accrual
+		}
+		if accrualVal.Sign() < 0 {
+			log.Printf("accrualWorker: negative accrual %s for order %s", accrualVal, number)
+			return accrualRetry, "negative accrual " + accrualVal.String()
+		}
+
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			log.Printf("accrualWorker: begin tx: %v", err)
+			return accrualRetry, "store status: " + err.Error()
+		}
+		defer tx.Rollback()
+
+		var orderID, userID int64
+		err = tx.QueryRowContext(
+			ctx,
+			`UPDATE orders
+			 SET status = 'PROCESSED',
+			     accrual = $1,
+			     parked_at = NULL
+			 WHERE number = $2 AND status IN ('NEW', 'PROCESSING', 'PARKED')
+			   AND ($3 = '' OR claimed_by = $3)
+			 RETURNING id, user_id`,
+			accrualVal, number, claimedBy,
+		).Scan(&orderID, &userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Already final, or claimed by someone else.
+			return accrualFinal, ""
+		}
+		if err != nil {
+			log.Printf("accrualWorker: update order PROCESSED: %v", err)
+			return accrualRetry, "store status: " + err.Error()
+		}
+
+		if accrualVal.Sign() > 0 {
+			if _, err := postLedger(ctx, tx, ledgerPosting{
+				UserID:  userID,
+				Kind:    ledgerAccrual,
+				OrderID: orderID,
+				Amount:  accrualVal,
+			}); err != nil {
+				log.Printf("accrualWorker: %v", err)
+				return accrualRetry, "store status: " + err.Error()
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("accrualWorker: commit tx: %v", err)
+			return accrualRetry, "store status: " + err.Error()
+		}
+		return accrualFinal, ""
+	}
+
+	log.Printf("accrualWorker: unknown status %q for order %s", info.Status, number)
+	return accrualRetry, "unknown accrual status " + string(info.Status)
+}
@@ -0,0 +1,439 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/accrual"
+	"gophermart/internal/config"
+	"gophermart/internal/money"
+)
+
+func newTestAccrualServer(t *testing.T, db *sql.DB, handler http.HandlerFunc) *Server {
+	t.Helper()
+
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	cl, err := accrual.New(ts.URL)
+	if err != nil {
+		t.Fatalf("accrual.New() error = %v", err)
+	}
+	return &Server{
+		cfg:            &config.Config{AccrualWorkers: 3},
+		db:             db,
+		mux:            http.NewServeMux(),
+		accrualLimiter: accrual.NewLimiter(cl, 0, 1, nil),
+		instanceID:     "test-instance",
+	}
+}
+
+func expectLeaseRenewal(mock sqlmock.Sqlmock, id int64, rows int64) {
+	mock.ExpectExec(`UPDATE orders SET lease_until = now\(\) \+ make_interval\(secs => \$3\)\s+WHERE id = \$1 AND claimed_by = \$2 AND lease_until > now\(\)`).
+		WithArgs(id, "test-instance", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, rows))
+}
+
+func TestServer_dispatchAccrualBatch_concurrent(t *testing.T) {
+	var (
+		inFlight, peak atomic.Int32
+		arrived        sync.WaitGroup
+	)
+	arrived.Add(3)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+	for id := 1; id <= 3; id++ {
+		expectLeaseRenewal(mock, int64(id), 1)
+		mock.ExpectExec(`UPDATE orders\s+SET claimed_by = NULL, lease_until = NULL,\s+attempt_count = attempt_count \+ 1`).
+			WithArgs(int64(id), "test-instance", sqlmock.AnyArg(), "order is not registered in the accrual system").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	s := newTestAccrualServer(t, db, func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+
+		// Hold every request until all three workers are inside, which only
+		// happens if they really run in parallel.
+		arrived.Done()
+		done := make(chan struct{})
+		go func() { arrived.Wait(); close(done) }()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	jobs := make(chan accrualJob)
+	defer close(jobs)
+	for i := 0; i < s.accrualWorkerCount(); i++ {
+		go s.runAccrualWorker(context.Background(), jobs)
+	}
+
+	s.dispatchAccrualBatch(context.Background(), jobs, []accrualJob{
+		{id: 1, number: "79927398713"},
+		{id: 2, number: "2377225624"},
+		{id: 3, number: "12345678903"},
+	})
+
+	if got := peak.Load(); got != 3 {
+		t.Errorf("peak concurrent requests = %d, want 3", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("claims not released: %v", err)
+	}
+}
+
+func TestServer_processAccrualOrder_rateLimitPausesWorkers(t *testing.T) {
+	var calls atomic.Int32
+	s := newTestAccrualServer(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	if got, _ := s.processAccrualOrder(context.Background(), "79927398713", time.Now().Add(time.Minute)); got != accrualThrottled {
+		t.Errorf("processAccrualOrder() = %v, want accrualThrottled", got)
+	}
+
+	st := s.accrualLimiter.State()
+	if st.PausedUntil == nil {
+		t.Fatal("limiter is not paused after 429")
+	}
+	if d := time.Until(*st.PausedUntil); d <= 0 || d > time.Second {
+		t.Errorf("pause remaining = %v, want (0, 1s]", d)
+	}
+
+	start := time.Now()
+	s.processAccrualOrder(context.Background(), "79927398713", time.Now().Add(time.Minute))
+	if waited := time.Since(start); waited < 500*time.Millisecond {
+		t.Errorf("next poll after %v, want to honour Retry-After", waited)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("accrual calls = %d, want 2", got)
+	}
+}
+
+func TestServer_runAccrualWorker_dropsLapsedLease(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	expectLeaseRenewal(mock, 1, 0)
+	mock.ExpectExec(`UPDATE orders SET claimed_by = NULL, lease_until = NULL WHERE id = \$1 AND claimed_by = \$2`).
+		WithArgs(int64(1), "test-instance").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	var calls atomic.Int32
+	s := newTestAccrualServer(t, db, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	jobs := make(chan accrualJob)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runAccrualWorker(context.Background(), jobs)
+	}()
+	s.dispatchAccrualBatch(context.Background(), jobs, []accrualJob{{id: 1, number: "79927398713"}})
+	close(jobs)
+	<-done
+
+	if got := calls.Load(); got != 0 {
+		t.Errorf("accrual calls = %d, want 0 for an order whose lease lapsed", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestServer_processAccrualOrder_leaseDeadline(t *testing.T) {
+	s := newTestAccrualServer(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	if got, _ := s.processAccrualOrder(context.Background(), "79927398713", time.Now().Add(time.Minute)); got != accrualThrottled {
+		t.Fatalf("processAccrualOrder() = %v, want accrualThrottled", got)
+	}
+
+	// The limiter is paused for a minute now; the next poll must give up once
+	// the lease deadline passes instead of waiting the pause out.
+	start := time.Now()
+	got, _ := s.processAccrualOrder(context.Background(), "79927398713", start.Add(100*time.Millisecond))
+	if got != accrualThrottled {
+		t.Errorf("processAccrualOrder() = %v, want accrualThrottled", got)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Errorf("processAccrualOrder() waited %v past the lease deadline", waited)
+	}
+}
+
+func TestServer_fetchAccrualBatch_claimsForInstance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`UPDATE orders\s+SET claimed_by = \$1, lease_until = now\(\) \+ make_interval\(secs => \$2\)(.|\n)*next_check_at <= now\(\)(.|\n)*FOR UPDATE SKIP LOCKED`).
+		WithArgs("test-instance", float64(120), 30).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "number", "user_id", "attempt_count", "uploaded_at"}).
+			AddRow(1, "79927398713", 7, 2, time.Now()))
+
+	s := &Server{cfg: &config.Config{AccrualWorkers: 3}, db: db, instanceID: "test-instance"}
+
+	batch, err := s.fetchAccrualBatch(context.Background())
+	if err != nil {
+		t.Fatalf("fetchAccrualBatch() error = %v", err)
+	}
+	if len(batch) != 1 || batch[0].id != 1 || batch[0].number != "79927398713" || batch[0].userID != 7 || batch[0].attempts != 2 {
+		t.Errorf("fetchAccrualBatch() = %+v", batch)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestServer_processAccrualOrder_fencedByClaim(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	// A lease that expired and was taken over by another replica leaves
+	// claimed_by pointing elsewhere, so this update must not match.
+	mock.ExpectExec(`UPDATE orders SET status = 'INVALID', parked_at = NULL\s+WHERE number = \$1 AND status IN \('NEW', 'PROCESSING', 'PARKED'\)\s+AND \(\$2 = '' OR claimed_by = \$2\)`).
+		WithArgs("79927398713", "test-instance").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	s := newTestAccrualServer(t, db, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"order":"79927398713","status":"INVALID"}`))
+	})
+
+	if got, _ := s.processAccrualOrder(context.Background(), "79927398713", time.Now().Add(time.Minute)); got != accrualFinal {
+		t.Errorf("processAccrualOrder() = %v, want accrualFinal", got)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestAccrualBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		wantMin  time.Duration
+		wantMax  time.Duration
+	}{
+		{name: "first retry", attempts: 0, wantMin: 500 * time.Millisecond, wantMax: time.Second},
+		{name: "doubles", attempts: 3, wantMin: 4 * time.Second, wantMax: 8 * time.Second},
+		{name: "capped", attempts: 20, wantMin: 5 * time.Minute, wantMax: 10 * time.Minute},
+		{name: "huge attempt count", attempts: 1000, wantMin: 5 * time.Minute, wantMax: 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := accrualBackoff(tt.attempts, time.Second, 10*time.Minute)
+				if got < tt.wantMin || got > tt.wantMax {
+					t.Fatalf("accrualBackoff(%d) = %v, want in [%v, %v]", tt.attempts, got, tt.wantMin, tt.wantMax)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_finishAccrualOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		outcome accrualOutcome
+		query   string
+		args    []driver.Value
+	}{
+		{
+			name:    "pending order is rescheduled",
+			outcome: accrualRetry,
+			query:   `attempt_count = attempt_count \+ 1,\s+next_check_at = now\(\) \+ make_interval\(secs => \$3\)`,
+			args:    []driver.Value{int64(4), "test-instance", sqlmock.AnyArg(), "accrual status REGISTERED"},
+		},
+		{
+			name:    "out of attempts",
+			cfg:     config.Config{AccrualMaxAttempts: 2},
+			outcome: accrualRetry,
+			query:   `SET status = 'PARKED', parked_at = now\(\), last_error = NULLIF\(\$3, ''\)(.|\n)*AND status IN \('NEW', 'PROCESSING'\)`,
+			args:    []driver.Value{int64(4), "test-instance", "accrual status REGISTERED"},
+		},
+		{
+			name:    "throttled order keeps its schedule",
+			outcome: accrualThrottled,
+			query:   `UPDATE orders SET claimed_by = NULL, lease_until = NULL WHERE id = \$1 AND claimed_by = \$2`,
+			args:    []driver.Value{int64(4), "test-instance"},
+		},
+		{
+			name:    "final order is released",
+			outcome: accrualFinal,
+			query:   `UPDATE orders SET claimed_by = NULL, lease_until = NULL WHERE id = \$1 AND claimed_by = \$2`,
+			args:    []driver.Value{int64(4), "test-instance"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectExec(tt.query).WithArgs(tt.args...).WillReturnResult(sqlmock.NewResult(0, 1))
+
+			s := &Server{cfg: &tt.cfg, db: db, instanceID: "test-instance"}
+			s.finishAccrualOrder(accrualJob{id: 4, attempts: 1, uploadedAt: time.Now()}, tt.outcome, "accrual status REGISTERED")
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_shouldParkOrder(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		cfg  config.Config
+		job  accrualJob
+		want bool
+	}{
+		{name: "limits disabled", job: accrualJob{attempts: 1000, uploadedAt: now.Add(-1000 * time.Hour)}},
+		{name: "below attempt limit", cfg: config.Config{AccrualMaxAttempts: 5}, job: accrualJob{attempts: 3}},
+		{name: "last attempt", cfg: config.Config{AccrualMaxAttempts: 5}, job: accrualJob{attempts: 4}, want: true},
+		{name: "young order", cfg: config.Config{AccrualMaxAge: time.Hour}, job: accrualJob{uploadedAt: now.Add(-time.Minute)}},
+		{name: "old order", cfg: config.Config{AccrualMaxAge: time.Hour}, job: accrualJob{uploadedAt: now.Add(-2 * time.Hour)}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{cfg: &tt.cfg}
+			if got := s.shouldParkOrder(tt.job, now); got != tt.want {
+				t.Errorf("shouldParkOrder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_accrualWorker_shutdownReleasesClaims(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`UPDATE orders\s+SET claimed_by = \$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "number", "user_id", "attempt_count", "uploaded_at"}).
+			AddRow(1, "79927398713", 7, 0, time.Now()).
+			AddRow(2, "2377225624", 7, 0, time.Now()))
+	mock.MatchExpectationsInOrder(false)
+	expectLeaseRenewal(mock, 1, 1)
+	for id := 1; id <= 2; id++ {
+		mock.ExpectExec(`UPDATE orders SET claimed_by = NULL, lease_until = NULL WHERE id = \$1 AND claimed_by = \$2`).
+			WithArgs(int64(id), "test-instance").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	arrived := make(chan struct{}, 1)
+	s := newTestAccrualServer(t, db, func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-r.Context().Done()
+	})
+	s.cfg.AccrualWorkers = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.accrualWorker(ctx)
+	}()
+
+	<-arrived
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accrualWorker() did not return after cancel")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("claims not released: %v", err)
+	}
+}
+
+func TestServer_processAccrualOrder_provider(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE orders\s+SET status = 'PROCESSED'`).
+		WithArgs("500", "79927398713", "test-instance").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(int64(1), int64(7)))
+	expectLedgerPosting(mock, 1, 7, ledgerAccrual, 1, 0, money.FromInt(500), accountIssued)
+	mock.ExpectCommit()
+
+	accrualVal := money.FromInt(500)
+	provider := accrual.NewStaticProvider([]accrual.OrderAccrual{
+		{Order: "79927398713", Status: accrual.StatusProcessed, Accrual: &accrualVal},
+	})
+	s := &Server{
+		cfg:             &config.Config{},
+		db:              db,
+		accrualProvider: provider,
+		accrualLimiter:  accrual.NewLimiter(provider, 0, 1, nil),
+		instanceID:      "test-instance",
+	}
+
+	if got, _ := s.processAccrualOrder(context.Background(), "79927398713", time.Now().Add(time.Minute)); got != accrualFinal {
+		t.Errorf("processAccrualOrder() = %v, want accrualFinal", got)
+	}
+	if got, reason := s.processAccrualOrder(context.Background(), "2377225624", time.Now().Add(time.Minute)); got != accrualRetry || reason == "" {
+		t.Errorf("processAccrualOrder() for unknown order = %v, %q, want accrualRetry with a reason", got, reason)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
@@ -0,0 +1,490 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gophermart/internal/policy"
+)
+
+const (
+	roleUser    = "user"
+	roleSupport = "support"
+	roleAdmin   = "admin"
+)
+
+// withRole must be layered on withAuth; it lets the request through only when
+// the authenticated user has one of the given roles.
+func (s *Server) withRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := sessionFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		for _, role := range roles {
+			if sess.Role == role {
+				next(w, r)
+				return
+			}
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+func (s *Server) withStaffAuth(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return s.withInteractiveAuth(s.withRole(next, roles...))
+}
+
+// promoteAdmins gives the admin role to the configured logins so a fresh
+// deployment has someone who can use the admin API.
+func (s *Server) promoteAdmins(ctx context.Context) error {
+	if len(s.cfg.AdminLogins) == 0 {
+		return nil
+	}
+	logins := make([]string, 0, len(s.cfg.AdminLogins))
+	for _, l := range s.cfg.AdminLogins {
+		logins = append(logins, policy.NormalizeLogin(l))
+	}
+	_, err := s.db.ExecContext(
+		ctx,
+		`UPDATE users SET role = 'admin' WHERE lower(login) = ANY($1) AND role <> 'admin'`,
+		logins,
+	)
+	return err
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// audit records an admin action. Actions that change data pass their
+// transaction, so the record is written only if the action is.
+func (s *Server) audit(ctx context.Context, ex execer, r *http.Request, action string, targetUserID int64, details map[string]any) error {
+	sess, _ := sessionFromContext(r.Context())
+
+	if details == nil {
+		details = map[string]any{}
+	}
+	raw, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("marshal audit details: %w", err)
+	}
+
+	var target sql.NullInt64
+	if targetUserID > 0 {
+		target = sql.NullInt64{Int64: targetUserID, Valid: true}
+	}
+
+	if _, err := ex.ExecContext(
+		ctx,
+		`INSERT INTO admin_audit (actor_id, action, target_user_id, details) VALUES ($1, $2, $3, $4)`,
+		sess.UserID, action, target, string(raw),
+	); err != nil {
+		return fmt.Errorf("insert audit record: %w", err)
+	}
+	return nil
+}
+
+func pathUserID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+type adminUserResponse struct {
+	ID        int64  `json:"id"`
+	Login     string `json:"login"`
+	Role      string `json:"role"`
+	CreatedAt string `json:"created_at"`
+}
+
+func (s *Server) handleAdminUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := s.audit(ctx, s.db, r, "user.view", userID, nil); err != nil {
+		log.Printf("admin: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		resp      adminUserResponse
+		createdAt time.Time
+	)
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT id, login, role, created_at FROM users WHERE id = $1`,
+		userID,
+	).Scan(&resp.ID, &resp.Login, &resp.Role, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	resp.CreatedAt = createdAt.Format(time.RFC3339)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) handleAdminUserOrders(w http.ResponseWriter, r *http.Request) {
+	s.serveAdminLookup(w, r, "user.orders", s.writeOrders)
+}
+
+func (s *Server) handleAdminUserBalance(w http.ResponseWriter, r *http.Request) {
+	s.serveAdminLookup(w, r, "user.balance", s.writeBalance)
+}
+
+func (s *Server) handleAdminUserWithdrawals(w http.ResponseWriter, r *http.Request) {
+	s.serveAdminLookup(w, r, "user.withdrawals", s.writeWithdrawals)
+}
+
+func (s *Server) handleAdminUserLedger(w http.ResponseWriter, r *http.Request) {
+	s.serveAdminLookup(w, r, "user.ledger", s.writeLedger)
+}
+
+// serveAdminLookup reuses the user-facing read handlers for the user named in
+// the path, after recording who looked.
+func (s *Server) serveAdminLookup(
+	w http.ResponseWriter,
+	r *http.Request,
+	action string,
+	write func(http.ResponseWriter, *http.Request, int64),
+) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := s.audit(ctx, s.db, r, action, userID, nil); err != nil {
+		log.Printf("admin: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	write(w, r, userID)
+}
+
+func (s *Server) handleAdminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := revokeUserSessions(ctx, tx, userID, ""); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := s.audit(ctx, tx, r, "user.sessions.revoke", userID, nil); err != nil {
+		log.Printf("admin: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type setRoleRequest struct {
+	Role string `json:"role"`
+}
+
+func (s *Server) handleAdminSetRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var req setRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch req.Role {
+	case roleUser, roleSupport, roleAdmin:
+	default:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `UPDATE users SET role = $1 WHERE id = $2`, req.Role, userID)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if err := s.audit(ctx, tx, r, "user.role.set", userID, map[string]any{"role": req.Role}); err != nil {
+		log.Printf("admin: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminReprocessOrder puts an order back in the accrual queue, e.g.
+// after the accrual system corrected its data. An accrual already credited is
+// reversed and credited again once the order is processed; if the user has
+// spent it in the meantime the order is left alone with 409.
+func (s *Server) handleAdminReprocessOrder(w http.ResponseWriter, r *http.Request) {
+	s.requeueOrder(w, r, "order.reprocess", false)
+}
+
+// handleAdminRequeueOrder gives a parked order a fresh set of attempts.
+func (s *Server) handleAdminRequeueOrder(w http.ResponseWriter, r *http.Request) {
+	s.requeueOrder(w, r, "order.requeue", true)
+}
+
+func (s *Server) requeueOrder(w http.ResponseWriter, r *http.Request, action string, onlyParked bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	number := r.PathValue("number")
+	if !isValidOrderNumber(number) {
+		http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// The row stays locked until commit, so the worker cannot finish the
+	// order between the status check and the reset.
+	var (
+		orderID int64
+		userID  int64
+		status  string
+	)
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT id, user_id, status FROM orders WHERE number = $1 FOR UPDATE`,
+		number,
+	).Scan(&orderID, &userID, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if onlyParked && status != "PARKED" {
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE orders
+		 SET status = 'NEW', accrual = NULL, claimed_by = NULL, lease_until = NULL,
+		     attempt_count = 0, next_check_at = now(), last_error = NULL, parked_at = NULL
+		 WHERE id = $1`,
+		orderID,
+	); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Points already spent are not clawed back into a negative balance; the
+	// order stays as it is and the admin has to settle it first.
+	err = reverseOrderAccruals(ctx, tx, userID, orderID, action)
+	if errors.Is(err, errOverdraft) {
+		http.Error(w, "the order's points have already been spent", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("admin: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.audit(ctx, tx, r, action, userID, map[string]any{"order": number, "status": status}); err != nil {
+		log.Printf("admin: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type parkedOrderResponse struct {
+	Number       string  `json:"number"`
+	UserID       int64   `json:"user_id"`
+	AttemptCount int     `json:"attempt_count"`
+	LastError    *string `json:"last_error,omitempty"`
+	UploadedAt   string  `json:"uploaded_at"`
+	ParkedAt     string  `json:"parked_at"`
+}
+
+func (s *Server) handleAdminParkedOrders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := s.audit(ctx, s.db, r, "orders.parked.list", 0, nil); err != nil {
+		log.Printf("admin: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT number, user_id, attempt_count, last_error, uploaded_at, parked_at
+		 FROM orders
+		 WHERE status = 'PARKED'
+		 ORDER BY parked_at DESC
+		 LIMIT 500`,
+	)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	items := []parkedOrderResponse{}
+	for rows.Next() {
+		var (
+			item       parkedOrderResponse
+			lastError  sql.NullString
+			uploadedAt time.Time
+			parkedAt   sql.NullTime
+		)
+		if err := rows.Scan(&item.Number, &item.UserID, &item.AttemptCount, &lastError, &uploadedAt, &parkedAt); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if lastError.Valid {
+			item.LastError = &lastError.String
+		}
+		item.UploadedAt = uploadedAt.Format(time.RFC3339)
+		if parkedAt.Valid {
+			item.ParkedAt = parkedAt.Time.Format(time.RFC3339)
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(items); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) handleAdminAccrualLimiter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	if s.accrualLimiter == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.accrualLimiter.State()); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
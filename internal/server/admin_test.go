@@ -0,0 +1,332 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/config"
+)
+
+func withTestRole(r *http.Request, userID int64, role string) *http.Request {
+	sess := &session{ID: "test-session", UserID: userID, Role: role}
+	return r.WithContext(withSession(r.Context(), sess))
+}
+
+func TestServer_withRole(t *testing.T) {
+	tests := []struct {
+		name           string
+		role           string
+		allowed        []string
+		wantStatusCode int
+	}{
+		{name: "admin on admin route", role: roleAdmin, allowed: []string{roleAdmin}, wantStatusCode: http.StatusOK},
+		{name: "support on lookup route", role: roleSupport, allowed: []string{roleSupport, roleAdmin}, wantStatusCode: http.StatusOK},
+		{name: "support on admin route", role: roleSupport, allowed: []string{roleAdmin}, wantStatusCode: http.StatusForbidden},
+		{name: "plain user", role: roleUser, allowed: []string{roleSupport, roleAdmin}, wantStatusCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{cfg: &config.Config{}, mux: http.NewServeMux()}
+
+			handler := s.withRole(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}, tt.allowed...)
+
+			req := withTestRole(httptest.NewRequest(http.MethodGet, "/api/admin/users/1", nil), 1, tt.role)
+			w := httptest.NewRecorder()
+
+			handler(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("withRole() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+		})
+	}
+
+	t.Run("no principal", func(t *testing.T) {
+		s := &Server{cfg: &config.Config{}, mux: http.NewServeMux()}
+		handler := s.withRole(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}, roleAdmin)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/users/1", nil).WithContext(context.Background())
+		w := httptest.NewRecorder()
+
+		handler(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("withRole() status = %v, want %v", w.Code, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestServer_handleAdminUserBalance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(`INSERT INTO admin_audit`).
+		WithArgs(int64(9), "user.balance", sql.NullInt64{Int64: 1, Valid: true}, "{}").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectLedgerBalance(mock, 1, "500.5", "42")
+
+	s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux()}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/users/1/balance", nil)
+	req.SetPathValue("id", "1")
+	req = withTestRole(req, 9, roleSupport)
+	w := httptest.NewRecorder()
+
+	s.handleAdminUserBalance(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("handleAdminUserBalance() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestServer_handleAdminRevokeSessions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE sessions\s+SET revoked_at = now\(\)`).
+		WithArgs(int64(2), "").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`INSERT INTO admin_audit`).
+		WithArgs(int64(9), "user.sessions.revoke", sql.NullInt64{Int64: 2, Valid: true}, "{}").
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux()}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/users/2/sessions/revoke", nil)
+	req.SetPathValue("id", "2")
+	req = withTestRole(req, 9, roleAdmin)
+	w := httptest.NewRecorder()
+
+	s.handleAdminRevokeSessions(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("handleAdminRevokeSessions() status = %v, want %v", w.Code, http.StatusInternalServerError)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestServer_handleAdminSetRole(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+	}{
+		{
+			name: "promote to support",
+			body: `{"role":"support"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE users SET role`).
+					WithArgs(roleSupport, int64(2)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO admin_audit`).
+					WithArgs(int64(9), "user.role.set", sql.NullInt64{Int64: 2, Valid: true}, `{"role":"support"}`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "unknown user",
+			body: `{"role":"user"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE users SET role`).
+					WithArgs(roleUser, int64(2)).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:           "unknown role",
+			body:           `{"role":"root"}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			if tt.setupMock != nil {
+				tt.setupMock(mock)
+			}
+
+			s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux()}
+
+			req := httptest.NewRequest(http.MethodPut, "/api/admin/users/2/role", strings.NewReader(tt.body))
+			req.SetPathValue("id", "2")
+			req = withTestRole(req, 9, roleAdmin)
+			w := httptest.NewRecorder()
+
+			s.handleAdminSetRole(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleAdminSetRole() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_handleAdminRequeueOrder(t *testing.T) {
+	expectOrder := func(mock sqlmock.Sqlmock, status string) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT id, user_id, status FROM orders WHERE number = \$1 FOR UPDATE`).
+			WithArgs("79927398713").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "status"}).AddRow(7, 2, status))
+	}
+	expectReset := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(`UPDATE orders\s+SET status = 'NEW'(.|\n)*attempt_count = 0`).
+			WithArgs(int64(7)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	tests := []struct {
+		name           string
+		reprocess      bool
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+	}{
+		{
+			name: "parked order",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectOrder(mock, "PARKED")
+				expectReset(mock)
+				mock.ExpectQuery(`SELECT t.id, e.amount\s+FROM ledger_transactions t`).
+					WithArgs(int64(7)).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "amount"}))
+				mock.ExpectExec(`INSERT INTO admin_audit`).
+					WithArgs(int64(9), "order.requeue", sql.NullInt64{Int64: 2, Valid: true}, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusAccepted,
+		},
+		{
+			name: "order is not parked",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectOrder(mock, "PROCESSED")
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+		{
+			name: "unknown order",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, user_id, status FROM orders`).
+					WithArgs("79927398713").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:      "reprocess reverses the accrual",
+			reprocess: true,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectOrder(mock, "PROCESSED")
+				expectReset(mock)
+				mock.ExpectQuery(`SELECT t.id, e.amount\s+FROM ledger_transactions t`).
+					WithArgs(int64(7)).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "amount"}).AddRow(int64(10), "500"))
+				expectLedgerBalance(mock, 2, "500", "0")
+				mock.ExpectQuery(`INSERT INTO ledger_transactions \(user_id, kind, order_id, withdrawal_id, reverses_id, note\)`).
+					WithArgs(int64(10), ledgerReversal, "order.reprocess").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(11)))
+				mock.ExpectExec(`INSERT INTO ledger_entries`).
+					WithArgs(int64(11), int64(10)).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec(`INSERT INTO admin_audit`).
+					WithArgs(int64(9), "order.reprocess", sql.NullInt64{Int64: 2, Valid: true}, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusAccepted,
+		},
+		{
+			name:      "reprocess after the points were spent",
+			reprocess: true,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectOrder(mock, "PROCESSED")
+				expectReset(mock)
+				mock.ExpectQuery(`SELECT t.id, e.amount\s+FROM ledger_transactions t`).
+					WithArgs(int64(7)).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "amount"}).AddRow(int64(10), "500"))
+				expectLedgerBalance(mock, 2, "120", "380")
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			tt.setupMock(mock)
+
+			s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux()}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/admin/orders/79927398713/requeue", nil)
+			req.SetPathValue("number", "79927398713")
+			req = withTestRole(req, 9, roleAdmin)
+			w := httptest.NewRecorder()
+
+			if tt.reprocess {
+				s.handleAdminReprocessOrder(w, req)
+			} else {
+				s.handleAdminRequeueOrder(w, req)
+			}
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleAdminRequeueOrder() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix = "gm_"
+
+	apiKeyScopeRead      = "read"
+	apiKeyScopeReadWrite = "read_write"
+)
+
+// serveWithAPIKey authenticates a machine client. Keys look like
+// gm_<prefix>_<secret>; the prefix is stored in clear to find the row and is
+// safe to show in listings, the whole key is only stored as a hash.
+func (s *Server) serveWithAPIKey(w http.ResponseWriter, r *http.Request, token string, next http.HandlerFunc) {
+	prefix, ok := apiKeyLookupPrefix(token)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var (
+		keyID   int64
+		userID  int64
+		keyHash string
+		scope   string
+		role    string
+	)
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT k.id, k.user_id, k.key_hash, k.scope, u.role
+		 FROM api_keys k
+		 JOIN users u ON u.id = k.user_id
+		 WHERE k.prefix = $1 AND k.revoked_at IS NULL`,
+		prefix,
+	).Scan(&keyID, &userID, &keyHash, &scope, &role)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(keyHash), []byte(hashToken(token))) != 1 {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if s.apiKeyLimiter != nil {
+		if ok, wait := s.apiKeyLimiter.Allow(strconv.FormatInt(keyID, 10)); !ok {
+			writeTooManyRequests(w, wait)
+			return
+		}
+	}
+
+	readOnly := scope == apiKeyScopeRead
+	if readOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if _, err := s.db.ExecContext(
+		ctx,
+		`UPDATE api_keys SET last_used_at = now() WHERE id = $1`,
+		keyID,
+	); err != nil {
+		log.Printf("update api key last used: %v", err)
+	}
+
+	sess := &session{UserID: userID, Role: role, APIKeyID: keyID, ReadOnly: readOnly}
+	next(w, r.WithContext(withSession(r.Context(), sess)))
+}
+
+func apiKeyLookupPrefix(token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, apiKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok || prefix == "" || secret == "" {
+		return "", false
+	}
+	return prefix, true
+}
+
+type createAPIKeyRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+type apiKeyResponse struct {
+	ID         int64   `json:"id"`
+	Name       string  `json:"name"`
+	Prefix     string  `json:"prefix"`
+	Scope      string  `json:"scope"`
+	Key        string  `json:"key,omitempty"`
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt *string `json:"last_used_at,omitempty"`
+}
+
+func (s *Server) handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.handleCreateAPIKey(w, r)
+	case http.MethodGet:
+		s.handleListAPIKeys(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	}
+}
+
+func (s *Server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID, _ := s.currentUserID(r)
+
+	var req createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = apiKeyScopeRead
+	}
+	if req.Scope != apiKeyScopeRead && req.Scope != apiKeyScopeReadWrite {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	random, err := newRandomID()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	prefix, secret := random[:8], random[8:]
+	key := apiKeyPrefix + prefix + "_" + secret
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var (
+		id        int64
+		createdAt time.Time
+	)
+	if err := s.db.QueryRowContext(
+		ctx,
+		`INSERT INTO api_keys (user_id, name, prefix, key_hash, scope)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING id, created_at`,
+		userID, req.Name, prefix, hashToken(key), req.Scope,
+	).Scan(&id, &createdAt); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(apiKeyResponse{
+		ID:        id,
+		Name:      req.Name,
+		Prefix:    apiKeyPrefix + prefix,
+		Scope:     req.Scope,
+		Key:       key,
+		CreatedAt: createdAt.Format(time.RFC3339),
+	}); err != nil {
+		log.Printf("write api key: %v", err)
+	}
+}
+
+func (s *Server) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userID, _ := s.currentUserID(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT id, name, prefix, scope, created_at, last_used_at
+		 FROM api_keys
+		 WHERE user_id = $1 AND revoked_at IS NULL
+		 ORDER BY created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	items := []apiKeyResponse{}
+	for rows.Next() {
+		var (
+			item       apiKeyResponse
+			createdAt  time.Time
+			lastUsedAt sql.NullTime
+		)
+		if err := rows.Scan(&item.ID, &item.Name, &item.Prefix, &item.Scope, &createdAt, &lastUsedAt); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		item.Prefix = apiKeyPrefix + item.Prefix
+		item.CreatedAt = createdAt.Format(time.RFC3339)
+		if lastUsedAt.Valid {
+			v := lastUsedAt.Time.Format(time.RFC3339)
+			item.LastUsedAt = &v
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(items); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := s.currentUserID(r)
+
+	keyID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || keyID <= 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE api_keys SET revoked_at = now()
+		 WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`,
+		keyID, userID,
+	)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
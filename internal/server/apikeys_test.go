@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/config"
+	"gophermart/internal/ratelimit"
+)
+
+func TestServer_withAuth_apiKey(t *testing.T) {
+	const key = "gm_abcd1234_secretpart"
+
+	expectKey := func(scope string) func(mock sqlmock.Sqlmock) {
+		return func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(`SELECT k.id, k.user_id, k.key_hash, k.scope, u.role\s+FROM api_keys`).
+				WithArgs("abcd1234").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "key_hash", "scope", "role"}).
+					AddRow(5, 1, hashToken(key), scope, roleUser))
+		}
+	}
+	expectLastUsed := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(`UPDATE api_keys SET last_used_at`).
+			WithArgs(int64(5)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		header         string
+		limiter        *ratelimit.Limiter
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+	}{
+		{
+			name:   "read key on GET",
+			method: http.MethodGet,
+			header: "Bearer " + key,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectKey(apiKeyScopeRead)(mock)
+				expectLastUsed(mock)
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "read key on POST",
+			method:         http.MethodPost,
+			header:         "Bearer " + key,
+			setupMock:      expectKey(apiKeyScopeRead),
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name:   "read-write key on POST",
+			method: http.MethodPost,
+			header: "Bearer " + key,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectKey(apiKeyScopeReadWrite)(mock)
+				expectLastUsed(mock)
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "wrong secret",
+			method:         http.MethodGet,
+			header:         "Bearer gm_abcd1234_guessed",
+			setupMock:      expectKey(apiKeyScopeRead),
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:   "revoked or unknown key",
+			method: http.MethodGet,
+			header: "Bearer " + key,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT k.id, k.user_id, k.key_hash, k.scope, u.role`).
+					WithArgs("abcd1234").
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:           "malformed key",
+			method:         http.MethodGet,
+			header:         "Bearer not-a-key",
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:           "rate limited",
+			method:         http.MethodGet,
+			header:         "Bearer " + key,
+			limiter:        exhaustedLimiter("5"),
+			setupMock:      expectKey(apiKeyScopeRead),
+			wantStatusCode: http.StatusTooManyRequests,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			if tt.setupMock != nil {
+				tt.setupMock(mock)
+			}
+
+			s := &Server{
+				cfg:           &config.Config{},
+				db:            db,
+				mux:           http.NewServeMux(),
+				tokens:        newTestSigner(t),
+				apiKeyLimiter: tt.limiter,
+			}
+
+			var got *session
+			handler := s.withAuth(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = sessionFromContext(r.Context())
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(tt.method, "/api/user/orders", nil)
+			req.Header.Set("Authorization", tt.header)
+			w := httptest.NewRecorder()
+
+			handler(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("withAuth() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+			if w.Code == http.StatusOK && (got.UserID != 1 || got.APIKeyID != 5) {
+				t.Errorf("withAuth() session = %+v, want user 1 via key 5", got)
+			}
+			if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Error("withAuth() rate limited without Retry-After")
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func exhaustedLimiter(key string) *ratelimit.Limiter {
+	l := ratelimit.New(1, 1)
+	l.Allow(key)
+	return l
+}
+
+func TestServer_withInteractiveAuth_rejectsAPIKeys(t *testing.T) {
+	const key = "gm_abcd1234_secretpart"
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT k.id, k.user_id, k.key_hash, k.scope, u.role`).
+		WithArgs("abcd1234").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "key_hash", "scope", "role"}).
+			AddRow(5, 1, hashToken(key), apiKeyScopeReadWrite, roleUser))
+	mock.ExpectExec(`UPDATE api_keys SET last_used_at`).
+		WithArgs(int64(5)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux(), tokens: newTestSigner(t)}
+
+	handler := s.withInteractiveAuth(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/api-keys", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+
+	handler(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("withInteractiveAuth() status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestServer_handleCreateAPIKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           createAPIKeyRequest
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+	}{
+		{
+			name: "read-write key",
+			body: createAPIKeyRequest{Name: "partner sync", Scope: apiKeyScopeReadWrite},
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO api_keys`).
+					WithArgs(int64(1), "partner sync", sqlmock.AnyArg(), sqlmock.AnyArg(), apiKeyScopeReadWrite).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, time.Now()))
+			},
+			wantStatusCode: http.StatusCreated,
+		},
+		{
+			name:           "unknown scope",
+			body:           createAPIKeyRequest{Scope: "admin"},
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			if tt.setupMock != nil {
+				tt.setupMock(mock)
+			}
+
+			s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux()}
+
+			bodyBytes, _ := json.Marshal(tt.body)
+			req := withTestUser(httptest.NewRequest(http.MethodPost, "/api/user/api-keys", bytes.NewReader(bodyBytes)), 1)
+			w := httptest.NewRecorder()
+
+			s.handleAPIKeys(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Fatalf("handleAPIKeys() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+
+			if w.Code == http.StatusCreated {
+				var resp apiKeyResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatalf("decode response: %v", err)
+				}
+				prefix, ok := apiKeyLookupPrefix(resp.Key)
+				if !ok || resp.Prefix != apiKeyPrefix+prefix || !strings.HasPrefix(resp.Key, resp.Prefix+"_") {
+					t.Errorf("handleAPIKeys() key %q does not match prefix %q", resp.Key, resp.Prefix)
+				}
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_handleRevokeAPIKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		rowsAffected   int64
+		wantStatusCode int
+	}{
+		{name: "own key", rowsAffected: 1, wantStatusCode: http.StatusNoContent},
+		{name: "someone else's or already revoked", rowsAffected: 0, wantStatusCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectExec(`UPDATE api_keys SET revoked_at = now\(\)`).
+				WithArgs(int64(3), int64(1)).
+				WillReturnResult(sqlmock.NewResult(0, tt.rowsAffected))
+
+			s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux()}
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/user/api-keys/3", nil)
+			req.SetPathValue("id", "3")
+			req = withTestUser(req, 1)
+			w := httptest.NewRecorder()
+
+			s.handleRevokeAPIKey(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleRevokeAPIKey() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
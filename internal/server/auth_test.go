@@ -1,60 +1,154 @@
 package server
 
 import (
+	"database/sql"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/auth"
 	"gophermart/internal/config"
 )
 
+func newTestSigner(t *testing.T) *auth.Signer {
+	t.Helper()
+	signer, err := auth.NewSigner([]string{"test-signing-key"}, time.Hour)
+	if err != nil {
+		t.Fatalf("auth.NewSigner() error = %v", err)
+	}
+	return signer
+}
+
+func authCookie(t *testing.T, s *Server, userID int64, sessionID string) *http.Cookie {
+	t.Helper()
+	token, err := s.tokens.Issue(userID, sessionID)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	return &http.Cookie{Name: authCookieName, Value: token}
+}
+
+func withTestUser(r *http.Request, userID int64) *http.Request {
+	return r.WithContext(withSession(r.Context(), &session{ID: "test-session", UserID: userID}))
+}
+
 func TestServer_withAuth(t *testing.T) {
+	otherSigner, err := auth.NewSigner([]string{"other-key"}, time.Hour)
+	if err != nil {
+		t.Fatalf("auth.NewSigner() error = %v", err)
+	}
+	forged, _ := otherSigner.Issue(1, "s1")
+
 	tests := []struct {
 		name           string
-		cookieValue    string
+		cookieValue    func(t *testing.T, s *Server) string
+		setupMock      func(mock sqlmock.Sqlmock)
 		wantStatusCode int
 	}{
 		{
-			name:           "valid cookie",
-			cookieValue:    "1",
+			name: "active session",
+			cookieValue: func(t *testing.T, s *Server) string {
+				return authCookie(t, s, 1, "s1").Value
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE sessions\s+SET last_seen_at`).
+					WithArgs("s1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "role"}).AddRow(1, roleUser))
+			},
 			wantStatusCode: http.StatusOK,
 		},
+		{
+			name: "revoked, idle or expired session",
+			cookieValue: func(t *testing.T, s *Server) string {
+				return authCookie(t, s, 1, "s1").Value
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE sessions\s+SET last_seen_at`).
+					WithArgs("s1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "session owned by another user",
+			cookieValue: func(t *testing.T, s *Server) string {
+				return authCookie(t, s, 1, "s1").Value
+			},
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE sessions\s+SET last_seen_at`).
+					WithArgs("s1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "role"}).AddRow(2, roleUser))
+			},
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "token without session",
+			cookieValue: func(t *testing.T, s *Server) string {
+				return authCookie(t, s, 1, "").Value
+			},
+			wantStatusCode: http.StatusUnauthorized,
+		},
 		{
 			name:           "no cookie",
-			cookieValue:    "",
+			cookieValue:    func(t *testing.T, s *Server) string { return "" },
 			wantStatusCode: http.StatusUnauthorized,
 		},
 		{
-			name:           "invalid cookie value",
-			cookieValue:    "invalid",
+			name:           "plain user id",
+			cookieValue:    func(t *testing.T, s *Server) string { return "1" },
 			wantStatusCode: http.StatusUnauthorized,
 		},
 		{
-			name:           "zero user id",
-			cookieValue:    "0",
+			name:           "token signed with unknown key",
+			cookieValue:    func(t *testing.T, s *Server) string { return forged },
 			wantStatusCode: http.StatusUnauthorized,
 		},
 		{
-			name:           "negative user id",
-			cookieValue:    "-1",
+			name: "expired token",
+			cookieValue: func(t *testing.T, s *Server) string {
+				token, _ := s.tokens.Sign(auth.Claims{
+					UserID:    1,
+					SessionID: "s1",
+					IssuedAt:  time.Now().Add(-2 * time.Hour).Unix(),
+					ExpiresAt: time.Now().Add(-time.Hour).Unix(),
+				})
+				return token
+			},
 			wantStatusCode: http.StatusUnauthorized,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			if tt.setupMock != nil {
+				tt.setupMock(mock)
+			}
+
 			s := &Server{
-				cfg: &config.Config{},
-				mux: http.NewServeMux(),
+				cfg:    &config.Config{},
+				db:     db,
+				mux:    http.NewServeMux(),
+				tokens: newTestSigner(t),
 			}
 
+			var gotUserID int64
 			handler := s.withAuth(func(w http.ResponseWriter, r *http.Request) {
+				gotUserID, _ = s.currentUserID(r)
 				w.WriteHeader(http.StatusOK)
 			})
 
 			req := httptest.NewRequest(http.MethodGet, "/test", nil)
-			if tt.cookieValue != "" {
-				req.AddCookie(&http.Cookie{Name: "user_id", Value: tt.cookieValue})
+			if v := tt.cookieValue(t, s); v != "" {
+				req.AddCookie(&http.Cookie{Name: authCookieName, Value: v})
 			}
 			w := httptest.NewRecorder()
 
@@ -63,68 +157,98 @@ func TestServer_withAuth(t *testing.T) {
 			if w.Code != tt.wantStatusCode {
 				t.Errorf("withAuth() status = %v, want %v", w.Code, tt.wantStatusCode)
 			}
+			if w.Code == http.StatusOK && gotUserID != 1 {
+				t.Errorf("withAuth() user id = %v, want 1", gotUserID)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
 		})
 	}
 }
 
 func TestServer_currentUserID(t *testing.T) {
+	s := &Server{cfg: &config.Config{}, mux: http.NewServeMux()}
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	if id, ok := s.currentUserID(req); ok || id != 0 {
+		t.Errorf("currentUserID() without session = (%v, %v), want (0, false)", id, ok)
+	}
+
+	req = withTestUser(req, 123)
+	if id, ok := s.currentUserID(req); !ok || id != 123 {
+		t.Errorf("currentUserID() = (%v, %v), want (123, true)", id, ok)
+	}
+}
+
+func TestServer_handleLogout(t *testing.T) {
 	tests := []struct {
-		name   string
-		cookie *http.Cookie
-		wantID int64
-		wantOk bool
+		name      string
+		path      string
+		handler   func(s *Server) http.HandlerFunc
+		setupMock func(mock sqlmock.Sqlmock)
 	}{
 		{
-			name:   "valid cookie",
-			cookie: &http.Cookie{Name: "user_id", Value: "123"},
-			wantID: 123,
-			wantOk: true,
-		},
-		{
-			name:   "no cookie",
-			cookie: nil,
-			wantID: 0,
-			wantOk: false,
-		},
-		{
-			name:   "invalid value",
-			cookie: &http.Cookie{Name: "user_id", Value: "abc"},
-			wantID: 0,
-			wantOk: false,
+			name:    "current session",
+			path:    "/api/user/logout",
+			handler: func(s *Server) http.HandlerFunc { return s.handleLogout },
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE sessions SET revoked_at = now\(\) WHERE id = \$1`).
+					WithArgs("test-session").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
 		},
 		{
-			name:   "zero value",
-			cookie: &http.Cookie{Name: "user_id", Value: "0"},
-			wantID: 0,
-			wantOk: false,
-		},
-		{
-			name:   "negative value",
-			cookie: &http.Cookie{Name: "user_id", Value: "-1"},
-			wantID: 0,
-			wantOk: false,
+			name:    "all sessions",
+			path:    "/api/user/logout/all",
+			handler: func(s *Server) http.HandlerFunc { return s.handleLogoutAll },
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE sessions\s+SET revoked_at = now\(\)\s+WHERE user_id = \$1`).
+					WithArgs(int64(1), "").
+					WillReturnResult(sqlmock.NewResult(0, 3))
+			},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := &Server{
-				cfg: &config.Config{},
-				mux: http.NewServeMux(),
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
 			}
+			defer db.Close()
 
-			req := httptest.NewRequest(http.MethodGet, "/test", nil)
-			if tt.cookie != nil {
-				req.AddCookie(tt.cookie)
+			tt.setupMock(mock)
+
+			s := &Server{
+				cfg:    &config.Config{},
+				db:     db,
+				mux:    http.NewServeMux(),
+				tokens: newTestSigner(t),
 			}
 
-			gotID, gotOk := s.currentUserID(req)
+			req := withTestUser(httptest.NewRequest(http.MethodPost, tt.path, nil), 1)
+			w := httptest.NewRecorder()
+
+			tt.handler(s)(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("status = %v, want %v", w.Code, http.StatusOK)
+			}
 
-			if gotID != tt.wantID {
-				t.Errorf("currentUserID() id = %v, want %v", gotID, tt.wantID)
+			cleared := false
+			for _, c := range w.Result().Cookies() {
+				if c.Name == authCookieName && c.MaxAge < 0 {
+					cleared = true
+				}
+			}
+			if !cleared {
+				t.Error("auth cookie was not cleared")
 			}
-			if gotOk != tt.wantOk {
-				t.Errorf("currentUserID() ok = %v, want %v", gotOk, tt.wantOk)
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
 			}
 		})
 	}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gophermart/internal/accrual"
+)
+
+const (
+	callbackTimestampHeader = "X-Accrual-Timestamp"
+	callbackNonceHeader     = "X-Accrual-Nonce"
+	callbackSignatureHeader = "X-Accrual-Signature"
+
+	maxCallbackBody     = 64 << 10
+	minCallbackNonceLen = 16
+	maxCallbackNonceLen = 128
+)
+
+// signAccrualCallback is the hex HMAC-SHA256 the accrual system sends in
+// X-Accrual-Signature, computed over "<timestamp>.<nonce>.<body>".
+func signAccrualCallback(secret, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) accrualCallbackSkew() time.Duration {
+	if s.cfg.AccrualCallbackSkew > 0 {
+		return s.cfg.AccrualCallbackSkew
+	}
+	return 5 * time.Minute
+}
+
+// accrualCallbackWindow is how long polling of a pending order waits for a
+// callback; 0 while callbacks are disabled.
+func (s *Server) accrualCallbackWindow() time.Duration {
+	if s.cfg.AccrualCallbackSecret == "" {
+		return 0
+	}
+	return s.cfg.AccrualCallbackWindow
+}
+
+// handleAccrualCallback lets the accrual system push an order status in the
+// same format it answers polls with. A callback is accepted once: the
+// timestamp has to be recent and the nonce is remembered for longer than the
+// timestamp stays valid.
+func (s *Server) handleAccrualCallback(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.AccrualCallbackSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCallbackBody+1))
+	if err != nil || len(body) > maxCallbackBody {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	timestamp := r.Header.Get(callbackTimestampHeader)
+	nonce := r.Header.Get(callbackNonceHeader)
+	want := signAccrualCallback(s.cfg.AccrualCallbackSecret, timestamp, nonce, body)
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get(callbackSignatureHeader))) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > s.accrualCallbackSkew() || age < -s.accrualCallbackSkew() {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if len(nonce) < minCallbackNonceLen || len(nonce) > maxCallbackNonceLen {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var info accrual.OrderAccrual
+	if err := json.Unmarshal(body, &info); err != nil || info.Order == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch info.Status {
+	case accrual.StatusRegistered, accrual.StatusProcessing, accrual.StatusInvalid, accrual.StatusProcessed:
+	default:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO accrual_callback_nonces (nonce) VALUES ($1) ON CONFLICT (nonce) DO NOTHING`,
+		nonce,
+	)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+
+	if _, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM accrual_callback_nonces WHERE seen_at < now() - make_interval(secs => $1)`,
+		(2 * s.accrualCallbackSkew()).Seconds(),
+	); err != nil {
+		log.Printf("accrual callback: purge nonces: %v", err)
+	}
+
+	// The nonce only guards callbacks that took effect; one that was not
+	// applied may be delivered again as is.
+	releaseNonce := func() {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM accrual_callback_nonces WHERE nonce = $1`, nonce); err != nil {
+			log.Printf("accrual callback: release nonce: %v", err)
+		}
+	}
+
+	var known bool
+	if err := s.db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM orders WHERE number = $1)`,
+		info.Order,
+	).Scan(&known); err != nil {
+		releaseNonce()
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !known {
+		releaseNonce()
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	outcome, reason := s.applyAccrualStatus(ctx, info.Order, &info, "")
+	if outcome == accrualRetry && (info.Status == accrual.StatusInvalid || info.Status == accrual.StatusProcessed) {
+		log.Printf("accrual callback: order %s: %s", info.Order, reason)
+		releaseNonce()
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// The accrual system is still working on the order and says so; give it
+	// another window before polling.
+	if outcome == accrualRetry && s.accrualCallbackWindow() > 0 {
+		if _, err := s.db.ExecContext(
+			ctx,
+			`UPDATE orders SET next_check_at = now() + make_interval(secs => $2)
+			 WHERE number = $1 AND status IN ('NEW', 'PROCESSING')`,
+			info.Order, s.accrualCallbackWindow().Seconds(),
+		); err != nil {
+			log.Printf("accrual callback: defer polling: %v", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/config"
+	"gophermart/internal/money"
+)
+
+const testCallbackSecret = "callback-secret"
+
+func newCallbackRequest(body string, ts time.Time, nonce, secret string) *http.Request {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	req := httptest.NewRequest(http.MethodPost, "/api/internal/accrual/callback", strings.NewReader(body))
+	req.Header.Set(callbackTimestampHeader, timestamp)
+	req.Header.Set(callbackNonceHeader, nonce)
+	req.Header.Set(callbackSignatureHeader, signAccrualCallback(secret, timestamp, nonce, []byte(body)))
+	return req
+}
+
+func TestServer_handleAccrualCallback(t *testing.T) {
+	const nonce = "0123456789abcdef"
+
+	expectNonce := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(`INSERT INTO accrual_callback_nonces`).
+			WithArgs(nonce).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`DELETE FROM accrual_callback_nonces`).
+			WithArgs(float64(600)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	expectKnownOrder := func(mock sqlmock.Sqlmock, known bool) {
+		mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM orders WHERE number = \$1\)`).
+			WithArgs("79927398713").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(known))
+	}
+	expectNonceReleased := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(`DELETE FROM accrual_callback_nonces WHERE nonce = \$1`).
+			WithArgs(nonce).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	tests := []struct {
+		name           string
+		secret         string
+		body           string
+		age            time.Duration
+		signWith       string
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+	}{
+		{
+			name:   "processed",
+			secret: testCallbackSecret,
+			body:   `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectNonce(mock)
+				expectKnownOrder(mock, true)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`UPDATE orders\s+SET status = 'PROCESSED'`).
+					WithArgs("500", "79927398713", "").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(int64(7), int64(2)))
+				expectLedgerPosting(mock, 1, 2, ledgerAccrual, 7, 0, money.FromInt(500), accountIssued)
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:   "failed update can be delivered again",
+			secret: testCallbackSecret,
+			body:   `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectNonce(mock)
+				expectKnownOrder(mock, true)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`UPDATE orders\s+SET status = 'PROCESSED'`).
+					WithArgs("500", "79927398713", "").
+					WillReturnError(sql.ErrConnDone)
+				mock.ExpectRollback()
+				expectNonceReleased(mock)
+			},
+			wantStatusCode: http.StatusInternalServerError,
+		},
+		{
+			name:   "still processing defers polling",
+			secret: testCallbackSecret,
+			body:   `{"order": "79927398713", "status": "PROCESSING"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectNonce(mock)
+				expectKnownOrder(mock, true)
+				mock.ExpectExec(`UPDATE orders\s+SET status = 'PROCESSING', parked_at = NULL,\s+attempt_count = CASE WHEN status = 'PARKED' THEN 0`).
+					WithArgs("79927398713", "").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE orders SET next_check_at = now\(\) \+ make_interval\(secs => \$2\)`).
+					WithArgs("79927398713", float64(60)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:   "unknown order",
+			secret: testCallbackSecret,
+			body:   `{"order": "79927398713", "status": "INVALID"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectNonce(mock)
+				expectKnownOrder(mock, false)
+				expectNonceReleased(mock)
+			},
+			wantStatusCode: http.StatusNotFound,
+		},
+		{
+			name:   "replayed nonce",
+			secret: testCallbackSecret,
+			body:   `{"order": "79927398713", "status": "INVALID"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`INSERT INTO accrual_callback_nonces`).
+					WithArgs(nonce).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+		{
+			name:           "bad signature",
+			secret:         testCallbackSecret,
+			body:           `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			signWith:       "other-secret",
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:           "stale timestamp",
+			secret:         testCallbackSecret,
+			body:           `{"order": "79927398713", "status": "PROCESSED", "accrual": 500}`,
+			age:            10 * time.Minute,
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:           "unknown status",
+			secret:         testCallbackSecret,
+			body:           `{"order": "79927398713", "status": "DONE"}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "callbacks disabled",
+			body:           `{"order": "79927398713", "status": "INVALID"}`,
+			wantStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			if tt.setupMock != nil {
+				tt.setupMock(mock)
+			}
+
+			s := &Server{
+				cfg: &config.Config{
+					AccrualCallbackSecret: tt.secret,
+					AccrualCallbackWindow: time.Minute,
+				},
+				db:  db,
+				mux: http.NewServeMux(),
+			}
+
+			signWith := tt.signWith
+			if signWith == "" {
+				signWith = tt.secret
+			}
+			w := httptest.NewRecorder()
+			s.handleAccrualCallback(w, newCallbackRequest(tt.body, time.Now().Add(-tt.age), nonce, signWith))
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleAccrualCallback() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
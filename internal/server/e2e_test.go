@@ -0,0 +1,468 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gophermart/internal/accrual"
+	"gophermart/internal/accrual/accrualfake"
+	"gophermart/internal/config"
+	"gophermart/internal/money"
+)
+
+// The end-to-end tests run the whole flow against a real database and the
+// fake accrual system. They are skipped unless TEST_DATABASE_URI is set.
+
+type e2eEnv struct {
+	fake *accrualfake.Server
+	srv  *Server
+	app  *httptest.Server
+	user *http.Client
+}
+
+func newE2EEnv(t *testing.T, opts accrualfake.Options) *e2eEnv {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URI")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+
+	fake := accrualfake.New(opts)
+	if err := fake.AddRule(accrualfake.Rule{Match: "Bork", Reward: money.FromInt(10), RewardType: accrualfake.RewardPercent}); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	fakeTS := httptest.NewServer(fake)
+	t.Cleanup(fakeTS.Close)
+
+	cl, err := accrual.NewWithOptions(fakeTS.URL, accrual.Options{
+		Retry:            accrual.RetryPolicy{Retries: 2, Backoff: 10 * time.Millisecond},
+		BreakerThreshold: 5,
+		BreakerCooldown:  200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("accrual.NewWithOptions() error = %v", err)
+	}
+
+	cfg := &config.Config{
+		DatabaseURI:       dsn,
+		AccrualWorkers:    4,
+		AccrualBackoff:    50 * time.Millisecond,
+		AccrualBackoffMax: 500 * time.Millisecond,
+		AccrualRateBurst:  10,
+		InstanceID:        "e2e-" + strconv.Itoa(rand.IntN(1_000_000)),
+	}
+	s, err := New(context.Background(), cfg, WithAccrualProvider(cl))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	app := httptest.NewServer(s.mux)
+	t.Cleanup(func() {
+		app.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown() error = %v", err)
+		}
+	})
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("cookiejar.New() error = %v", err)
+	}
+	env := &e2eEnv{fake: fake, srv: s, app: app, user: &http.Client{Jar: jar}}
+
+	login := fmt.Sprintf("e2e%d", rand.Int64())
+	body := fmt.Sprintf(`{"login": %q, "password": "correct-horse-battery"}`, login)
+	resp, err := env.user.Post(app.URL+"/api/user/register", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("register status = %d", resp.StatusCode)
+	}
+	return env
+}
+
+// uploadOrder registers a fresh order with the fake accrual system and
+// uploads it to gophermart.
+func (env *e2eEnv) uploadOrder(t *testing.T, goods ...accrualfake.Good) string {
+	t.Helper()
+
+	number := newLuhnNumber()
+	if err := env.fake.RegisterOrder(accrualfake.Order{Order: number, Goods: goods}); err != nil {
+		t.Fatalf("RegisterOrder() error = %v", err)
+	}
+
+	resp, err := env.user.Post(env.app.URL+"/api/user/orders", "text/plain", strings.NewReader(number))
+	if err != nil {
+		t.Fatalf("upload order: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("upload order status = %d", resp.StatusCode)
+	}
+	return number
+}
+
+type e2eOrder struct {
+	Number  string        `json:"number"`
+	Status  string        `json:"status"`
+	Accrual *money.Amount `json:"accrual"`
+}
+
+// waitForOrders polls the order list until every order is final.
+func (env *e2eEnv) waitForOrders(t *testing.T, want int, timeout time.Duration) map[string]e2eOrder {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		orders := map[string]e2eOrder{}
+		resp, err := env.user.Get(env.app.URL + "/api/user/orders")
+		if err != nil {
+			t.Fatalf("list orders: %v", err)
+		}
+		var list []e2eOrder
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+				t.Fatalf("decode orders: %v", err)
+			}
+		}
+		resp.Body.Close()
+
+		final := 0
+		for _, o := range list {
+			orders[o.Number] = o
+			if o.Status == "PROCESSED" || o.Status == "INVALID" {
+				final++
+			}
+		}
+		if final == want {
+			return orders
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("orders not final after %v: %+v", timeout, list)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestE2E_accrualWorker(t *testing.T) {
+	env := newE2EEnv(t, accrualfake.Options{
+		RegisteredFor: 100 * time.Millisecond,
+		ProcessingFor: 200 * time.Millisecond,
+	})
+
+	bork := env.uploadOrder(t, accrualfake.Good{Description: "Чайник Bork", Price: money.FromInt(7000)})
+	socks := env.uploadOrder(t, accrualfake.Good{Description: "Socks", Price: money.FromInt(100)})
+
+	orders := env.waitForOrders(t, 2, 20*time.Second)
+
+	if o := orders[bork]; o.Status != "PROCESSED" || o.Accrual == nil || *o.Accrual != money.FromInt(700) {
+		t.Errorf("order %s = %+v, want PROCESSED with 700", bork, o)
+	}
+	if o := orders[socks]; o.Status != "INVALID" || o.Accrual != nil {
+		t.Errorf("order %s = %+v, want INVALID", socks, o)
+	}
+}
+
+func TestE2E_accrualWorker_unreliableUpstream(t *testing.T) {
+	env := newE2EEnv(t, accrualfake.Options{
+		Latency:       20 * time.Millisecond,
+		ErrorRate:     0.3,
+		RateLimit:     5,
+		RateWindow:    time.Second,
+		ProcessingFor: 100 * time.Millisecond,
+	})
+
+	var numbers []string
+	for i := 0; i < 10; i++ {
+		numbers = append(numbers, env.uploadOrder(t, accrualfake.Good{Description: "Bork", Price: money.FromInt(100)}))
+	}
+
+	orders := env.waitForOrders(t, len(numbers), 60*time.Second)
+
+	for _, n := range numbers {
+		if o := orders[n]; o.Status != "PROCESSED" || o.Accrual == nil || *o.Accrual != money.FromInt(10) {
+			t.Errorf("order %s = %+v, want PROCESSED with 10", n, o)
+		}
+	}
+}
+
+func TestE2E_ledger(t *testing.T) {
+	env := newE2EEnv(t, accrualfake.Options{})
+
+	env.uploadOrder(t, accrualfake.Good{Description: "Bork", Price: money.MustParse("7299.8")})
+	env.waitForOrders(t, 1, 20*time.Second)
+
+	body := fmt.Sprintf(`{"order": %q, "sum": 500.01}`, newLuhnNumber())
+	resp, err := env.user.Post(env.app.URL+"/api/user/balance/withdraw", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("withdraw: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("withdraw status = %d", resp.StatusCode)
+	}
+
+	resp, err = env.user.Get(env.app.URL + "/api/user/balance")
+	if err != nil {
+		t.Fatalf("balance: %v", err)
+	}
+	var balance balanceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&balance); err != nil {
+		t.Fatalf("decode balance: %v", err)
+	}
+	resp.Body.Close()
+	if balance.Current != money.MustParse("229.97") || balance.Withdrawn != money.MustParse("500.01") {
+		t.Errorf("balance = %+v, want 229.97 current and 500.01 withdrawn", balance)
+	}
+
+	ctx := context.Background()
+	report, err := env.srv.reconcileLedger(ctx)
+	if err != nil {
+		t.Fatalf("reconcileLedger() error = %v", err)
+	}
+	if !report.OK {
+		t.Errorf("reconcileLedger() = %+v, want OK", report)
+	}
+
+	var txnID int64
+	if err := env.srv.db.QueryRowContext(ctx, `SELECT MAX(transaction_id) FROM ledger_entries`).Scan(&txnID); err != nil {
+		t.Fatalf("select transaction: %v", err)
+	}
+	if _, err := env.srv.db.ExecContext(ctx, `UPDATE ledger_entries SET amount = amount * 2 WHERE transaction_id = $1`, txnID); err == nil {
+		t.Error("UPDATE ledger_entries succeeded, want the ledger to be append-only")
+	}
+	if _, err := env.srv.db.ExecContext(ctx, `DELETE FROM ledger_transactions WHERE id = $1`, txnID); err == nil {
+		t.Error("DELETE FROM ledger_transactions succeeded, want the ledger to be append-only")
+	}
+
+	// Debits past the balance are refused by the database as well.
+	overdraw, err := env.srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	var userID int64
+	if err := overdraw.QueryRowContext(ctx, `SELECT user_id FROM ledger_transactions WHERE id = $1`, txnID).Scan(&userID); err != nil {
+		t.Fatalf("select user: %v", err)
+	}
+	if _, err := postLedger(ctx, overdraw, ledgerPosting{
+		UserID: userID,
+		Kind:   ledgerExpiry,
+		Amount: money.MustParse("-229.98"),
+	}); err == nil {
+		t.Error("postLedger() of a debit past the balance succeeded")
+	}
+	overdraw.Rollback()
+
+	// A transaction whose entries do not cancel out is rejected at commit.
+	tx, err := env.srv.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() error = %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO ledger_entries (transaction_id, account, amount) VALUES ($1, 'expired', 1)`,
+		txnID,
+	); err != nil {
+		t.Fatalf("insert entry: %v", err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Error("Commit() of an unbalanced transaction succeeded")
+	}
+}
+
+// Parallel withdrawals of one user must never spend more than the balance,
+// whatever order they commit in.
+func TestE2E_concurrentWithdrawals(t *testing.T) {
+	env := newE2EEnv(t, accrualfake.Options{})
+	// Hundreds of requests wait for the same balance row; keep them within
+	// the database's connection limit.
+	env.srv.db.SetMaxOpenConns(20)
+
+	env.uploadOrder(t, accrualfake.Good{Description: "Bork", Price: money.FromInt(1000)})
+	env.waitForOrders(t, 1, 20*time.Second)
+
+	const attempts = 300
+	var (
+		wg       sync.WaitGroup
+		ok, paid atomic.Int64
+	)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"order": %q, "sum": 1}`, newLuhnNumber())
+			resp, err := env.user.Post(env.app.URL+"/api/user/balance/withdraw", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Errorf("withdraw: %v", err)
+				return
+			}
+			resp.Body.Close()
+			switch resp.StatusCode {
+			case http.StatusOK:
+				ok.Add(1)
+			case http.StatusPaymentRequired:
+				paid.Add(1)
+			default:
+				t.Errorf("withdraw status = %d", resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ok.Load() != 100 || paid.Load() != attempts-100 {
+		t.Errorf("withdrawals: %d accepted, %d rejected, want 100 and %d", ok.Load(), paid.Load(), attempts-100)
+	}
+
+	resp, err := env.user.Get(env.app.URL + "/api/user/balance")
+	if err != nil {
+		t.Fatalf("balance: %v", err)
+	}
+	var balance balanceResponse
+	if err := json.NewDecoder(resp.Body).Decode(&balance); err != nil {
+		t.Fatalf("decode balance: %v", err)
+	}
+	resp.Body.Close()
+	if balance.Current.Sign() != 0 || balance.Withdrawn != money.FromInt(100) {
+		t.Errorf("balance = %+v, want 0 current and 100 withdrawn", balance)
+	}
+
+	report, err := env.srv.reconcileLedger(context.Background())
+	if err != nil {
+		t.Fatalf("reconcileLedger() error = %v", err)
+	}
+	if !report.OK {
+		t.Errorf("reconcileLedger() = %+v, want OK", report)
+	}
+}
+
+func TestE2E_withdrawalOrderNumbers(t *testing.T) {
+	env := newE2EEnv(t, accrualfake.Options{})
+
+	uploaded := env.uploadOrder(t, accrualfake.Good{Description: "Bork", Price: money.FromInt(1000)})
+	env.waitForOrders(t, 1, 20*time.Second)
+
+	withdraw := func(number string) int {
+		t.Helper()
+		body := fmt.Sprintf(`{"order": %q, "sum": 1}`, number)
+		resp, err := env.user.Post(env.app.URL+"/api/user/balance/withdraw", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("withdraw: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	number := newLuhnNumber()
+	if code := withdraw(number); code != http.StatusOK {
+		t.Fatalf("first withdrawal status = %d", code)
+	}
+	if code := withdraw(number); code != http.StatusConflict {
+		t.Errorf("repeated withdrawal status = %d, want %d", code, http.StatusConflict)
+	}
+	if code := withdraw(uploaded); code != http.StatusConflict {
+		t.Errorf("withdrawal against an uploaded order status = %d, want %d", code, http.StatusConflict)
+	}
+
+	resp, err := env.user.Post(env.app.URL+"/api/user/orders", "text/plain", strings.NewReader(number))
+	if err != nil {
+		t.Fatalf("upload order: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("upload of a withdrawn number status = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	// The database holds the line without the handler's checks.
+	if _, err := env.srv.db.ExecContext(
+		context.Background(),
+		`INSERT INTO withdrawals (user_id, "order", sum, processed_at)
+		 SELECT user_id, "order", sum, now() FROM withdrawals WHERE "order" = $1`,
+		number,
+	); !isUniqueViolation(err) {
+		t.Errorf("duplicate withdrawal insert error = %v, want a unique violation", err)
+	}
+}
+
+// Each failure arrives right after the previous lockout ended, long after the
+// failure window; the lockouts still double up to the maximum.
+func TestE2E_lockoutEscalation(t *testing.T) {
+	env := newE2EEnv(t, accrualfake.Options{})
+	ctx := context.Background()
+	key := fmt.Sprintf("e2e-lockout-%d", rand.Int64())
+
+	want := []time.Duration{
+		0, 0,
+		time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute,
+		16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour,
+	}
+	for i, wantLock := range want {
+		if err := env.srv.recordFailure(ctx, lockoutScopeLogin, key, 3); err != nil {
+			t.Fatalf("recordFailure() error = %v", err)
+		}
+
+		var (
+			failures int
+			lockSecs sql.NullFloat64
+			lock     time.Duration
+		)
+		if err := env.srv.db.QueryRowContext(
+			ctx,
+			`SELECT failures, EXTRACT(EPOCH FROM locked_until - last_failure_at)
+			 FROM login_attempts WHERE scope = $1 AND key = $2`,
+			lockoutScopeLogin, key,
+		).Scan(&failures, &lockSecs); err != nil {
+			t.Fatalf("select attempts: %v", err)
+		}
+		if lockSecs.Valid {
+			lock = time.Duration(lockSecs.Float64 * float64(time.Second)).Round(time.Second)
+		}
+		if failures != i+1 || lock != wantLock {
+			t.Fatalf("failure %d: failures = %d, lockout = %v, want %d and %v", i+1, failures, lock, i+1, wantLock)
+		}
+
+		// Let the lockout run out.
+		if _, err := env.srv.db.ExecContext(
+			ctx,
+			`UPDATE login_attempts
+			 SET last_failure_at = last_failure_at - make_interval(secs => $3),
+			     locked_until = locked_until - make_interval(secs => $3)
+			 WHERE scope = $1 AND key = $2`,
+			lockoutScopeLogin, key, (lock + time.Minute).Seconds(),
+		); err != nil {
+			t.Fatalf("rewind attempts: %v", err)
+		}
+	}
+}
+
+func newLuhnNumber() string {
+	digits := make([]byte, 11)
+	for i := 0; i < 10; i++ {
+		digits[i] = byte('0' + rand.IntN(10))
+	}
+	digits[0] = byte('1' + rand.IntN(9))
+	for d := byte('0'); d <= '9'; d++ {
+		digits[10] = d
+		if isValidOrderNumber(string(digits)) {
+			break
+		}
+	}
+	return string(digits)
+}
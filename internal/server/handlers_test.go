@@ -7,12 +7,16 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx/v5/pgconn"
 	"golang.org/x/crypto/bcrypt"
 
 	"gophermart/internal/config"
+	"gophermart/internal/money"
+	"gophermart/internal/policy"
 )
 
 func TestServer_handleRegister(t *testing.T) {
@@ -35,6 +39,9 @@ func TestServer_handleRegister(t *testing.T) {
 				mock.ExpectQuery(`INSERT INTO users`).
 					WithArgs("testuser", sqlmock.AnyArg()).
 					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectExec(`INSERT INTO sessions`).
+					WithArgs(sqlmock.AnyArg(), int64(1), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 			wantStatusCode: http.StatusOK,
 			wantCookie:     true,
@@ -93,9 +100,10 @@ func TestServer_handleRegister(t *testing.T) {
 			}
 
 			s := &Server{
-				cfg: &config.Config{},
-				db:  db,
-				mux: http.NewServeMux(),
+				cfg:    &config.Config{},
+				db:     db,
+				mux:    http.NewServeMux(),
+				tokens: newTestSigner(t),
 			}
 			s.registerRoutes()
 
@@ -122,13 +130,13 @@ func TestServer_handleRegister(t *testing.T) {
 				cookies := w.Result().Cookies()
 				found := false
 				for _, c := range cookies {
-					if c.Name == "user_id" && c.Value != "" {
+					if c.Name == authCookieName && c.Value != "" {
 						found = true
 						break
 					}
 				}
 				if !found {
-					t.Error("handleRegister() expected cookie 'user_id' not found")
+					t.Error("handleRegister() expected auth cookie not found")
 				}
 			}
 
@@ -156,10 +164,20 @@ func TestServer_handleLogin(t *testing.T) {
 				"password": "testpass",
 			},
 			setupMock: func(mock sqlmock.Sqlmock) {
+				expectNoLockout(mock)
 				hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.DefaultCost)
 				mock.ExpectQuery(`SELECT id, password_hash FROM users`).
 					WithArgs("testuser").
 					WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash"}).AddRow(1, string(hash)))
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_totp`).
+					WithArgs(int64(1)).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`DELETE FROM login_attempts`).
+					WithArgs("testuser").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`INSERT INTO sessions`).
+					WithArgs(sqlmock.AnyArg(), int64(1), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 			wantStatusCode: http.StatusOK,
 			wantCookie:     true,
@@ -172,6 +190,7 @@ func TestServer_handleLogin(t *testing.T) {
 				"password": "wrongpass",
 			},
 			setupMock: func(mock sqlmock.Sqlmock) {
+				expectNoLockout(mock)
 				hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.DefaultCost)
 				mock.ExpectQuery(`SELECT id, password_hash FROM users`).
 					WithArgs("testuser").
@@ -188,6 +207,7 @@ func TestServer_handleLogin(t *testing.T) {
 				"password": "testpass",
 			},
 			setupMock: func(mock sqlmock.Sqlmock) {
+				expectNoLockout(mock)
 				mock.ExpectQuery(`SELECT id, password_hash FROM users`).
 					WithArgs("nonexistent").
 					WillReturnError(sql.ErrNoRows)
@@ -210,9 +230,10 @@ func TestServer_handleLogin(t *testing.T) {
 			}
 
 			s := &Server{
-				cfg: &config.Config{},
-				db:  db,
-				mux: http.NewServeMux(),
+				cfg:    &config.Config{},
+				db:     db,
+				mux:    http.NewServeMux(),
+				tokens: newTestSigner(t),
 			}
 			s.registerRoutes()
 
@@ -231,13 +252,13 @@ func TestServer_handleLogin(t *testing.T) {
 				cookies := w.Result().Cookies()
 				found := false
 				for _, c := range cookies {
-					if c.Name == "user_id" && c.Value != "" {
+					if c.Name == authCookieName && c.Value != "" {
 						found = true
 						break
 					}
 				}
 				if !found {
-					t.Error("handleLogin() expected cookie 'user_id' not found")
+					t.Error("handleLogin() expected auth cookie not found")
 				}
 			}
 
@@ -264,12 +285,89 @@ func TestServer_handleCreateOrder(t *testing.T) {
 				mock.ExpectQuery(`SELECT user_id FROM orders`).
 					WithArgs("12345678903").
 					WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM withdrawals WHERE "order" = \$1\)`).
+					WithArgs("12345678903").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
 				mock.ExpectExec(`INSERT INTO orders`).
-					WithArgs(int64(1), "12345678903", "NEW", sqlmock.AnyArg()).
+					WithArgs(int64(1), "12345678903", "NEW", sqlmock.AnyArg(), sqlmock.AnyArg()).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 			},
 			wantStatusCode: http.StatusAccepted,
 		},
+		{
+			name:        "number used for a withdrawal",
+			orderNumber: "12345678903",
+			userID:      1,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT user_id FROM orders`).
+					WithArgs("12345678903").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM withdrawals WHERE "order" = \$1\)`).
+					WithArgs("12345678903").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+		{
+			name:        "number taken concurrently by another user",
+			orderNumber: "12345678903",
+			userID:      1,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT user_id FROM orders`).
+					WithArgs("12345678903").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM withdrawals WHERE "order" = \$1\)`).
+					WithArgs("12345678903").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`INSERT INTO orders`).
+					WithArgs(int64(1), "12345678903", "NEW", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnError(&pgconn.PgError{Code: "23505"})
+				mock.ExpectQuery(`SELECT user_id FROM orders`).
+					WithArgs("12345678903").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(2))
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+		{
+			name:        "number taken concurrently by the same user",
+			orderNumber: "12345678903",
+			userID:      1,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT user_id FROM orders`).
+					WithArgs("12345678903").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM withdrawals WHERE "order" = \$1\)`).
+					WithArgs("12345678903").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`INSERT INTO orders`).
+					WithArgs(int64(1), "12345678903", "NEW", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnError(&pgconn.PgError{Code: "23505"})
+				mock.ExpectQuery(`SELECT user_id FROM orders`).
+					WithArgs("12345678903").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:        "number taken concurrently by a withdrawal",
+			orderNumber: "12345678903",
+			userID:      1,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT user_id FROM orders`).
+					WithArgs("12345678903").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM withdrawals WHERE "order" = \$1\)`).
+					WithArgs("12345678903").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec(`INSERT INTO orders`).
+					WithArgs(int64(1), "12345678903", "NEW", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnError(&pgconn.PgError{Code: "23505"})
+				mock.ExpectQuery(`SELECT user_id FROM orders`).
+					WithArgs("12345678903").
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantStatusCode: http.StatusConflict,
+		},
 		{
 			name:        "order already exists for same user",
 			orderNumber: "12345678903",
@@ -323,14 +421,15 @@ func TestServer_handleCreateOrder(t *testing.T) {
 			}
 
 			s := &Server{
-				cfg: &config.Config{},
-				db:  db,
-				mux: http.NewServeMux(),
+				cfg:    &config.Config{},
+				db:     db,
+				mux:    http.NewServeMux(),
+				tokens: newTestSigner(t),
 			}
 
 			req := httptest.NewRequest(http.MethodPost, "/api/user/orders", bytes.NewReader([]byte(tt.orderNumber)))
 			req.Header.Set("Content-Type", "text/plain")
-			req.AddCookie(&http.Cookie{Name: "user_id", Value: "1"})
+			req = withTestUser(req, 1)
 			w := httptest.NewRecorder()
 
 			s.handleCreateOrder(w, req)
@@ -352,38 +451,40 @@ func TestServer_handleBalance(t *testing.T) {
 		userID         int64
 		setupMock      func(mock sqlmock.Sqlmock)
 		wantStatusCode int
-		wantBalance    float64
-		wantWithdrawn  float64
+		wantBalance    money.Amount
+		wantWithdrawn  money.Amount
 	}{
 		{
 			name:   "successful balance retrieval",
 			userID: 1,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`SELECT COALESCE\(SUM\(accrual\), 0\)`).
-					WithArgs(int64(1)).
-					WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(1000.5))
-				mock.ExpectQuery(`SELECT COALESCE\(SUM\(sum\), 0\)`).
-					WithArgs(int64(1)).
-					WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(200.0))
+				expectLedgerBalance(mock, 1, "800.5", "200")
 			},
 			wantStatusCode: http.StatusOK,
-			wantBalance:    800.5,
-			wantWithdrawn:  200.0,
+			wantBalance:    money.MustParse("800.5"),
+			wantWithdrawn:  money.FromInt(200),
 		},
 		{
-			name:   "zero balance",
+			name:   "exact decimals",
 			userID: 1,
 			setupMock: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`SELECT COALESCE\(SUM\(accrual\), 0\)`).
-					WithArgs(int64(1)).
-					WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
-				mock.ExpectQuery(`SELECT COALESCE\(SUM\(sum\), 0\)`).
+				expectLedgerBalance(mock, 1, "0.2", "0.1")
+			},
+			wantStatusCode: http.StatusOK,
+			wantBalance:    money.MustParse("0.2"),
+			wantWithdrawn:  money.MustParse("0.1"),
+		},
+		{
+			name:   "never credited",
+			userID: 1,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT current, withdrawn FROM balances`).
 					WithArgs(int64(1)).
-					WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+					WillReturnError(sql.ErrNoRows)
 			},
 			wantStatusCode: http.StatusOK,
-			wantBalance:    0,
-			wantWithdrawn:  0,
+			wantBalance:    money.Zero,
+			wantWithdrawn:  money.Zero,
 		},
 	}
 
@@ -400,13 +501,14 @@ func TestServer_handleBalance(t *testing.T) {
 			}
 
 			s := &Server{
-				cfg: &config.Config{},
-				db:  db,
-				mux: http.NewServeMux(),
+				cfg:    &config.Config{},
+				db:     db,
+				mux:    http.NewServeMux(),
+				tokens: newTestSigner(t),
 			}
 
 			req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
-			req.AddCookie(&http.Cookie{Name: "user_id", Value: "1"})
+			req = withTestUser(req, 1)
 			w := httptest.NewRecorder()
 
 			s.handleBalance(w, req)
@@ -434,3 +536,170 @@ func TestServer_handleBalance(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_handleWithdraw(t *testing.T) {
+	expectOrderNumberUse := func(mock sqlmock.Sqlmock, byOrder, byWithdrawal bool) {
+		mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM orders WHERE number = \$1\),\s+EXISTS \(SELECT 1 FROM withdrawals WHERE "order" = \$1\)`).
+			WithArgs("2377225624").
+			WillReturnRows(sqlmock.NewRows([]string{"order", "withdrawal"}).AddRow(byOrder, byWithdrawal))
+	}
+
+	tests := []struct {
+		name           string
+		body           string
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+	}{
+		{
+			name: "whole balance",
+			body: `{"order": "2377225624", "sum": 0.1}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOrderNumberUse(mock, false, false)
+				mock.ExpectQuery(`SELECT current, withdrawn FROM balances WHERE user_id = \$1 FOR UPDATE`).
+					WithArgs(int64(1)).
+					WillReturnRows(sqlmock.NewRows([]string{"current", "withdrawn"}).AddRow("0.1", "0.2"))
+				mock.ExpectQuery(`INSERT INTO withdrawals \(user_id, "order", sum, processed_at\)`).
+					WithArgs(int64(1), "2377225624", "0.1", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(4)))
+				expectLedgerPosting(mock, 9, 1, ledgerWithdrawal, 0, 4, money.MustParse("-0.1"), accountRedeemed)
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "insufficient funds",
+			body: `{"order": "2377225624", "sum": 0.11}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOrderNumberUse(mock, false, false)
+				mock.ExpectQuery(`SELECT current, withdrawn FROM balances WHERE user_id = \$1 FOR UPDATE`).
+					WithArgs(int64(1)).
+					WillReturnRows(sqlmock.NewRows([]string{"current", "withdrawn"}).AddRow("0.1", "0.2"))
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusPaymentRequired,
+		},
+		{
+			name: "number already withdrawn against",
+			body: `{"order": "2377225624", "sum": 0.1}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOrderNumberUse(mock, false, true)
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+		{
+			name: "number of an uploaded order",
+			body: `{"order": "2377225624", "sum": 0.1}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOrderNumberUse(mock, true, false)
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+		{
+			name: "number taken concurrently",
+			body: `{"order": "2377225624", "sum": 0.1}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectOrderNumberUse(mock, false, false)
+				mock.ExpectQuery(`SELECT current, withdrawn FROM balances WHERE user_id = \$1 FOR UPDATE`).
+					WithArgs(int64(1)).
+					WillReturnRows(sqlmock.NewRows([]string{"current", "withdrawn"}).AddRow("0.1", "0.2"))
+				mock.ExpectQuery(`INSERT INTO withdrawals \(user_id, "order", sum, processed_at\)`).
+					WithArgs(int64(1), "2377225624", "0.1", sqlmock.AnyArg()).
+					WillReturnError(errors.New(`ERROR: duplicate key value violates unique constraint "idx_withdrawals_order_unique" (SQLSTATE 23505)`))
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+		{
+			name:           "fraction of a kopeck",
+			body:           `{"order": "2377225624", "sum": 0.001}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "sum as string",
+			body:           `{"order": "2377225624", "sum": "10"}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			if tt.setupMock != nil {
+				tt.setupMock(mock)
+			}
+
+			s := &Server{
+				cfg:    &config.Config{},
+				db:     db,
+				mux:    http.NewServeMux(),
+				tokens: newTestSigner(t),
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(tt.body))
+			req = withTestUser(req, 1)
+			w := httptest.NewRecorder()
+
+			s.handleWithdraw(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleWithdraw() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_handleRegister_policy(t *testing.T) {
+	pol, err := policy.New(policy.Options{PasswordMinLength: 8, LoginMinLength: 3, LoginMaxLength: 64})
+	if err != nil {
+		t.Fatalf("policy.New() error = %v", err)
+	}
+
+	s := &Server{
+		cfg:    &config.Config{},
+		mux:    http.NewServeMux(),
+		tokens: newTestSigner(t),
+		policy: pol,
+	}
+
+	bodyBytes, _ := json.Marshal(credentials{Login: "a b", Password: "short"})
+	req := httptest.NewRequest(http.MethodPost, "/api/user/register", bytes.NewReader(bodyBytes))
+	w := httptest.NewRecorder()
+
+	s.handleRegister(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("handleRegister() status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("handleRegister() Content-Type = %q, want application/json", ct)
+	}
+
+	var resp policyErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	var got []string
+	for _, v := range resp.Errors {
+		got = append(got, v.Rule)
+	}
+	want := []string{"login_charset", "password_min_length"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("handleRegister() rules = %v, want %v", got, want)
+	}
+}
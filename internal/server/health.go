@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"gophermart/internal/accrual"
+)
+
+// accrualStatser is implemented by providers that track call statistics,
+// such as *accrual.Client.
+type accrualStatser interface {
+	Stats() accrual.ClientStats
+}
+
+type healthResponse struct {
+	Status   string               `json:"status"`
+	Database string               `json:"database"`
+	Accrual  *accrual.ClientStats `json:"accrual,omitempty"`
+}
+
+// handleHealth answers 503 only when the database is unreachable. An open
+// accrual breaker degrades the instance but it still serves users, so
+// restarting it would not help.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	resp := healthResponse{Status: "ok", Database: "ok"}
+	code := http.StatusOK
+
+	if err := s.db.PingContext(ctx); err != nil {
+		resp.Status, resp.Database = "unavailable", "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+
+	if sp, ok := s.accrualProvider.(accrualStatser); ok {
+		st := sp.Stats()
+		resp.Accrual = &st
+		if code == http.StatusOK && st.Breaker != nil && st.Breaker.State != accrual.BreakerClosed {
+			resp.Status = "degraded"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// handleMetrics exposes accrual client and limiter state in the Prometheus
+// text format, labelled with the accrual route.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	if sp, ok := s.accrualProvider.(accrualStatser); ok {
+		st := sp.Stats()
+		routes := st.Routes
+		if len(routes) == 0 {
+			routes = map[string]accrual.ClientStats{accrual.DefaultRoute: st}
+		}
+		names := sortedKeys(routes)
+
+		writeMetricHeader(w, "gophermart_accrual_retries_total", "counter", "Accrual requests retried after a network error or 5xx.")
+		for _, route := range names {
+			writeSample(w, "gophermart_accrual_retries_total", routeLabel(route), routes[route].Retries)
+		}
+
+		if st.Breaker != nil {
+			writeMetricHeader(w, "gophermart_accrual_breaker_state", "gauge", "Accrual circuit breaker state, 1 for the current one.")
+			for _, route := range names {
+				b := routes[route].Breaker
+				if b == nil {
+					continue
+				}
+				for _, state := range []accrual.BreakerState{accrual.BreakerClosed, accrual.BreakerOpen, accrual.BreakerHalfOpen} {
+					v := 0
+					if b.State == state {
+						v = 1
+					}
+					writeSample(w, "gophermart_accrual_breaker_state", fmt.Sprintf("%s,state=%q", routeLabel(route), state), v)
+				}
+			}
+			writeMetricHeader(w, "gophermart_accrual_breaker_opens_total", "counter", "Times the accrual circuit breaker opened.")
+			for _, route := range names {
+				if b := routes[route].Breaker; b != nil {
+					writeSample(w, "gophermart_accrual_breaker_opens_total", routeLabel(route), b.Opens)
+				}
+			}
+			writeMetricHeader(w, "gophermart_accrual_breaker_consecutive_failures", "gauge", "Accrual calls failed in a row.")
+			for _, route := range names {
+				if b := routes[route].Breaker; b != nil {
+					writeSample(w, "gophermart_accrual_breaker_consecutive_failures", routeLabel(route), b.ConsecutiveFailures)
+				}
+			}
+		}
+	}
+
+	if s.accrualLimiter != nil {
+		ls := s.accrualLimiter.State()
+		routes := map[string]accrual.LimiterState{accrual.DefaultRoute: ls}
+		for route, rs := range ls.Routes {
+			routes[route] = rs
+		}
+		names := sortedKeys(routes)
+
+		writeMetricHeader(w, "gophermart_accrual_rate_limit_per_minute", "gauge", "Requests per minute allowed to the accrual system, 0 if unlimited.")
+		for _, route := range names {
+			writeSample(w, "gophermart_accrual_rate_limit_per_minute", routeLabel(route), routes[route].PerMinute)
+		}
+		writeMetricHeader(w, "gophermart_accrual_paused", "gauge", "Whether requests to the accrual system are paused.")
+		for _, route := range names {
+			paused := 0
+			if rs := routes[route]; rs.PausedUntil != nil || rs.CircuitOpenUntil != nil {
+				paused = 1
+			}
+			writeSample(w, "gophermart_accrual_paused", routeLabel(route), paused)
+		}
+	}
+}
+
+func routeLabel(route string) string {
+	return fmt.Sprintf("route=%q", route)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetricHeader(w http.ResponseWriter, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample[T int | int64](w http.ResponseWriter, name, labels string, v T) {
+	fmt.Fprintf(w, "%s{%s} %d\n", name, labels, v)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/accrual"
+	"gophermart/internal/config"
+)
+
+func TestServer_handleHealth(t *testing.T) {
+	tests := []struct {
+		name           string
+		pingErr        error
+		openBreaker    bool
+		routed         bool
+		wantStatusCode int
+		wantStatus     string
+	}{
+		{name: "healthy", wantStatusCode: http.StatusOK, wantStatus: "ok"},
+		{name: "accrual down", openBreaker: true, wantStatusCode: http.StatusOK, wantStatus: "degraded"},
+		{name: "one accrual route down", routed: true, openBreaker: true, wantStatusCode: http.StatusOK, wantStatus: "degraded"},
+		{name: "database down", pingErr: errors.New("connection refused"), wantStatusCode: http.StatusServiceUnavailable, wantStatus: "unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+			mock.ExpectPing().WillReturnError(tt.pingErr)
+
+			cl, err := accrual.NewWithOptions("http://127.0.0.1:1", accrual.Options{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+			if err != nil {
+				t.Fatalf("accrual.NewWithOptions() error = %v", err)
+			}
+			if tt.openBreaker {
+				_, _ = cl.GetOrderInfo(context.Background(), "79927398713")
+			}
+
+			var provider accrual.Provider = cl
+			if tt.routed {
+				fallback, err := accrual.NewWithOptions("http://127.0.0.1:1", accrual.Options{BreakerThreshold: 5})
+				if err != nil {
+					t.Fatalf("accrual.NewWithOptions() error = %v", err)
+				}
+				provider = accrual.NewRouter([]accrual.Route{{Prefix: "7", Provider: cl}}, fallback)
+			}
+
+			s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux(), accrualProvider: provider}
+
+			w := httptest.NewRecorder()
+			s.handleHealth(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleHealth() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+			var resp healthResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if resp.Status != tt.wantStatus || resp.Accrual == nil || resp.Accrual.Breaker == nil {
+				t.Errorf("handleHealth() = %+v, want status %q with breaker state", resp, tt.wantStatus)
+			}
+			if tt.routed {
+				if b := resp.Accrual.Routes["7"].Breaker; b == nil || b.State != accrual.BreakerOpen {
+					t.Errorf("handleHealth() routes = %+v, want route 7 open", resp.Accrual.Routes)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_handleMetrics(t *testing.T) {
+	down, err := accrual.NewWithOptions("http://127.0.0.1:1", accrual.Options{BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	if err != nil {
+		t.Fatalf("accrual.NewWithOptions() error = %v", err)
+	}
+	up, err := accrual.NewWithOptions("http://127.0.0.1:1", accrual.Options{BreakerThreshold: 5})
+	if err != nil {
+		t.Fatalf("accrual.NewWithOptions() error = %v", err)
+	}
+	router := accrual.NewRouter([]accrual.Route{{Prefix: "7", Provider: down}}, up)
+	limiter := accrual.NewLimiter(router, 0, 1, nil)
+	// The first failure opens the breaker, the second call runs into it.
+	_, _ = limiter.GetOrderInfo(context.Background(), "79927398713")
+	_, _ = limiter.GetOrderInfo(context.Background(), "79927398713")
+
+	s := &Server{cfg: &config.Config{}, accrualProvider: router, accrualLimiter: limiter}
+
+	w := httptest.NewRecorder()
+	s.handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`gophermart_accrual_breaker_state{route="7",state="open"} 1`,
+		`gophermart_accrual_breaker_state{route="default",state="closed"} 1`,
+		`gophermart_accrual_breaker_opens_total{route="7"} 1`,
+		`gophermart_accrual_breaker_opens_total{route="default"} 0`,
+		`gophermart_accrual_rate_limit_per_minute{route="7"} 0`,
+		`gophermart_accrual_rate_limit_per_minute{route="default"} 0`,
+		`gophermart_accrual_paused{route="7"} 1`,
+		`gophermart_accrual_paused{route="default"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("handleMetrics() missing %q in:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLen  = 255
+	maxIdempotentBodySize = 1 << 20
+
+	// idempotencyLease is how long a claim blocks retries while its request
+	// runs. It is well past the handlers' own timeouts.
+	idempotencyLease = 30 * time.Second
+)
+
+func (s *Server) idempotencyRetention() time.Duration {
+	if s.cfg.IdempotencyKeyRetention > 0 {
+		return s.cfg.IdempotencyKeyRetention
+	}
+	return 24 * time.Hour
+}
+
+// withIdempotency must be layered on withAuth. A POST carrying an
+// Idempotency-Key runs once per user, endpoint and key; repeating it returns
+// the stored response instead of running it again. Reusing a key for a
+// different request is rejected, as is a repeat that arrives while the first
+// one is still running. Server errors are not stored, so the client can retry
+// them with the same key.
+//
+// If the response was never stored (a crash, or the store failed) the claim
+// lapses after idempotencyLease and the next retry runs the request again.
+// Both endpoints that use this are safe to repeat: an order number can be
+// uploaded and withdrawn against only once.
+func (s *Server) withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if r.Method != http.MethodPost || key == "" {
+			next(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodySize+1))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxIdempotentBodySize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		userID, _ := s.currentUserID(r)
+		endpoint := r.URL.Path
+		hash := requestHash(r.Method, endpoint, body)
+
+		// Storing the outcome must not depend on the client still waiting:
+		// a client that timed out is exactly the one that will retry.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 5*time.Second)
+		defer cancel()
+
+		claimed, err := s.claimIdempotencyKey(ctx, userID, endpoint, key, hash)
+		if err != nil {
+			log.Printf("idempotency: claim key: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			s.replayIdempotentResponse(ctx, w, userID, endpoint, key, hash)
+			return
+		}
+
+		release := func() {
+			if _, err := s.db.ExecContext(
+				ctx,
+				`DELETE FROM idempotency_keys WHERE user_id = $1 AND endpoint = $2 AND key = $3`,
+				userID, endpoint, key,
+			); err != nil {
+				log.Printf("idempotency: release key: %v", err)
+			}
+		}
+		defer func() {
+			if p := recover(); p != nil {
+				release()
+				panic(p)
+			}
+		}()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		if rec.status >= http.StatusInternalServerError {
+			release()
+			return
+		}
+
+		if _, err := s.db.ExecContext(
+			ctx,
+			`UPDATE idempotency_keys
+			 SET status_code = $4, content_type = $5, response_body = $6, locked_until = NULL
+			 WHERE user_id = $1 AND endpoint = $2 AND key = $3`,
+			userID, endpoint, key, rec.status, w.Header().Get("Content-Type"), rec.body.Bytes(),
+		); err != nil {
+			log.Printf("idempotency: store response: %v", err)
+		}
+	}
+}
+
+// claimIdempotencyKey records the key as in progress. It reports false when
+// the key is already taken by an earlier request that has not expired, unless
+// that request is the same one and its lease has run out.
+func (s *Server) claimIdempotencyKey(ctx context.Context, userID int64, endpoint, key, hash string) (bool, error) {
+	retention := s.idempotencyRetention().Seconds()
+
+	if _, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM idempotency_keys WHERE created_at < now() - make_interval(secs => $1)`,
+		retention,
+	); err != nil {
+		log.Printf("idempotency: purge keys: %v", err)
+	}
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO idempotency_keys (user_id, endpoint, key, request_hash, locked_until)
+		 VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5))
+		 ON CONFLICT (user_id, endpoint, key) DO UPDATE
+		 SET locked_until = EXCLUDED.locked_until
+		 WHERE idempotency_keys.status_code IS NULL
+		   AND idempotency_keys.locked_until < now()
+		   AND idempotency_keys.request_hash = EXCLUDED.request_hash`,
+		userID, endpoint, key, hash, idempotencyLease.Seconds(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *Server) replayIdempotentResponse(ctx context.Context, w http.ResponseWriter, userID int64, endpoint, key, hash string) {
+	var (
+		storedHash  string
+		status      sql.NullInt64
+		contentType sql.NullString
+		body        []byte
+		lockedUntil sql.NullTime
+	)
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT request_hash, status_code, content_type, response_body, locked_until
+		 FROM idempotency_keys
+		 WHERE user_id = $1 AND endpoint = $2 AND key = $3`,
+		userID, endpoint, key,
+	).Scan(&storedHash, &status, &contentType, &body, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The first request failed and released the key in the meantime.
+		http.Error(w, "request with this Idempotency-Key is being retried, try again", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("idempotency: load response: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if storedHash != hash {
+		http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if !status.Valid {
+		if lockedUntil.Valid {
+			retryAfter := max(int(math.Ceil(time.Until(lockedUntil.Time).Seconds())), 1)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		}
+		http.Error(w, "request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	}
+
+	if contentType.Valid && contentType.String != "" {
+		w.Header().Set("Content-Type", contentType.String)
+	}
+	w.Header().Set(idempotencyReplayedHeader, "true")
+	w.WriteHeader(int(status.Int64))
+	_, _ = w.Write(body)
+}
+
+func requestHash(method, endpoint string, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, method+" "+endpoint+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// responseRecorder passes a response through and keeps a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/config"
+)
+
+func TestServer_withIdempotency(t *testing.T) {
+	const (
+		endpoint = "/api/user/balance/withdraw"
+		body     = `{"order": "2377225624", "sum": 10}`
+		key      = "3f2a7c1e-retry"
+	)
+	hash := requestHash(http.MethodPost, endpoint, []byte(body))
+
+	expectClaim := func(mock sqlmock.Sqlmock, claimed bool) {
+		mock.ExpectExec(`DELETE FROM idempotency_keys WHERE created_at <`).
+			WithArgs(float64(3600)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		var n int64
+		if claimed {
+			n = 1
+		}
+		mock.ExpectExec(`INSERT INTO idempotency_keys`).
+			WithArgs(int64(1), endpoint, key, hash, idempotencyLease.Seconds()).
+			WillReturnResult(sqlmock.NewResult(0, n))
+	}
+	expectStored := func(mock sqlmock.Sqlmock, storedHash string, status any) {
+		var lockedUntil any
+		if status == nil {
+			lockedUntil = time.Now().Add(20 * time.Second)
+		}
+		mock.ExpectQuery(`SELECT request_hash, status_code, content_type, response_body, locked_until`).
+			WithArgs(int64(1), endpoint, key).
+			WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status_code", "content_type", "response_body", "locked_until"}).
+				AddRow(storedHash, status, "application/json", []byte(`{"ok":true}`), lockedUntil))
+	}
+
+	tests := []struct {
+		name           string
+		key            string
+		handlerStatus  int
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+		wantCalls      int
+		wantReplayed   bool
+		wantRetryAfter string
+	}{
+		{
+			name:           "no key",
+			handlerStatus:  http.StatusOK,
+			wantStatusCode: http.StatusOK,
+			wantCalls:      1,
+		},
+		{
+			name:          "first request stores the response",
+			key:           key,
+			handlerStatus: http.StatusPaymentRequired,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectClaim(mock, true)
+				mock.ExpectExec(`UPDATE idempotency_keys\s+SET status_code = \$4, content_type = \$5, response_body = \$6, locked_until = NULL`).
+					WithArgs(int64(1), endpoint, key, http.StatusPaymentRequired, "application/json", []byte(`{"ok":true}`)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatusCode: http.StatusPaymentRequired,
+			wantCalls:      1,
+		},
+		{
+			name:          "server error releases the key",
+			key:           key,
+			handlerStatus: http.StatusInternalServerError,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectClaim(mock, true)
+				mock.ExpectExec(`DELETE FROM idempotency_keys WHERE user_id = \$1 AND endpoint = \$2 AND key = \$3`).
+					WithArgs(int64(1), endpoint, key).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatusCode: http.StatusInternalServerError,
+			wantCalls:      1,
+		},
+		{
+			name: "repeat is replayed",
+			key:  key,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectClaim(mock, false)
+				expectStored(mock, hash, int64(http.StatusOK))
+			},
+			wantStatusCode: http.StatusOK,
+			wantReplayed:   true,
+		},
+		{
+			name: "key reused for another request",
+			key:  key,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectClaim(mock, false)
+				expectStored(mock, "other", int64(http.StatusOK))
+			},
+			wantStatusCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "first request still running",
+			key:  key,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectClaim(mock, false)
+				expectStored(mock, hash, nil)
+			},
+			wantStatusCode: http.StatusConflict,
+			wantRetryAfter: "20",
+		},
+		{
+			name:           "invalid key",
+			key:            strings.Repeat("k", maxIdempotencyKeyLen+1),
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			if tt.setupMock != nil {
+				tt.setupMock(mock)
+			}
+
+			s := &Server{cfg: &config.Config{IdempotencyKeyRetention: time.Hour}, db: db}
+
+			calls := 0
+			handler := s.withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if got, err := io.ReadAll(r.Body); err != nil || string(got) != body {
+					t.Errorf("handler body = %q, %v, want %q", got, err, body)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.handlerStatus)
+				w.Write([]byte(`{"ok":true}`))
+			})
+
+			req := httptest.NewRequest(http.MethodPost, endpoint, strings.NewReader(body))
+			if tt.key != "" {
+				req.Header.Set(idempotencyKeyHeader, tt.key)
+			}
+			req = withTestUser(req, 1)
+			w := httptest.NewRecorder()
+
+			handler(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("withIdempotency() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("handler called %d times, want %d", calls, tt.wantCalls)
+			}
+			if replayed := w.Header().Get(idempotencyReplayedHeader) == "true"; replayed != tt.wantReplayed {
+				t.Errorf("replayed = %v, want %v", replayed, tt.wantReplayed)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if tt.wantReplayed && w.Body.String() != `{"ok":true}` {
+				t.Errorf("replayed body = %q", w.Body.String())
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_withIdempotency_panic(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec(`DELETE FROM idempotency_keys WHERE created_at <`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO idempotency_keys`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM idempotency_keys WHERE user_id = \$1 AND endpoint = \$2 AND key = \$3`).
+		WithArgs(int64(1), "/api/user/orders", "k1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	s := &Server{cfg: &config.Config{}, db: db}
+	handler := s.withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/user/orders", strings.NewReader("12345678903"))
+	req.Header.Set(idempotencyKeyHeader, "k1")
+	req = withTestUser(req, 1)
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("recover() = %v, want the handler's panic", p)
+			}
+		}()
+		handler(httptest.NewRecorder(), req)
+	}()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
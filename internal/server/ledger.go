@@ -0,0 +1,613 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gophermart/internal/money"
+)
+
+const (
+	ledgerAccrual    = "accrual"
+	ledgerWithdrawal = "withdrawal"
+	ledgerReversal   = "reversal"
+	ledgerAdjustment = "adjustment"
+	ledgerExpiry     = "expiry"
+)
+
+// Ledger accounts. accountUser is the balance of the transaction's user; the
+// others are program-wide and hold the opposite side of every entry.
+const (
+	accountUser        = "user"
+	accountIssued      = "issued"
+	accountRedeemed    = "redeemed"
+	accountExpired     = "expired"
+	accountAdjustments = "adjustments"
+)
+
+// errOverdraft is returned when a debit would take the user's balance below
+// zero, e.g. reversing an accrual whose points have been spent.
+var errOverdraft = errors.New("balance would go negative")
+
+var ledgerCounterAccount = map[string]string{
+	ledgerAccrual:    accountIssued,
+	ledgerWithdrawal: accountRedeemed,
+	ledgerExpiry:     accountExpired,
+	ledgerAdjustment: accountAdjustments,
+}
+
+// ledgerPosting moves Amount into the user's account, or out of it when
+// negative. OrderID and WithdrawalID link the source and are 0 when there is
+// none.
+type ledgerPosting struct {
+	UserID       int64
+	Kind         string
+	OrderID      int64
+	WithdrawalID int64
+	Note         string
+	Amount       money.Amount
+}
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id > 0}
+}
+
+// postLedger records p as a transaction with two entries that cancel out.
+func postLedger(ctx context.Context, tx *sql.Tx, p ledgerPosting) (int64, error) {
+	counter, ok := ledgerCounterAccount[p.Kind]
+	if !ok {
+		return 0, fmt.Errorf("post ledger: unsupported kind %q", p.Kind)
+	}
+	if p.Amount.Sign() == 0 {
+		return 0, errors.New("post ledger: zero amount")
+	}
+
+	var note sql.NullString
+	if p.Note != "" {
+		note = sql.NullString{String: p.Note, Valid: true}
+	}
+
+	var id int64
+	if err := tx.QueryRowContext(
+		ctx,
+		`INSERT INTO ledger_transactions (user_id, kind, order_id, withdrawal_id, note)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING id`,
+		p.UserID, p.Kind, nullID(p.OrderID), nullID(p.WithdrawalID), note,
+	).Scan(&id); err != nil {
+		return 0, fmt.Errorf("insert ledger transaction: %w", err)
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO ledger_entries (transaction_id, account, amount)
+		 VALUES ($1, $2, $3), ($1, $4, $5)`,
+		id, accountUser, p.Amount, counter, p.Amount.Neg(),
+	); err != nil {
+		return 0, fmt.Errorf("insert ledger entries: %w", err)
+	}
+	return id, nil
+}
+
+// reverseOrderAccruals cancels the accruals of an order that have not been
+// reversed yet, e.g. before it is calculated again. It locks the user's
+// balance and fails with errOverdraft rather than take back points the user
+// has already spent.
+func reverseOrderAccruals(ctx context.Context, tx *sql.Tx, userID, orderID int64, note string) error {
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT t.id, e.amount
+		 FROM ledger_transactions t
+		 JOIN ledger_entries e ON e.transaction_id = t.id AND e.account = 'user'
+		 WHERE t.order_id = $1 AND t.kind = 'accrual'
+		   AND NOT EXISTS (SELECT 1 FROM ledger_transactions r WHERE r.reverses_id = t.id)`,
+		orderID,
+	)
+	if err != nil {
+		return fmt.Errorf("select accruals: %w", err)
+	}
+	var (
+		ids   []int64
+		total money.Amount
+	)
+	for rows.Next() {
+		var (
+			id     int64
+			amount money.Amount
+		)
+		if err := rows.Scan(&id, &amount); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan accrual: %w", err)
+		}
+		ids = append(ids, id)
+		if total, err = total.Add(amount); err != nil {
+			rows.Close()
+			return fmt.Errorf("sum accruals: %w", err)
+		}
+	}
+	if err := closeRows(rows); err != nil {
+		return fmt.Errorf("select accruals: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	current, _, err := lockBalance(ctx, tx, userID)
+	if err != nil {
+		return fmt.Errorf("lock balance: %w", err)
+	}
+	if current.Cmp(total) < 0 {
+		return errOverdraft
+	}
+
+	for _, id := range ids {
+		var reversalID int64
+		if err := tx.QueryRowContext(
+			ctx,
+			`INSERT INTO ledger_transactions (user_id, kind, order_id, withdrawal_id, reverses_id, note)
+			 SELECT user_id, $2, order_id, withdrawal_id, id, $3
+			 FROM ledger_transactions
+			 WHERE id = $1
+			 RETURNING id`,
+			id, ledgerReversal, note,
+		).Scan(&reversalID); err != nil {
+			return fmt.Errorf("insert reversal: %w", err)
+		}
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO ledger_entries (transaction_id, account, amount)
+			 SELECT $1, account, -amount FROM ledger_entries WHERE transaction_id = $2`,
+			reversalID, id,
+		); err != nil {
+			return fmt.Errorf("insert reversal entries: %w", err)
+		}
+	}
+	return nil
+}
+
+// ledgerBalance returns what the user can spend and how much they have
+// withdrawn in total, net of reversed withdrawals. The totals come from the
+// balances row the database keeps in step with the ledger.
+func ledgerBalance(ctx context.Context, q rowQueryer, userID int64) (current, withdrawn money.Amount, err error) {
+	return scanBalance(q.QueryRowContext(
+		ctx,
+		`SELECT current, withdrawn FROM balances WHERE user_id = $1`,
+		userID,
+	))
+}
+
+// lockBalance is ledgerBalance that also locks the user's balance until tx
+// ends. Every ledger entry for the user updates the same row, so nothing can
+// change the balance in between.
+func lockBalance(ctx context.Context, tx *sql.Tx, userID int64) (current, withdrawn money.Amount, err error) {
+	return scanBalance(tx.QueryRowContext(
+		ctx,
+		`SELECT current, withdrawn FROM balances WHERE user_id = $1 FOR UPDATE`,
+		userID,
+	))
+}
+
+// scanBalance treats a user without a balances row, who has never been
+// credited, as having nothing.
+func scanBalance(row *sql.Row) (current, withdrawn money.Amount, err error) {
+	err = row.Scan(&current, &withdrawn)
+	if errors.Is(err, sql.ErrNoRows) {
+		return money.Zero, money.Zero, nil
+	}
+	return current, withdrawn, err
+}
+
+type ledgerEntryResponse struct {
+	ID        int64        `json:"id"`
+	Kind      string       `json:"kind"`
+	Amount    money.Amount `json:"amount"`
+	Order     *string      `json:"order,omitempty"`
+	Reverses  *int64       `json:"reverses,omitempty"`
+	Note      *string      `json:"note,omitempty"`
+	CreatedAt string       `json:"created_at"`
+}
+
+func (s *Server) handleLedger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := s.currentUserID(r)
+	s.writeLedger(w, r, userID)
+}
+
+// writeLedger lists the changes of the user's balance, newest first.
+func (s *Server) writeLedger(w http.ResponseWriter, r *http.Request, userID int64) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(
+		ctx,
+		`SELECT t.id, t.kind, e.amount, COALESCE(o.number, w."order"), t.reverses_id, t.note, t.created_at
+		 FROM ledger_transactions t
+		 JOIN ledger_entries e ON e.transaction_id = t.id AND e.account = 'user'
+		 LEFT JOIN orders o ON o.id = t.order_id
+		 LEFT JOIN withdrawals w ON w.id = t.withdrawal_id
+		 WHERE t.user_id = $1
+		 ORDER BY t.created_at DESC, t.id DESC`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var items []ledgerEntryResponse
+	for rows.Next() {
+		var (
+			item      ledgerEntryResponse
+			order     sql.NullString
+			reverses  sql.NullInt64
+			note      sql.NullString
+			createdAt time.Time
+		)
+		if err := rows.Scan(&item.ID, &item.Kind, &item.Amount, &order, &reverses, &note, &createdAt); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if order.Valid {
+			item.Order = &order.String
+		}
+		if reverses.Valid {
+			item.Reverses = &reverses.Int64
+		}
+		if note.Valid {
+			item.Note = &note.String
+		}
+		item.CreatedAt = createdAt.Format(time.RFC3339)
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if len(items) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(items); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+type adjustmentRequest struct {
+	Kind   string       `json:"kind"`
+	Amount money.Amount `json:"amount"`
+	Note   string       `json:"note"`
+}
+
+// handleAdminLedgerAdjustment credits or debits a user outside of orders and
+// withdrawals. Expiries only debit.
+func (s *Server) handleAdminLedgerAdjustment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	userID, ok := pathUserID(r)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var req adjustmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Kind == ledgerAdjustment && req.Amount.Sign() != 0 && req.Note != "":
+	case req.Kind == ledgerExpiry && req.Amount.Sign() < 0:
+	default:
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if req.Amount.Sign() < 0 {
+		current, _, err := lockBalance(ctx, tx, userID)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if next, err := current.Add(req.Amount); err != nil || next.Sign() < 0 {
+			http.Error(w, "the balance is lower than the debit", http.StatusConflict)
+			return
+		}
+	}
+
+	if _, err := postLedger(ctx, tx, ledgerPosting{UserID: userID, Kind: req.Kind, Note: req.Note, Amount: req.Amount}); err != nil {
+		log.Printf("admin: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := s.audit(ctx, tx, r, "ledger."+req.Kind, userID, map[string]any{"amount": req.Amount, "note": req.Note}); err != nil {
+		log.Printf("admin: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+type orderMismatch struct {
+	Number   string       `json:"number"`
+	UserID   int64        `json:"user_id"`
+	Expected money.Amount `json:"expected"`
+	Ledger   money.Amount `json:"ledger"`
+}
+
+type withdrawalMismatch struct {
+	ID       int64        `json:"id"`
+	UserID   int64        `json:"user_id"`
+	Expected money.Amount `json:"expected"`
+	Ledger   money.Amount `json:"ledger"`
+}
+
+type balanceMismatch struct {
+	UserID          int64        `json:"user_id"`
+	Current         money.Amount `json:"current"`
+	LedgerCurrent   money.Amount `json:"ledger_current"`
+	Withdrawn       money.Amount `json:"withdrawn"`
+	LedgerWithdrawn money.Amount `json:"ledger_withdrawn"`
+}
+
+type reconciliationReport struct {
+	OK                     bool                    `json:"ok"`
+	Accounts               map[string]money.Amount `json:"accounts"`
+	UnbalancedTransactions []int64                 `json:"unbalanced_transactions"`
+	Orders                 []orderMismatch         `json:"orders"`
+	Withdrawals            []withdrawalMismatch    `json:"withdrawals"`
+	Balances               []balanceMismatch       `json:"balances"`
+}
+
+const reconciliationLimit = 500
+
+// handleAdminLedgerReconciliation checks the ledger against itself and
+// against the orders and withdrawals it was posted for: every transaction
+// balances, every processed order is credited with its accrual exactly once
+// and every withdrawal is debited with its sum. The balances table has to
+// match the ledger totals.
+func (s *Server) handleAdminLedgerReconciliation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	if err := s.audit(ctx, s.db, r, "ledger.reconcile", 0, nil); err != nil {
+		log.Printf("admin: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	report, err := s.reconcileLedger(ctx)
+	if err != nil {
+		log.Printf("admin: reconcile ledger: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) reconcileLedger(ctx context.Context) (*reconciliationReport, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	report := &reconciliationReport{
+		Accounts:               map[string]money.Amount{},
+		UnbalancedTransactions: []int64{},
+		Orders:                 []orderMismatch{},
+		Withdrawals:            []withdrawalMismatch{},
+		Balances:               []balanceMismatch{},
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT account, SUM(amount) FROM ledger_entries GROUP BY account`)
+	if err != nil {
+		return nil, fmt.Errorf("select accounts: %w", err)
+	}
+	for rows.Next() {
+		var (
+			account string
+			total   money.Amount
+		)
+		if err := rows.Scan(&account, &total); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan account: %w", err)
+		}
+		report.Accounts[account] = total
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, fmt.Errorf("select accounts: %w", err)
+	}
+
+	rows, err = tx.QueryContext(
+		ctx,
+		`SELECT t.id
+		 FROM ledger_transactions t
+		 LEFT JOIN ledger_entries e ON e.transaction_id = t.id
+		 GROUP BY t.id
+		 HAVING COUNT(e.id) = 0 OR SUM(e.amount) <> 0
+		 ORDER BY t.id
+		 LIMIT $1`,
+		reconciliationLimit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select unbalanced transactions: %w", err)
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan transaction: %w", err)
+		}
+		report.UnbalancedTransactions = append(report.UnbalancedTransactions, id)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, fmt.Errorf("select unbalanced transactions: %w", err)
+	}
+
+	rows, err = tx.QueryContext(
+		ctx,
+		`SELECT number, user_id, expected, ledger
+		 FROM (
+		     SELECT o.number, o.user_id,
+		            CASE WHEN o.status = 'PROCESSED' THEN COALESCE(o.accrual, 0) ELSE 0 END AS expected,
+		            COALESCE(SUM(e.amount), 0) AS ledger
+		     FROM orders o
+		     LEFT JOIN ledger_transactions t ON t.order_id = o.id
+		     LEFT JOIN ledger_entries e ON e.transaction_id = t.id AND e.account = 'user'
+		     GROUP BY o.id
+		 ) AS s
+		 WHERE expected <> ledger
+		 ORDER BY number
+		 LIMIT $1`,
+		reconciliationLimit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select order mismatches: %w", err)
+	}
+	for rows.Next() {
+		var m orderMismatch
+		if err := rows.Scan(&m.Number, &m.UserID, &m.Expected, &m.Ledger); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan order mismatch: %w", err)
+		}
+		report.Orders = append(report.Orders, m)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, fmt.Errorf("select order mismatches: %w", err)
+	}
+
+	rows, err = tx.QueryContext(
+		ctx,
+		`SELECT id, user_id, expected, ledger
+		 FROM (
+		     SELECT wd.id, wd.user_id, -wd.sum AS expected, COALESCE(SUM(e.amount), 0) AS ledger
+		     FROM withdrawals wd
+		     LEFT JOIN ledger_transactions t ON t.withdrawal_id = wd.id
+		     LEFT JOIN ledger_entries e ON e.transaction_id = t.id AND e.account = 'user'
+		     GROUP BY wd.id
+		 ) AS s
+		 WHERE expected <> ledger
+		 ORDER BY id
+		 LIMIT $1`,
+		reconciliationLimit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select withdrawal mismatches: %w", err)
+	}
+	for rows.Next() {
+		var m withdrawalMismatch
+		if err := rows.Scan(&m.ID, &m.UserID, &m.Expected, &m.Ledger); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan withdrawal mismatch: %w", err)
+		}
+		report.Withdrawals = append(report.Withdrawals, m)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, fmt.Errorf("select withdrawal mismatches: %w", err)
+	}
+
+	rows, err = tx.QueryContext(
+		ctx,
+		`SELECT COALESCE(b.user_id, l.user_id),
+		        COALESCE(b.current, 0), COALESCE(l.current, 0),
+		        COALESCE(b.withdrawn, 0), COALESCE(l.withdrawn, 0)
+		 FROM balances b
+		 FULL JOIN (
+		     SELECT t.user_id,
+		            COALESCE(SUM(e.amount) FILTER (WHERE e.account = 'user'), 0) AS current,
+		            COALESCE(SUM(e.amount) FILTER (WHERE e.account = 'redeemed'), 0) AS withdrawn
+		     FROM ledger_entries e
+		     JOIN ledger_transactions t ON t.id = e.transaction_id
+		     GROUP BY t.user_id
+		 ) AS l ON l.user_id = b.user_id
+		 WHERE COALESCE(b.current, 0) <> COALESCE(l.current, 0)
+		    OR COALESCE(b.withdrawn, 0) <> COALESCE(l.withdrawn, 0)
+		 ORDER BY 1
+		 LIMIT $1`,
+		reconciliationLimit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("select balance mismatches: %w", err)
+	}
+	for rows.Next() {
+		var m balanceMismatch
+		if err := rows.Scan(&m.UserID, &m.Current, &m.LedgerCurrent, &m.Withdrawn, &m.LedgerWithdrawn); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan balance mismatch: %w", err)
+		}
+		report.Balances = append(report.Balances, m)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, fmt.Errorf("select balance mismatches: %w", err)
+	}
+
+	var total money.Amount
+	for _, v := range report.Accounts {
+		if total, err = total.Add(v); err != nil {
+			return nil, fmt.Errorf("sum accounts: %w", err)
+		}
+	}
+	report.OK = total.Sign() == 0 &&
+		len(report.UnbalancedTransactions) == 0 &&
+		len(report.Orders) == 0 &&
+		len(report.Withdrawals) == 0 &&
+		len(report.Balances) == 0
+	return report, nil
+}
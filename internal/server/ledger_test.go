@@ -0,0 +1,394 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/config"
+	"gophermart/internal/money"
+)
+
+// expectLedgerPosting expects postLedger to record amount for the user as
+// transaction id, balanced by counter.
+func expectLedgerPosting(mock sqlmock.Sqlmock, id, userID int64, kind string, orderID, withdrawalID int64, amount money.Amount, counter string) {
+	mock.ExpectQuery(`INSERT INTO ledger_transactions \(user_id, kind, order_id, withdrawal_id, note\)`).
+		WithArgs(userID, kind, nullID(orderID), nullID(withdrawalID), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(id, accountUser, amount.String(), counter, amount.Neg().String()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+}
+
+// expectLedgerBalance answers ledgerBalance and lockBalance for the user.
+func expectLedgerBalance(mock sqlmock.Sqlmock, userID int64, current, withdrawn string) {
+	mock.ExpectQuery(`SELECT current, withdrawn FROM balances WHERE user_id = \$1`).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"current", "withdrawn"}).AddRow(current, withdrawn))
+}
+
+func TestPostLedger(t *testing.T) {
+	tests := []struct {
+		name        string
+		posting     ledgerPosting
+		wantCounter string
+		wantErr     bool
+	}{
+		{
+			name:        "accrual credits the user from issued points",
+			posting:     ledgerPosting{UserID: 1, Kind: ledgerAccrual, OrderID: 7, Amount: money.MustParse("729.98")},
+			wantCounter: accountIssued,
+		},
+		{
+			name:        "withdrawal debits the user into redeemed points",
+			posting:     ledgerPosting{UserID: 1, Kind: ledgerWithdrawal, WithdrawalID: 3, Amount: money.MustParse("-751")},
+			wantCounter: accountRedeemed,
+		},
+		{
+			name:        "expiry",
+			posting:     ledgerPosting{UserID: 1, Kind: ledgerExpiry, Amount: money.MustParse("-10")},
+			wantCounter: accountExpired,
+		},
+		{
+			name:        "adjustment",
+			posting:     ledgerPosting{UserID: 1, Kind: ledgerAdjustment, Note: "goodwill", Amount: money.MustParse("0.01")},
+			wantCounter: accountAdjustments,
+		},
+		{
+			name:    "reversals are not posted directly",
+			posting: ledgerPosting{UserID: 1, Kind: ledgerReversal, Amount: money.FromInt(1)},
+			wantErr: true,
+		},
+		{
+			name:    "zero amount",
+			posting: ledgerPosting{UserID: 1, Kind: ledgerAccrual, OrderID: 7},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectBegin()
+			if !tt.wantErr {
+				p := tt.posting
+				expectLedgerPosting(mock, 42, p.UserID, p.Kind, p.OrderID, p.WithdrawalID, p.Amount, tt.wantCounter)
+			}
+			mock.ExpectRollback()
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatalf("Begin() error = %v", err)
+			}
+			id, err := postLedger(context.Background(), tx, tt.posting)
+			tx.Rollback()
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("postLedger() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && id != 42 {
+				t.Errorf("postLedger() = %d, want 42", id)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+// Every kind that can be posted has a program account on the other side, so
+// its entries always sum to zero.
+func TestLedgerCounterAccount(t *testing.T) {
+	for _, kind := range []string{ledgerAccrual, ledgerWithdrawal, ledgerExpiry, ledgerAdjustment} {
+		counter, ok := ledgerCounterAccount[kind]
+		if !ok || counter == accountUser {
+			t.Errorf("counter account for %s = %q, %v", kind, counter, ok)
+		}
+	}
+}
+
+func TestReverseOrderAccruals(t *testing.T) {
+	expectAccruals := func(mock sqlmock.Sqlmock, amount string) {
+		mock.ExpectQuery(`SELECT t.id, e.amount\s+FROM ledger_transactions t\s+JOIN ledger_entries e(.|\n)*WHERE t.order_id = \$1 AND t.kind = 'accrual'`).
+			WithArgs(int64(7)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "amount"}).AddRow(int64(10), amount))
+		mock.ExpectQuery(`SELECT current, withdrawn FROM balances WHERE user_id = \$1 FOR UPDATE`).
+			WithArgs(int64(2)).
+			WillReturnRows(sqlmock.NewRows([]string{"current", "withdrawn"}).AddRow("500", "100"))
+	}
+
+	tests := []struct {
+		name      string
+		setupMock func(mock sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "reversed",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectAccruals(mock, "500")
+				mock.ExpectQuery(`INSERT INTO ledger_transactions \(user_id, kind, order_id, withdrawal_id, reverses_id, note\)`).
+					WithArgs(int64(10), ledgerReversal, "order.reprocess").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(int64(11)))
+				mock.ExpectExec(`INSERT INTO ledger_entries \(transaction_id, account, amount\)\s+SELECT \$1, account, -amount`).
+					WithArgs(int64(11), int64(10)).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+			},
+		},
+		{
+			name: "points already spent",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectAccruals(mock, "500.01")
+			},
+			wantErr: errOverdraft,
+		},
+		{
+			name: "nothing to reverse",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT t.id, e.amount\s+FROM ledger_transactions t`).
+					WithArgs(int64(7)).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "amount"}))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectBegin()
+			tt.setupMock(mock)
+			mock.ExpectRollback()
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatalf("Begin() error = %v", err)
+			}
+			if err := reverseOrderAccruals(context.Background(), tx, 2, 7, "order.reprocess"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("reverseOrderAccruals() error = %v, want %v", err, tt.wantErr)
+			}
+			if err := tx.Rollback(); err != nil {
+				t.Fatalf("Rollback() error = %v", err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_handleLedger(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`FROM ledger_transactions t\s+JOIN ledger_entries e`).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "kind", "amount", "order", "reverses_id", "note", "created_at"}).
+			AddRow(int64(3), "reversal", "-500", "79927398713", int64(1), "order.reprocess", now).
+			AddRow(int64(2), "withdrawal", "-100.5", "2377225624", nil, nil, now).
+			AddRow(int64(1), "accrual", "500", "79927398713", nil, nil, now))
+
+	s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux()}
+
+	req := withTestUser(httptest.NewRequest(http.MethodGet, "/api/user/balance/history", nil), 1)
+	w := httptest.NewRecorder()
+
+	s.handleLedger(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("handleLedger() status = %v, want %v", w.Code, http.StatusOK)
+	}
+	var got []ledgerEntryResponse
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(got) != 3 || got[0].Reverses == nil || *got[0].Reverses != 1 || got[1].Amount != money.MustParse("-100.5") {
+		t.Errorf("handleLedger() = %+v", got)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestServer_handleAdminLedgerAdjustment(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+	}{
+		{
+			name: "adjustment",
+			body: `{"kind": "adjustment", "amount": 25.5, "note": "lost receipt"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).
+					WithArgs(int64(2)).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectBegin()
+				expectLedgerPosting(mock, 5, 2, ledgerAdjustment, 0, 0, money.MustParse("25.5"), accountAdjustments)
+				mock.ExpectExec(`INSERT INTO admin_audit`).
+					WithArgs(int64(9), "ledger.adjustment", sql.NullInt64{Int64: 2, Valid: true}, `{"amount":25.5,"note":"lost receipt"}`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusCreated,
+		},
+		{
+			name: "expiry",
+			body: `{"kind": "expiry", "amount": -10}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).
+					WithArgs(int64(2)).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectBegin()
+				expectLedgerBalance(mock, 2, "10", "0")
+				expectLedgerPosting(mock, 5, 2, ledgerExpiry, 0, 0, money.FromInt(-10), accountExpired)
+				mock.ExpectExec(`INSERT INTO admin_audit`).
+					WithArgs(int64(9), "ledger.expiry", sql.NullInt64{Int64: 2, Valid: true}, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusCreated,
+		},
+		{
+			name: "debit over the balance",
+			body: `{"kind": "adjustment", "amount": -10.01, "note": "duplicate accrual"}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).
+					WithArgs(int64(2)).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectBegin()
+				expectLedgerBalance(mock, 2, "10", "0")
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+		{
+			name:           "adjustment without a note",
+			body:           `{"kind": "adjustment", "amount": 25.5}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "expiry has to debit",
+			body:           `{"kind": "expiry", "amount": 10}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "reversals are not adjustments",
+			body:           `{"kind": "reversal", "amount": -10, "note": "x"}`,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "unknown user",
+			body: `{"kind": "expiry", "amount": -10}`,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT EXISTS`).
+					WithArgs(int64(2)).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			},
+			wantStatusCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			if tt.setupMock != nil {
+				tt.setupMock(mock)
+			}
+
+			s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux()}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/admin/users/2/ledger/adjustments", strings.NewReader(tt.body))
+			req.SetPathValue("id", "2")
+			req = withTestRole(req, 9, roleAdmin)
+			w := httptest.NewRecorder()
+
+			s.handleAdminLedgerAdjustment(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleAdminLedgerAdjustment() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_reconcileLedger(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT account, SUM\(amount\) FROM ledger_entries GROUP BY account`).
+		WillReturnRows(sqlmock.NewRows([]string{"account", "sum"}).
+			AddRow("user", "399.5").
+			AddRow("issued", "-500").
+			AddRow("redeemed", "100.5"))
+	mock.ExpectQuery(`HAVING COUNT\(e.id\) = 0 OR SUM\(e.amount\) <> 0`).
+		WithArgs(reconciliationLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`FROM orders o`).
+		WithArgs(reconciliationLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"number", "user_id", "expected", "ledger"}).
+			AddRow("2377225624", int64(1), "12", "0"))
+	mock.ExpectQuery(`FROM withdrawals wd`).
+		WithArgs(reconciliationLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "expected", "ledger"}))
+	mock.ExpectQuery(`FROM balances b\s+FULL JOIN`).
+		WithArgs(reconciliationLimit).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "current", "ledger_current", "withdrawn", "ledger_withdrawn"}))
+	mock.ExpectRollback()
+
+	s := &Server{cfg: &config.Config{}, db: db}
+
+	report, err := s.reconcileLedger(context.Background())
+	if err != nil {
+		t.Fatalf("reconcileLedger() error = %v", err)
+	}
+	if report.OK {
+		t.Error("reconcileLedger() OK = true with an order missing from the ledger")
+	}
+	if len(report.Orders) != 1 || report.Orders[0].Expected != money.FromInt(12) || report.Orders[0].Ledger.Sign() != 0 {
+		t.Errorf("reconcileLedger() orders = %+v", report.Orders)
+	}
+	if report.Accounts[accountUser] != money.MustParse("399.5") {
+		t.Errorf("reconcileLedger() accounts = %+v", report.Accounts)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
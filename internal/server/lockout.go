@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gophermart/internal/policy"
+)
+
+const (
+	lockoutScopeLogin = "login"
+	lockoutScopeIP    = "ip"
+
+	// Password reset requests are counted like failed logins, in scopes of
+	// their own so they neither lock nor unlock logging in.
+	lockoutScopeResetLogin = "reset_login"
+	lockoutScopeResetIP    = "reset_ip"
+)
+
+// loginLockedFor returns how long the login or the client IP is still locked
+// out, or zero if neither is. Counters live in PostgreSQL so every instance
+// sees the same state.
+func (s *Server) loginLockedFor(ctx context.Context, login, ip string) (time.Duration, error) {
+	var lockedUntil sql.NullTime
+	if err := s.db.QueryRowContext(
+		ctx,
+		`SELECT MAX(locked_until)
+		 FROM login_attempts
+		 WHERE ((scope = 'login' AND key = $1) OR (scope = 'ip' AND key = $2))
+		   AND locked_until > now()`,
+		policy.NormalizeLogin(login), ip,
+	).Scan(&lockedUntil); err != nil {
+		return 0, fmt.Errorf("query login lockout: %w", err)
+	}
+	if !lockedUntil.Valid {
+		return 0, nil
+	}
+	if d := time.Until(lockedUntil.Time); d > 0 {
+		return d, nil
+	}
+	return 0, nil
+}
+
+// passwordResetLockedFor is loginLockedFor for password reset requests.
+func (s *Server) passwordResetLockedFor(ctx context.Context, login, ip string) (time.Duration, error) {
+	var lockedUntil sql.NullTime
+	if err := s.db.QueryRowContext(
+		ctx,
+		`SELECT MAX(locked_until)
+		 FROM login_attempts
+		 WHERE ((scope = 'reset_login' AND key = $1) OR (scope = 'reset_ip' AND key = $2))
+		   AND locked_until > now()`,
+		policy.NormalizeLogin(login), ip,
+	).Scan(&lockedUntil); err != nil {
+		return 0, fmt.Errorf("query password reset lockout: %w", err)
+	}
+	if !lockedUntil.Valid {
+		return 0, nil
+	}
+	return max(time.Until(lockedUntil.Time), 0), nil
+}
+
+func (s *Server) recordPasswordResetRequest(ctx context.Context, login, ip string) error {
+	if err := s.recordFailure(ctx, lockoutScopeResetLogin, policy.NormalizeLogin(login), s.cfg.PasswordResetMaxRequests); err != nil {
+		return err
+	}
+	return s.recordFailure(ctx, lockoutScopeResetIP, ip, s.cfg.PasswordResetIPMaxRequests)
+}
+
+func (s *Server) recordLoginFailure(ctx context.Context, login, ip string) error {
+	if err := s.recordFailure(ctx, lockoutScopeLogin, policy.NormalizeLogin(login), s.cfg.LoginMaxFailures); err != nil {
+		return err
+	}
+	return s.recordFailure(ctx, lockoutScopeIP, ip, s.cfg.LoginIPMaxFailures)
+}
+
+func (s *Server) recordFailure(ctx context.Context, scope, key string, threshold int) error {
+	if threshold <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	window := s.cfg.LoginFailureWindow
+	if window <= 0 {
+		window = 15 * time.Minute
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The window runs from the end of the last lockout too, otherwise a
+	// lockout longer than the window would reset the counter and the lockouts
+	// would never grow to LoginLockoutMax.
+	var failures int
+	if err := tx.QueryRowContext(
+		ctx,
+		`INSERT INTO login_attempts (scope, key, failures, last_failure_at)
+		 VALUES ($1, $2, 1, $3)
+		 ON CONFLICT (scope, key) DO UPDATE
+		 SET failures = CASE
+		         WHEN GREATEST(login_attempts.last_failure_at, login_attempts.locked_until) < $4 THEN 1
+		         ELSE login_attempts.failures + 1
+		     END,
+		     last_failure_at = $3
+		 RETURNING failures`,
+		scope, key, now, now.Add(-window),
+	).Scan(&failures); err != nil {
+		return fmt.Errorf("record login failure: %w", err)
+	}
+
+	if failures >= threshold {
+		lockedUntil := now.Add(lockoutDuration(failures, threshold, s.cfg.LoginLockoutBase, s.cfg.LoginLockoutMax))
+
+		if _, err := tx.ExecContext(
+			ctx,
+			`UPDATE login_attempts SET locked_until = $3 WHERE scope = $1 AND key = $2`,
+			scope, key, lockedUntil,
+		); err != nil {
+			return fmt.Errorf("lock out: %w", err)
+		}
+
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO login_lockouts (scope, key, failures, locked_until) VALUES ($1, $2, $3, $4)`,
+			scope, key, failures, lockedUntil,
+		); err != nil {
+			return fmt.Errorf("audit lockout: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// resetLoginFailures clears the per-login counter after a successful login.
+// The per-IP counter is left alone so one valid account cannot be used to
+// keep resetting the budget for guessing others.
+func (s *Server) resetLoginFailures(ctx context.Context, login string) error {
+	_, err := s.db.ExecContext(
+		ctx,
+		`DELETE FROM login_attempts WHERE scope = 'login' AND key = $1`,
+		policy.NormalizeLogin(login),
+	)
+	return err
+}
+
+func lockoutDuration(failures, threshold int, base, max time.Duration) time.Duration {
+	if base <= 0 {
+		base = time.Minute
+	}
+	if max <= 0 {
+		max = time.Hour
+	}
+	exp := failures - threshold
+	if exp < 0 {
+		return 0
+	}
+	if exp > 30 {
+		return max
+	}
+	d := time.Duration(float64(base) * math.Pow(2, float64(exp)))
+	if d > max || d <= 0 {
+		return max
+	}
+	return d
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/config"
+)
+
+func expectNoLockout(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT MAX\(locked_until\)\s+FROM login_attempts`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(nil))
+}
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		threshold int
+		want      time.Duration
+	}{
+		{name: "below threshold", failures: 4, threshold: 5, want: 0},
+		{name: "at threshold", failures: 5, threshold: 5, want: time.Minute},
+		{name: "one over", failures: 6, threshold: 5, want: 2 * time.Minute},
+		{name: "three over", failures: 8, threshold: 5, want: 8 * time.Minute},
+		{name: "capped", failures: 20, threshold: 5, want: time.Hour},
+		{name: "huge exponent", failures: 500, threshold: 5, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := lockoutDuration(tt.failures, tt.threshold, time.Minute, time.Hour)
+			if got != tt.want {
+				t.Errorf("lockoutDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_handleLogin_lockout(t *testing.T) {
+	tests := []struct {
+		name           string
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+		wantRetryAfter bool
+	}{
+		{
+			name: "locked out",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT MAX\(locked_until\)\s+FROM login_attempts`).
+					WithArgs("testuser", "192.0.2.1").
+					WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(time.Now().Add(90 * time.Second)))
+			},
+			wantStatusCode: http.StatusTooManyRequests,
+			wantRetryAfter: true,
+		},
+		{
+			name: "failure that triggers a lockout is audited",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectNoLockout(mock)
+				mock.ExpectQuery(`SELECT id, password_hash FROM users`).
+					WithArgs("TestUser").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash"}).AddRow(1, "not-a-bcrypt-hash"))
+
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs(lockoutScopeLogin, "testuser", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(3))
+				mock.ExpectExec(`UPDATE login_attempts SET locked_until`).
+					WithArgs(lockoutScopeLogin, "testuser", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO login_lockouts`).
+					WithArgs(lockoutScopeLogin, "testuser", 3, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs(lockoutScopeIP, "192.0.2.1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(3))
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			tt.setupMock(mock)
+
+			s := &Server{
+				cfg: &config.Config{
+					LoginMaxFailures:   3,
+					LoginIPMaxFailures: 10,
+					LoginLockoutBase:   time.Minute,
+					LoginLockoutMax:    time.Hour,
+				},
+				db:     db,
+				mux:    http.NewServeMux(),
+				tokens: newTestSigner(t),
+			}
+
+			login := "testuser"
+			if !tt.wantRetryAfter {
+				login = "TestUser"
+			}
+			bodyBytes, _ := json.Marshal(credentials{Login: login, Password: "secret"})
+			req := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewReader(bodyBytes))
+			req.RemoteAddr = "192.0.2.1:52000"
+			w := httptest.NewRecorder()
+
+			s.handleLogin(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleLogin() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+			if tt.wantRetryAfter && w.Header().Get("Retry-After") != "90" {
+				t.Errorf("handleLogin() Retry-After = %q, want %q", w.Header().Get("Retry-After"), "90")
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gophermart/internal/oidc"
+	"gophermart/internal/policy"
+)
+
+const (
+	oidcStateCookieName = "oidc_state"
+	oidcStateTTL        = 10 * time.Minute
+
+	// unusablePasswordHash is stored for users provisioned through SSO; it is
+	// not a valid bcrypt hash so password login always fails for them.
+	unusablePasswordHash = "!"
+)
+
+var (
+	errIdentityLinkedElsewhere = errors.New("identity is linked to another user")
+	errAccountDeleted          = errors.New("account is deleted")
+)
+
+func (s *Server) newOIDCProvider(ctx context.Context) (*oidc.Provider, error) {
+	return oidc.Discover(ctx, oidc.Options{
+		Issuer:       s.cfg.OIDCIssuer,
+		ClientID:     s.cfg.OIDCClientID,
+		ClientSecret: s.cfg.OIDCClientSecret,
+		RedirectURL:  s.cfg.OIDCRedirectURL,
+	})
+}
+
+func (s *Server) handleOIDCStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	s.beginOIDC(w, r, 0)
+}
+
+// handleOIDCLink starts the same flow for a signed-in user; the identity
+// returned by the provider is attached to that user instead of logging in.
+func (s *Server) handleOIDCLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	userID, _ := s.currentUserID(r)
+	s.beginOIDC(w, r, userID)
+}
+
+func (s *Server) beginOIDC(w http.ResponseWriter, r *http.Request, linkUserID int64) {
+	if s.oidcProvider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, err := newRandomID()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := newRandomID()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var link sql.NullInt64
+	if linkUserID > 0 {
+		link = sql.NullInt64{Int64: linkUserID, Valid: true}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO oidc_login_states (state_hash, nonce, code_verifier, link_user_id, expires_at)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		hashToken(state), nonce, verifier, link, time.Now().Add(oidcStateTTL),
+	); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// The state is also bound to the browser so a callback URL obtained by
+	// someone else cannot be replayed into this user's session.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/api/user/oidc",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, s.oidcProvider.AuthCodeURL(state, nonce, challenge), http.StatusFound)
+}
+
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if s.oidcProvider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if state == "" || err != nil || cookie.Value != state {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Path: "/api/user/oidc", MaxAge: -1})
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	var (
+		nonce, verifier string
+		link            sql.NullInt64
+	)
+	err = s.db.QueryRowContext(
+		ctx,
+		`DELETE FROM oidc_login_states
+		 WHERE state_hash = $1 AND expires_at > now()
+		 RETURNING nonce, code_verifier, link_user_id`,
+		hashToken(state),
+	).Scan(&nonce, &verifier, &link)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	raw, err := s.oidcProvider.Exchange(ctx, code, verifier)
+	if err != nil {
+		log.Printf("oidc exchange: %v", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	idToken, err := s.oidcProvider.Verify(ctx, raw, nonce, time.Now())
+	if err != nil {
+		log.Printf("oidc verify: %v", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := s.resolveIdentity(ctx, idToken, link.Int64)
+	if errors.Is(err, errIdentityLinkedElsewhere) {
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errAccountDeleted) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if isUniqueViolation(err) {
+		// A password account already uses this login; its owner has to sign
+		// in and link the identity explicitly.
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+	var violations policyViolationsError
+	if errors.As(err, &violations) {
+		writePolicyViolations(w, violations)
+		return
+	}
+	if err != nil {
+		log.Printf("oidc resolve identity: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if link.Valid {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// An enrolled user still has to pass the local TOTP challenge unless the
+	// deployment trusts the provider to enforce its own second factor.
+	if !s.cfg.OIDCSkipTOTP {
+		secondFactor, err := s.totpEnabled(ctx, userID)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if secondFactor {
+			if err := s.startLoginChallenge(ctx, w, userID); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
+	if err := s.startSession(ctx, w, userID); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type policyViolationsError []policy.Violation
+
+func (e policyViolationsError) Error() string {
+	return fmt.Sprintf("%d policy violations", len(e))
+}
+
+// resolveIdentity maps a verified ID token to a local user: an already linked
+// identity wins, otherwise it is linked to linkUserID when set, or a new user
+// is provisioned from the token's preferred username or email. Deleted users
+// are never signed in or linked to.
+func (s *Server) resolveIdentity(ctx context.Context, tok *oidc.IDToken, linkUserID int64) (int64, error) {
+	var (
+		userID  int64
+		deleted bool
+	)
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT i.user_id, u.deleted_at IS NOT NULL
+		 FROM user_identities i
+		 JOIN users u ON u.id = i.user_id
+		 WHERE i.issuer = $1 AND i.subject = $2`,
+		tok.Issuer, tok.Subject,
+	).Scan(&userID, &deleted)
+	switch {
+	case err == nil:
+		if linkUserID > 0 && linkUserID != userID {
+			return 0, errIdentityLinkedElsewhere
+		}
+		if deleted {
+			return 0, errAccountDeleted
+		}
+		return userID, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return 0, fmt.Errorf("select identity: %w", err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	userID = linkUserID
+	if userID > 0 {
+		// The lock keeps the account from being deleted before the link is
+		// committed.
+		var live bool
+		if err := tx.QueryRowContext(
+			ctx,
+			`SELECT deleted_at IS NULL FROM users WHERE id = $1 FOR UPDATE`,
+			userID,
+		).Scan(&live); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("lock user: %w", err)
+		}
+		if !live {
+			return 0, errAccountDeleted
+		}
+	} else {
+		login := tok.PreferredUsername
+		if login == "" {
+			login = tok.Email
+		}
+		login = policy.NormalizeLogin(login)
+		if violations := s.policy.CheckLogin(login); len(violations) > 0 {
+			return 0, policyViolationsError(violations)
+		}
+
+		if err := tx.QueryRowContext(
+			ctx,
+			`INSERT INTO users (login, password_hash) VALUES ($1, $2) RETURNING id`,
+			login, unusablePasswordHash,
+		).Scan(&userID); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO user_identities (user_id, issuer, subject, email) VALUES ($1, $2, $3, $4)`,
+		userID, tok.Issuer, tok.Subject, sql.NullString{String: tok.Email, Valid: tok.Email != ""},
+	); err != nil {
+		if isUniqueViolation(err) {
+			return 0, errIdentityLinkedElsewhere
+		}
+		return 0, fmt.Errorf("insert identity: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return userID, nil
+}
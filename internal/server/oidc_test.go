@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/config"
+	"gophermart/internal/oidc"
+	"gophermart/internal/oidc/oidctest"
+)
+
+// capturedArg matches any argument and remembers it, so values generated
+// inside a handler can be fed back into later expectations.
+type capturedArg struct {
+	value driver.Value
+}
+
+func (c *capturedArg) Match(v driver.Value) bool {
+	c.value = v
+	return true
+}
+
+func expectTOTPEnabled(mock sqlmock.Sqlmock, userID int64, enabled bool) {
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_totp`).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(enabled))
+}
+
+func TestServer_oidcLogin(t *testing.T) {
+	fake, err := oidctest.NewProvider("gophermart")
+	if err != nil {
+		t.Fatalf("oidctest.NewProvider() error = %v", err)
+	}
+	defer fake.Close()
+	fake.SetUser(oidctest.User{Subject: "sso-1", Email: "alice@example.com", PreferredUsername: "Alice"})
+
+	provider, err := oidc.Discover(context.Background(), oidc.Options{
+		Issuer:      fake.Issuer(),
+		ClientID:    "gophermart",
+		RedirectURL: "http://gophermart.test/api/user/oidc/callback",
+	})
+	if err != nil {
+		t.Fatalf("Discover() error = %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		linkUserID     int64
+		skipTOTP       bool
+		setupIdentity  func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+		wantSession    bool
+	}{
+		{
+			name: "first login provisions a user",
+			setupIdentity: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM user_identities`).
+					WithArgs(fake.Issuer(), "sso-1").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO users`).
+					WithArgs("alice", unusablePasswordHash).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+				mock.ExpectExec(`INSERT INTO user_identities`).
+					WithArgs(int64(7), fake.Issuer(), "sso-1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				expectTOTPEnabled(mock, 7, false)
+				mock.ExpectExec(`INSERT INTO sessions`).
+					WithArgs(sqlmock.AnyArg(), int64(7), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatusCode: http.StatusOK,
+			wantSession:    true,
+		},
+		{
+			name: "linked identity logs in",
+			setupIdentity: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT i.user_id, u.deleted_at IS NOT NULL\s+FROM user_identities i`).
+					WithArgs(fake.Issuer(), "sso-1").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "deleted"}).AddRow(3, false))
+				expectTOTPEnabled(mock, 3, false)
+				mock.ExpectExec(`INSERT INTO sessions`).
+					WithArgs(sqlmock.AnyArg(), int64(3), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatusCode: http.StatusOK,
+			wantSession:    true,
+		},
+		{
+			name: "enrolled user gets a second factor challenge",
+			setupIdentity: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM user_identities`).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "deleted"}).AddRow(3, false))
+				expectTOTPEnabled(mock, 3, true)
+				mock.ExpectExec(`INSERT INTO login_challenges`).
+					WithArgs(sqlmock.AnyArg(), int64(3), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatusCode: http.StatusAccepted,
+		},
+		{
+			name:     "provider trusted for the second factor",
+			skipTOTP: true,
+			setupIdentity: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM user_identities`).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "deleted"}).AddRow(3, false))
+				mock.ExpectExec(`INSERT INTO sessions`).
+					WithArgs(sqlmock.AnyArg(), int64(3), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatusCode: http.StatusOK,
+			wantSession:    true,
+		},
+		{
+			name: "deleted user",
+			setupIdentity: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM user_identities`).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "deleted"}).AddRow(3, true))
+			},
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "login taken by a password account",
+			setupIdentity: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM user_identities`).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO users`).
+					WillReturnError(errors.New(`duplicate key value violates unique constraint "users_login_key"`))
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+		{
+			name:       "link to the signed-in user",
+			linkUserID: 5,
+			setupIdentity: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM user_identities`).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT deleted_at IS NULL FROM users WHERE id = \$1 FOR UPDATE`).
+					WithArgs(int64(5)).
+					WillReturnRows(sqlmock.NewRows([]string{"live"}).AddRow(true))
+				mock.ExpectExec(`INSERT INTO user_identities`).
+					WithArgs(int64(5), fake.Issuer(), "sso-1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:       "link to a deleted user",
+			linkUserID: 5,
+			setupIdentity: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM user_identities`).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT deleted_at IS NULL FROM users`).
+					WithArgs(int64(5)).
+					WillReturnRows(sqlmock.NewRows([]string{"live"}).AddRow(false))
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "identity already linked to someone else",
+			linkUserID: 5,
+			setupIdentity: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM user_identities`).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "deleted"}).AddRow(3, false))
+			},
+			wantStatusCode: http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			s := &Server{
+				cfg:          &config.Config{OIDCSkipTOTP: tt.skipTOTP},
+				db:           db,
+				mux:          http.NewServeMux(),
+				tokens:       newTestSigner(t),
+				oidcProvider: provider,
+			}
+
+			var stateHash, nonce, verifier capturedArg
+			mock.ExpectExec(`INSERT INTO oidc_login_states`).
+				WithArgs(&stateHash, &nonce, &verifier, sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/oidc/start", nil)
+			if tt.linkUserID > 0 {
+				req = withTestUser(req, tt.linkUserID)
+			}
+			w := httptest.NewRecorder()
+			s.beginOIDC(w, req, tt.linkUserID)
+
+			if w.Code != http.StatusFound {
+				t.Fatalf("beginOIDC() status = %v, want %v", w.Code, http.StatusFound)
+			}
+			stateCookie := w.Result().Cookies()[0]
+
+			callback := followAuthorize(t, w.Header().Get("Location"))
+
+			var link any
+			if tt.linkUserID > 0 {
+				link = tt.linkUserID
+			}
+			mock.ExpectQuery(`DELETE FROM oidc_login_states`).
+				WithArgs(hashToken(callback.Query().Get("state"))).
+				WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier", "link_user_id"}).
+					AddRow(nonce.value, verifier.value, link))
+			tt.setupIdentity(mock)
+
+			req = httptest.NewRequest(http.MethodGet, callback.String(), nil)
+			req.AddCookie(stateCookie)
+			w = httptest.NewRecorder()
+			s.handleOIDCCallback(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleOIDCCallback() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+			gotSession := false
+			for _, c := range w.Result().Cookies() {
+				if c.Name == authCookieName && c.Value != "" {
+					gotSession = true
+				}
+			}
+			if gotSession != tt.wantSession {
+				t.Errorf("handleOIDCCallback() session cookie = %v, want %v", gotSession, tt.wantSession)
+			}
+			if stateHash.value != hashToken(callback.Query().Get("state")) {
+				t.Error("state is not stored hashed")
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_handleOIDCCallback_stateMismatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux(), oidcProvider: &oidc.Provider{}}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/oidc/callback?code=c&state=attacker", nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookieName, Value: "victim"})
+	w := httptest.NewRecorder()
+
+	s.handleOIDCCallback(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("handleOIDCCallback() status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func followAuthorize(t *testing.T, authURL string) *url.URL {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	defer resp.Body.Close()
+
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize status = %v, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	return loc
+}
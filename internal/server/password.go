@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type changePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	sess, _ := sessionFromContext(r.Context())
+
+	var req changePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if req.OldPassword == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if req.NewPassword == "" {
+		writePolicyViolations(w, s.policy.CheckPassword(req.NewPassword, ""))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var login, passwordHash string
+	if err := s.db.QueryRowContext(
+		ctx,
+		`SELECT login, password_hash FROM users WHERE id = $1`,
+		sess.UserID,
+	).Scan(&login, &passwordHash); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.OldPassword)); err != nil {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if violations := s.policy.CheckPassword(req.NewPassword, login); len(violations) > 0 {
+		writePolicyViolations(w, violations)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE users SET password_hash = $1 WHERE id = $2`,
+		string(hash), sess.UserID,
+	); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE sessions
+		 SET revoked_at = now()
+		 WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL`,
+		sess.UserID, sess.ID,
+	); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type passwordResetRequest struct {
+	Login string `json:"login"`
+}
+
+// handleRequestPasswordReset always answers 202 so that the endpoint cannot be
+// used to find out which logins exist. The login is looked up and the reset
+// sent after answering, so known and unknown logins take the same time.
+// Requests are throttled per login and per client IP.
+func (s *Server) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var req passwordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if req.Login == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	ip := clientIP(r)
+	lockedFor, err := s.passwordResetLockedFor(ctx, req.Login, ip)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if lockedFor > 0 {
+		writeTooManyRequests(w, lockedFor)
+		return
+	}
+	if err := s.recordPasswordResetRequest(ctx, req.Login, ip); err != nil {
+		log.Printf("record password reset request: %v", err)
+	}
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 30*time.Second)
+		defer cancel()
+		if err := s.sendPasswordReset(ctx, req.Login); err != nil {
+			log.Printf("password reset: %v", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendPasswordReset issues a reset token for login and sends it to the user.
+// Unknown logins are ignored.
+func (s *Server) sendPasswordReset(ctx context.Context, login string) error {
+	var userID int64
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT id FROM users WHERE lower(login) = lower($1)`,
+		login,
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("look up login: %w", err)
+	}
+
+	token, err := newRandomID()
+	if err != nil {
+		return fmt.Errorf("generate token: %w", err)
+	}
+
+	if _, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO password_resets (token_hash, user_id, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4)`,
+		hashToken(token), userID, time.Now(), time.Now().Add(s.passwordResetTTL()),
+	); err != nil {
+		return fmt.Errorf("insert token: %w", err)
+	}
+
+	if err := s.notifier.SendPasswordReset(ctx, login, token); err != nil {
+		return fmt.Errorf("send: %w", err)
+	}
+	return nil
+}
+
+type confirmPasswordResetRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+func (s *Server) handleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var req confirmPasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if req.NewPassword == "" {
+		writePolicyViolations(w, s.policy.CheckPassword(req.NewPassword, ""))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		userID int64
+		login  string
+	)
+	err = tx.QueryRowContext(
+		ctx,
+		`UPDATE password_resets pr
+		 SET used_at = now()
+		 FROM users u
+		 WHERE pr.token_hash = $1 AND pr.used_at IS NULL AND pr.expires_at > now() AND u.id = pr.user_id
+		 RETURNING pr.user_id, u.login`,
+		hashToken(req.Token),
+	).Scan(&userID, &login)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// A rejected password rolls back, so the token can be used again.
+	if violations := s.policy.CheckPassword(req.NewPassword, login); len(violations) > 0 {
+		writePolicyViolations(w, violations)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE users SET password_hash = $1 WHERE id = $2`,
+		string(hash), userID,
+	); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`,
+		userID,
+	); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) passwordResetTTL() time.Duration {
+	if s.cfg.PasswordResetTTL > 0 {
+		return s.cfg.PasswordResetTTL
+	}
+	return time.Hour
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+
+	"gophermart/internal/config"
+	"gophermart/internal/policy"
+)
+
+type recordingNotifier struct {
+	login string
+	token string
+	err   error
+}
+
+func (n *recordingNotifier) SendPasswordReset(_ context.Context, login, token string) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.login = login
+	n.token = token
+	return nil
+}
+
+func TestServer_handleChangePassword(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("oldpass"), bcrypt.MinCost)
+
+	tests := []struct {
+		name           string
+		body           interface{}
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+	}{
+		{
+			name: "password changed and other sessions revoked",
+			body: changePasswordRequest{OldPassword: "oldpass", NewPassword: "newpass"},
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT login, password_hash FROM users WHERE id = \$1`).
+					WithArgs(int64(1)).
+					WillReturnRows(sqlmock.NewRows([]string{"login", "password_hash"}).AddRow("alice", string(hash)))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE users SET password_hash`).
+					WithArgs(sqlmock.AnyArg(), int64(1)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE sessions\s+SET revoked_at = now\(\)\s+WHERE user_id = \$1 AND id <> \$2`).
+					WithArgs(int64(1), "test-session").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "wrong old password",
+			body: changePasswordRequest{OldPassword: "wrong", NewPassword: "newpass"},
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT login, password_hash FROM users WHERE id = \$1`).
+					WithArgs(int64(1)).
+					WillReturnRows(sqlmock.NewRows([]string{"login", "password_hash"}).AddRow("alice", string(hash)))
+			},
+			wantStatusCode: http.StatusForbidden,
+		},
+		{
+			name: "new password equals login",
+			body: changePasswordRequest{OldPassword: "oldpass", NewPassword: "Alice"},
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT login, password_hash FROM users WHERE id = \$1`).
+					WithArgs(int64(1)).
+					WillReturnRows(sqlmock.NewRows([]string{"login", "password_hash"}).AddRow("alice", string(hash)))
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "empty new password",
+			body:           changePasswordRequest{OldPassword: "oldpass"},
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			if tt.setupMock != nil {
+				tt.setupMock(mock)
+			}
+
+			pol, err := policy.New(policy.Options{})
+			if err != nil {
+				t.Fatalf("policy.New() error = %v", err)
+			}
+			s := &Server{
+				cfg:    &config.Config{},
+				db:     db,
+				mux:    http.NewServeMux(),
+				policy: pol,
+			}
+
+			bodyBytes, _ := json.Marshal(tt.body)
+			req := httptest.NewRequest(http.MethodPost, "/api/user/password", bytes.NewReader(bodyBytes))
+			req = withTestUser(req, 1)
+			w := httptest.NewRecorder()
+
+			s.handleChangePassword(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleChangePassword() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_handleRequestPasswordReset(t *testing.T) {
+	expectNotThrottled := func(mock sqlmock.Sqlmock, login string) {
+		mock.ExpectQuery(`SELECT MAX\(locked_until\)\s+FROM login_attempts\s+WHERE \(\(scope = 'reset_login'`).
+			WithArgs(login, "192.0.2.1").
+			WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(nil))
+	}
+
+	tests := []struct {
+		name           string
+		login          string
+		notifyErr      error
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+		wantToken      bool
+	}{
+		{
+			name:  "known login",
+			login: "alice",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectNotThrottled(mock, "alice")
+				mock.ExpectQuery(`SELECT id FROM users WHERE lower\(login\) = lower\(\$1\)`).
+					WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+				mock.ExpectExec(`INSERT INTO password_resets`).
+					WithArgs(sqlmock.AnyArg(), int64(7), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatusCode: http.StatusAccepted,
+			wantToken:      true,
+		},
+		{
+			name:      "delivery fails",
+			login:     "alice",
+			notifyErr: errors.New("smtp: connection refused"),
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectNotThrottled(mock, "alice")
+				mock.ExpectQuery(`SELECT id FROM users WHERE lower\(login\) = lower\(\$1\)`).
+					WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+				mock.ExpectExec(`INSERT INTO password_resets`).
+					WithArgs(sqlmock.AnyArg(), int64(7), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatusCode: http.StatusAccepted,
+		},
+		{
+			name:  "unknown login",
+			login: "nobody",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectNotThrottled(mock, "nobody")
+				mock.ExpectQuery(`SELECT id FROM users WHERE lower\(login\) = lower\(\$1\)`).
+					WithArgs("nobody").
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantStatusCode: http.StatusAccepted,
+		},
+		{
+			name:  "throttled",
+			login: "Alice",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT MAX\(locked_until\)\s+FROM login_attempts`).
+					WithArgs("alice", "192.0.2.1").
+					WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(time.Now().Add(time.Minute)))
+			},
+			wantStatusCode: http.StatusTooManyRequests,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			tt.setupMock(mock)
+
+			n := &recordingNotifier{err: tt.notifyErr}
+			s := &Server{
+				cfg:      &config.Config{},
+				db:       db,
+				mux:      http.NewServeMux(),
+				notifier: n,
+			}
+
+			bodyBytes, _ := json.Marshal(passwordResetRequest{Login: tt.login})
+			req := httptest.NewRequest(http.MethodPost, "/api/user/password/reset", bytes.NewReader(bodyBytes))
+			req.RemoteAddr = "192.0.2.1:52000"
+			w := httptest.NewRecorder()
+
+			s.handleRequestPasswordReset(w, req)
+			s.background.Wait()
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleRequestPasswordReset() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+			if got := n.token != ""; got != tt.wantToken {
+				t.Errorf("token delivered = %v, want %v", got, tt.wantToken)
+			}
+			if tt.wantToken && n.login != tt.login {
+				t.Errorf("token delivered to %q, want %q", n.login, tt.login)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_handleConfirmPasswordReset(t *testing.T) {
+	tests := []struct {
+		name           string
+		newPassword    string
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+	}{
+		{
+			name: "valid token",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`UPDATE password_resets pr\s+SET used_at = now\(\)\s+FROM users u`).
+					WithArgs(hashToken("reset-token")).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "login"}).AddRow(7, "alice"))
+				mock.ExpectExec(`UPDATE users SET password_hash`).
+					WithArgs(sqlmock.AnyArg(), int64(7)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE sessions SET revoked_at = now\(\) WHERE user_id = \$1`).
+					WithArgs(int64(7)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:        "new password equals login",
+			newPassword: "alice",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`UPDATE password_resets`).
+					WithArgs(hashToken("reset-token")).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "login"}).AddRow(7, "alice"))
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "used, expired or unknown token",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`UPDATE password_resets`).
+					WithArgs(hashToken("reset-token")).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			tt.setupMock(mock)
+
+			pol, err := policy.New(policy.Options{})
+			if err != nil {
+				t.Fatalf("policy.New() error = %v", err)
+			}
+			s := &Server{
+				cfg:    &config.Config{},
+				db:     db,
+				mux:    http.NewServeMux(),
+				policy: pol,
+			}
+
+			newPassword := tt.newPassword
+			if newPassword == "" {
+				newPassword = "newpass"
+			}
+			bodyBytes, _ := json.Marshal(confirmPasswordResetRequest{Token: "reset-token", NewPassword: newPassword})
+			req := httptest.NewRequest(http.MethodPost, "/api/user/password/reset/confirm", bytes.NewReader(bodyBytes))
+			w := httptest.NewRecorder()
+
+			s.handleConfirmPasswordReset(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleConfirmPasswordReset() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
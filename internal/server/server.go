@@ -9,8 +9,8 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -18,218 +18,266 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"gophermart/internal/accrual"
+	"gophermart/internal/auth"
 	"gophermart/internal/config"
 	"gophermart/internal/migrations"
+	"gophermart/internal/money"
+	"gophermart/internal/notify"
+	"gophermart/internal/oidc"
+	"gophermart/internal/policy"
+	"gophermart/internal/ratelimit"
+	"gophermart/internal/secretbox"
 )
 
 type Server struct {
 	cfg           *config.Config
 	db            *sql.DB
 	mux           *http.ServeMux
-	accrualClient *accrual.Client
+	tokens        *auth.Signer
+	notifier      notify.Notifier
+	policy        *policy.Policy
+	totpBox       *secretbox.Box
+	apiKeyLimiter *ratelimit.Limiter
+	oidcProvider  *oidc.Provider
+	instanceID    string
+
+	accrualProvider accrual.Provider
+	accrualLimiter  *accrual.Limiter
+
+	httpServer  *http.Server
+	stopAccrual context.CancelFunc
+	accrualDone chan struct{}
+	// background tracks work that outlives its request.
+	background sync.WaitGroup
 }
 
-func New(cfg *config.Config) (*Server, error) {
+const authCookieName = "auth_token"
+
+type Option func(*Server)
+
+// WithAccrualProvider sets where order accruals are fetched from. Without it
+// the accrual worker does not run.
+func WithAccrualProvider(p accrual.Provider) Option {
+	return func(s *Server) {
+		s.accrualProvider = p
+	}
+}
+
+// New connects to the database and starts the accrual worker. The worker stops
+// when ctx is cancelled or on Shutdown.
+func New(ctx context.Context, cfg *config.Config, opts ...Option) (_ *Server, err error) {
+	tokens, err := newSigner(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("create token signer: %w", err)
+	}
+
+	pol, err := policy.New(policy.Options{
+		PasswordMinLength: cfg.PasswordMinLength,
+		PasswordClasses:   cfg.PasswordClasses,
+		DenyListFile:      cfg.PasswordDenyListFile,
+		LoginMinLength:    cfg.LoginMinLength,
+		LoginMaxLength:    cfg.LoginMaxLength,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create policy: %w", err)
+	}
+
 	db, err := sql.Open("pgx", cfg.DatabaseURI)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			db.Close()
+		}
+	}()
 
-	if err := db.Ping(); err != nil {
+	if err := db.PingContext(ctx); err != nil {
 		return nil, fmt.Errorf("ping database: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	initCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	if err := migrations.Apply(ctx, db); err != nil {
+	if err := migrations.Apply(initCtx, db); err != nil {
 		return nil, fmt.Errorf("apply migrations: %w", err)
 	}
 
 	s := &Server{
-		cfg: cfg,
-		db:  db,
-		mux: http.NewServeMux(),
+		cfg:           cfg,
+		db:            db,
+		mux:           http.NewServeMux(),
+		tokens:        tokens,
+		policy:        pol,
+		apiKeyLimiter: ratelimit.New(cfg.APIKeyRateLimit, cfg.APIKeyRateBurst),
+		accrualDone:   make(chan struct{}),
+	}
+	s.httpServer = &http.Server{Addr: cfg.RunAddress, Handler: s.mux}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := s.promoteAdmins(initCtx); err != nil {
+		return nil, fmt.Errorf("promote admins: %w", err)
 	}
 
-	if cfg.AccrualSystemAddr != "" {
-		cl, err := accrual.New(cfg.AccrualSystemAddr)
+	if cfg.TOTPEncryptionKey != "" {
+		box, err := secretbox.New(cfg.TOTPEncryptionKey)
 		if err != nil {
-			return nil, fmt.Errorf("create accrual client: %w", err)
+			return nil, fmt.Errorf("create totp secret box: %w", err)
 		}
-		s.accrualClient = cl
-		go s.accrualWorker()
+		s.totpBox = box
 	}
 
-	s.registerRoutes()
-
-	return s, nil
-}
-
-func (s *Server) ListenAndServe() error {
-	defer func() {
-		if err := s.db.Close(); err != nil {
-			log.Printf("close db: %v", err)
+	if cfg.OIDCIssuer != "" {
+		p, err := s.newOIDCProvider(initCtx)
+		if err != nil {
+			return nil, fmt.Errorf("create oidc provider: %w", err)
 		}
-	}()
-
-	return http.ListenAndServe(s.cfg.RunAddress, s.mux)
-}
-
-func (s *Server) registerRoutes() {
-	s.mux.HandleFunc("/api/user/register", s.handleRegister)
-	s.mux.HandleFunc("/api/user/login", s.handleLogin)
-
-	s.mux.HandleFunc("/api/user/orders", s.withAuth(s.handleOrders))
-	s.mux.HandleFunc("/api/user/balance", s.withAuth(s.handleBalance))
-	s.mux.HandleFunc("/api/user/balance/withdraw", s.withAuth(s.handleWithdraw))
-	s.mux.HandleFunc("/api/user/withdrawals", s.withAuth(s.handleWithdrawals))
-}
-
-func (s *Server) accrualWorker() {
-	if s.accrualClient == nil {
-		return
+		s.oidcProvider = p
 	}
 
-	for {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if cfg.PasswordResetFile != "" {
+		s.notifier = notify.NewFileNotifier(cfg.PasswordResetFile)
+	} else {
+		s.notifier = notify.LogNotifier{}
+	}
 
-		rows, err := s.db.QueryContext(
-			ctx,
-			`SELECT id, number, user_id
-			 FROM orders
-			 WHERE status IN ('NEW', 'PROCESSING')
-			 ORDER BY uploaded_at
-			 LIMIT 100`,
-		)
-		cancel()
+	if s.accrualProvider != nil {
+		instanceID, err := newInstanceID(cfg.InstanceID)
 		if err != nil {
-			log.Printf("accrualWorker: query orders: %v", err)
-			time.Sleep(time.Second)
-			continue
+			return nil, fmt.Errorf("generate instance id: %w", err)
 		}
+		s.instanceID = instanceID
 
-		type row struct {
-			id     int64
-			number string
-			userID int64
+		var coord accrual.Coordinator
+		if cfg.AccrualRateShared {
+			coord = accrual.NewPostgresCoordinator(db)
 		}
+		s.accrualLimiter = accrual.NewLimiter(s.accrualProvider, cfg.AccrualRateLimit, cfg.AccrualRateBurst, coord)
+	}
 
-		var batch []row
-		for rows.Next() {
-			var r row
-			if err := rows.Scan(&r.id, &r.number, &r.userID); err != nil {
-				log.Printf("accrualWorker: scan row: %v", err)
-				continue
-			}
-			batch = append(batch, r)
-		}
-		rows.Close()
+	workerCtx, stop := context.WithCancel(ctx)
+	s.stopAccrual = stop
+	go func() {
+		defer close(s.accrualDone)
+		s.accrualWorker(workerCtx)
+	}()
 
-		if len(batch) == 0 {
-			time.Sleep(time.Second)
-			continue
-		}
+	s.registerRoutes()
 
-		for _, ord := range batch {
-			s.processAccrualOrder(ord.id, ord.number, ord.userID)
-		}
-	}
+	return s, nil
 }
 
-func (s *Server) processAccrualOrder(orderID int64, number string, userID int64) {
-	if s.accrualClient == nil {
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	info, err := s.accrualClient.GetOrderInfo(ctx, number)
-	if err != nil {
-		if rl, ok := err.(*accrual.RateLimitError); ok {
-			log.Printf("accrualWorker: rate limit reached, sleep %s", rl.RetryAfter)
-			time.Sleep(rl.RetryAfter)
-			return
+func newSigner(cfg *config.Config) (*auth.Signer, error) {
+	signingKey := cfg.AuthSigningKey
+	if signingKey == "" {
+		key, err := newRandomID()
+		if err != nil {
+			return nil, fmt.Errorf("generate signing key: %w", err)
 		}
-		log.Printf("accrualWorker: get order info: %v", err)
-		return
+		signingKey = key
+		log.Printf("auth signing key is not configured, using an ephemeral key: tokens will not survive a restart")
 	}
 
-	if info == nil {
-		return
+	ttl := cfg.AuthTokenTTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
 	}
 
-	switch info.Status {
-	case accrual.StatusRegistered, accrual.StatusProcessing:
-		if _, err := s.db.ExecContext(
-			ctx,
-			`UPDATE orders SET status = 'PROCESSING' WHERE id = $1`,
-			orderID,
-		); err != nil {
-			log.Printf("accrualWorker: update order PROCESSING: %v", err)
-		}
-	case accrual.StatusInvalid:
-		if _, err := s.db.ExecContext(
-			ctx,
-			`UPDATE orders SET status = 'INVALID' WHERE id = $1`,
-			orderID,
-		); err != nil {
-			log.Printf("accrualWorker: update order INVALID: %v", err)
-		}
-	case accrual.StatusProcessed:
-		var accrualVal float64
-		if info.Accrual != nil {
-			accrualVal = *info.Accrual
-		}
+	return auth.NewSigner(append([]string{signingKey}, cfg.AuthVerifyKeys...), ttl)
+}
 
-		tx, err := s.db.BeginTx(ctx, nil)
-		if err != nil {
-			log.Printf("accrualWorker: begin tx: %v", err)
-			return
-		}
-		defer tx.Rollback()
+// ListenAndServe returns http.ErrServerClosed once Shutdown was called.
+func (s *Server) ListenAndServe() error {
+	return s.httpServer.ListenAndServe()
+}
 
-		if _, err := tx.ExecContext(
-			ctx,
-			`UPDATE orders
-			 SET status = 'PROCESSED',
-			     accrual = $1
-			 WHERE id = $2`,
-			accrualVal, orderID,
-		); err != nil {
-			log.Printf("accrualWorker: update order PROCESSED: %v", err)
-			return
+// Shutdown stops the accrual worker from claiming orders, drains in-flight
+// requests, waits for the worker to finish or release its claimed orders and
+// closes the database last. Whatever is left when ctx expires is abandoned;
+// unfinished claims then run out with their lease.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopAccrual()
+
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		log.Printf("shutdown http server: %v", err)
+	}
+
+	select {
+	case <-s.accrualDone:
+	case <-ctx.Done():
+		log.Printf("shutdown accrual worker: %v", ctx.Err())
+		if err == nil {
+			err = ctx.Err()
 		}
+	}
 
-		if err := tx.Commit(); err != nil {
-			log.Printf("accrualWorker: commit tx: %v", err)
-			return
+	backgroundDone := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(backgroundDone)
+	}()
+	select {
+	case <-backgroundDone:
+	case <-ctx.Done():
+		log.Printf("shutdown background work: %v", ctx.Err())
+		if err == nil {
+			err = ctx.Err()
 		}
 	}
-}
 
-func (s *Server) withAuth(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		_, ok := s.currentUserID(r)
-		if !ok {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
+	if cerr := s.db.Close(); cerr != nil {
+		log.Printf("close db: %v", cerr)
+		if err == nil {
+			err = cerr
 		}
-		next(w, r)
 	}
+	return err
 }
 
-func (s *Server) currentUserID(r *http.Request) (int64, bool) {
-	c, err := r.Cookie("user_id")
-	if err != nil {
-		return 0, false
-	}
-	id, err := strconv.ParseInt(c.Value, 10, 64)
-	if err != nil || id <= 0 {
-		return 0, false
-	}
-	return id, true
+func (s *Server) registerRoutes() {
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	s.mux.HandleFunc("/api/internal/accrual/callback", s.handleAccrualCallback)
+	s.mux.HandleFunc("/api/user/register", s.handleRegister)
+	s.mux.HandleFunc("/api/user/login", s.handleLogin)
+	s.mux.HandleFunc("/api/user/login/2fa", s.handleVerifySecondFactor)
+	s.mux.HandleFunc("/api/user/oidc/start", s.handleOIDCStart)
+	s.mux.HandleFunc("/api/user/oidc/callback", s.handleOIDCCallback)
+	s.mux.HandleFunc("/api/user/oidc/link", s.withInteractiveAuth(s.handleOIDCLink))
+	s.mux.HandleFunc("/api/user", s.withInteractiveAuth(s.handleDeleteAccount))
+	s.mux.HandleFunc("/api/user/export", s.withInteractiveAuth(s.handleExport))
+	s.mux.HandleFunc("/api/user/logout", s.withInteractiveAuth(s.handleLogout))
+	s.mux.HandleFunc("/api/user/logout/all", s.withInteractiveAuth(s.handleLogoutAll))
+	s.mux.HandleFunc("/api/user/password", s.withInteractiveAuth(s.handleChangePassword))
+	s.mux.HandleFunc("/api/user/password/reset", s.handleRequestPasswordReset)
+	s.mux.HandleFunc("/api/user/password/reset/confirm", s.handleConfirmPasswordReset)
+	s.mux.HandleFunc("/api/user/2fa/enroll", s.withInteractiveAuth(s.handleEnrollTOTP))
+	s.mux.HandleFunc("/api/user/2fa/confirm", s.withInteractiveAuth(s.handleConfirmTOTP))
+	s.mux.HandleFunc("/api/user/api-keys", s.withInteractiveAuth(s.handleAPIKeys))
+	s.mux.HandleFunc("/api/user/api-keys/{id}", s.withInteractiveAuth(s.handleRevokeAPIKey))
+
+	s.mux.HandleFunc("/api/admin/users/{id}", s.withStaffAuth(s.handleAdminUser, roleSupport, roleAdmin))
+	s.mux.HandleFunc("/api/admin/users/{id}/orders", s.withStaffAuth(s.handleAdminUserOrders, roleSupport, roleAdmin))
+	s.mux.HandleFunc("/api/admin/users/{id}/balance", s.withStaffAuth(s.handleAdminUserBalance, roleSupport, roleAdmin))
+	s.mux.HandleFunc("/api/admin/users/{id}/withdrawals", s.withStaffAuth(s.handleAdminUserWithdrawals, roleSupport, roleAdmin))
+	s.mux.HandleFunc("/api/admin/users/{id}/ledger", s.withStaffAuth(s.handleAdminUserLedger, roleSupport, roleAdmin))
+	s.mux.HandleFunc("/api/admin/users/{id}/ledger/adjustments", s.withStaffAuth(s.handleAdminLedgerAdjustment, roleAdmin))
+	s.mux.HandleFunc("/api/admin/ledger/reconciliation", s.withStaffAuth(s.handleAdminLedgerReconciliation, roleSupport, roleAdmin))
+	s.mux.HandleFunc("/api/admin/users/{id}/sessions/revoke", s.withStaffAuth(s.handleAdminRevokeSessions, roleAdmin))
+	s.mux.HandleFunc("/api/admin/users/{id}/role", s.withStaffAuth(s.handleAdminSetRole, roleAdmin))
+	s.mux.HandleFunc("/api/admin/orders/parked", s.withStaffAuth(s.handleAdminParkedOrders, roleSupport, roleAdmin))
+	s.mux.HandleFunc("/api/admin/orders/{number}/reprocess", s.withStaffAuth(s.handleAdminReprocessOrder, roleAdmin))
+	s.mux.HandleFunc("/api/admin/orders/{number}/requeue", s.withStaffAuth(s.handleAdminRequeueOrder, roleAdmin))
+	s.mux.HandleFunc("/api/admin/accrual/limiter", s.withStaffAuth(s.handleAdminAccrualLimiter, roleSupport, roleAdmin))
+
+	s.mux.HandleFunc("/api/user/orders", s.withAuth(s.withIdempotency(s.handleOrders)))
+	s.mux.HandleFunc("/api/user/balance", s.withAuth(s.handleBalance))
+	s.mux.HandleFunc("/api/user/balance/withdraw", s.withAuth(s.withIdempotency(s.handleWithdraw)))
+	s.mux.HandleFunc("/api/user/balance/history", s.withAuth(s.handleLedger))
+	s.mux.HandleFunc("/api/user/withdrawals", s.withAuth(s.handleWithdrawals))
 }
 
 type credentials struct {
@@ -248,8 +296,10 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	if cred.Login == "" || cred.Password == "" {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+
+	violations := append(s.policy.CheckLogin(cred.Login), s.policy.CheckPassword(cred.Password, cred.Login)...)
+	if len(violations) > 0 {
+		writePolicyViolations(w, violations)
 		return
 	}
 
@@ -277,10 +327,25 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.setUserCookie(w, userID)
+	if err := s.startSession(ctx, w, userID); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
+type policyErrorResponse struct {
+	Errors []policy.Violation `json:"errors"`
+}
+
+func writePolicyViolations(w http.ResponseWriter, violations []policy.Violation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(policyErrorResponse{Errors: violations}); err != nil {
+		log.Printf("write policy violations: %v", err)
+	}
+}
+
 func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -300,40 +365,64 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
+	ip := clientIP(r)
+
+	lockedFor, err := s.loginLockedFor(ctx, cred.Login, ip)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if lockedFor > 0 {
+		writeTooManyRequests(w, lockedFor)
+		return
+	}
+
 	var (
 		userID       int64
 		passwordHash string
 	)
-	err := s.db.QueryRowContext(
+	err = s.db.QueryRowContext(
 		ctx,
-		`SELECT id, password_hash FROM users WHERE login = $1`,
+		`SELECT id, password_hash FROM users WHERE lower(login) = lower($1)`,
 		cred.Login,
 	).Scan(&userID, &passwordHash)
-	if errors.Is(err, sql.ErrNoRows) {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(cred.Password)) != nil {
+		if err := s.recordLoginFailure(ctx, cred.Login, ip); err != nil {
+			log.Printf("record login failure: %v", err)
+		}
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
+
+	secondFactor, err := s.totpEnabled(ctx, userID)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(cred.Password)); err != nil {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	// With a second factor the login is not done yet: the counter is reset
+	// once the code is verified, so fresh challenges do not bring fresh
+	// guesses.
+	if secondFactor {
+		if err := s.startLoginChallenge(ctx, w, userID); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
 		return
 	}
 
-	s.setUserCookie(w, userID)
-	w.WriteHeader(http.StatusOK)
-}
+	if err := s.resetLoginFailures(ctx, cred.Login); err != nil {
+		log.Printf("reset login failures: %v", err)
+	}
 
-func (s *Server) setUserCookie(w http.ResponseWriter, userID int64) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "user_id",
-		Value:    strconv.FormatInt(userID, 10),
-		Path:     "/",
-		HttpOnly: true,
-	})
+	if err := s.startSession(ctx, w, userID); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
 func (s *Server) handleOrders(w http.ResponseWriter, r *http.Request) {
@@ -389,11 +478,48 @@ func (s *Server) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var usedByWithdrawal bool
+	if err := s.db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM withdrawals WHERE "order" = $1)`,
+		number,
+	).Scan(&usedByWithdrawal); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if usedByWithdrawal {
+		http.Error(w, "order number was already used for a withdrawal", http.StatusConflict)
+		return
+	}
+
+	// With callbacks enabled the accrual system gets a window to report the
+	// order before it is polled.
+	now := time.Now()
 	_, err = s.db.ExecContext(
 		ctx,
-		`INSERT INTO orders (user_id, number, status, uploaded_at) VALUES ($1, $2, $3, $4)`,
-		userID, number, "NEW", time.Now(),
+		`INSERT INTO orders (user_id, number, status, uploaded_at, next_check_at) VALUES ($1, $2, $3, $4, $5)`,
+		userID, number, "NEW", now, now.Add(s.accrualCallbackWindow()),
 	)
+	if isUniqueViolation(err) {
+		// Another request got the number in first. When it was the same
+		// user this is a repeated upload, not a conflict.
+		err = s.db.QueryRowContext(
+			ctx,
+			`SELECT user_id FROM orders WHERE number = $1`,
+			number,
+		).Scan(&existingUserID)
+		switch {
+		case err == nil && existingUserID == userID:
+			w.WriteHeader(http.StatusOK)
+		case err == nil:
+			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, "order number is already in use", http.StatusConflict)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
@@ -404,6 +530,10 @@ func (s *Server) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleListOrders(w http.ResponseWriter, r *http.Request) {
 	userID, _ := s.currentUserID(r)
+	s.writeOrders(w, r, userID)
+}
+
+func (s *Server) writeOrders(w http.ResponseWriter, r *http.Request, userID int64) {
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
@@ -423,10 +553,10 @@ func (s *Server) handleListOrders(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	type orderResponse struct {
-		Number     string   `json:"number"`
-		Status     string   `json:"status"`
-		Accrual    *float64 `json:"accrual,omitempty"`
-		UploadedAt string   `json:"uploaded_at"`
+		Number     string        `json:"number"`
+		Status     string        `json:"status"`
+		Accrual    *money.Amount `json:"accrual,omitempty"`
+		UploadedAt string        `json:"uploaded_at"`
 	}
 
 	var orders []orderResponse
@@ -434,17 +564,16 @@ func (s *Server) handleListOrders(w http.ResponseWriter, r *http.Request) {
 		var (
 			number     string
 			status     string
-			accrual    sql.NullFloat64
+			accrual    sql.Null[money.Amount]
 			uploadedAt time.Time
 		)
 		if err := rows.Scan(&number, &status, &accrual, &uploadedAt); err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-		var accrualPtr *float64
+		var accrualPtr *money.Amount
 		if accrual.Valid {
-			v := accrual.Float64
-			accrualPtr = &v
+			accrualPtr = &accrual.V
 		}
 		orders = append(orders, orderResponse{
 			Number:     number,
@@ -471,8 +600,8 @@ func (s *Server) handleListOrders(w http.ResponseWriter, r *http.Request) {
 }
 
 type balanceResponse struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   money.Amount `json:"current"`
+	Withdrawn money.Amount `json:"withdrawn"`
 }
 
 func (s *Server) handleBalance(w http.ResponseWriter, r *http.Request) {
@@ -482,36 +611,21 @@ func (s *Server) handleBalance(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID, _ := s.currentUserID(r)
+	s.writeBalance(w, r, userID)
+}
 
+func (s *Server) writeBalance(w http.ResponseWriter, r *http.Request, userID int64) {
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	var accrued float64
-	if err := s.db.QueryRowContext(
-		ctx,
-		`SELECT COALESCE(SUM(accrual), 0)
-		 FROM orders
-		 WHERE user_id = $1 AND status = 'PROCESSED'`,
-		userID,
-	).Scan(&accrued); err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-	}
-
-	var withdrawn float64
-	if err := s.db.QueryRowContext(
-		ctx,
-		`SELECT COALESCE(SUM(sum), 0)
-		 FROM withdrawals
-		 WHERE user_id = $1`,
-		userID,
-	).Scan(&withdrawn); err != nil {
+	current, withdrawn, err := ledgerBalance(ctx, s.db, userID)
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	resp := balanceResponse{
-		Current:   accrued - withdrawn,
+		Current:   current,
 		Withdrawn: withdrawn,
 	}
 
@@ -523,8 +637,8 @@ func (s *Server) handleBalance(w http.ResponseWriter, r *http.Request) {
 }
 
 type withdrawRequest struct {
-	Order string  `json:"order"`
-	Sum   float64 `json:"sum"`
+	Order string       `json:"order"`
+	Sum   money.Amount `json:"sum"`
 }
 
 func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
@@ -541,7 +655,7 @@ func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Order == "" || req.Sum <= 0 {
+	if req.Order == "" || req.Sum.Sign() <= 0 {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
@@ -561,42 +675,62 @@ func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	var accrued float64
+	// The database enforces the same rules; checking first gives a clearer
+	// answer than a constraint violation.
+	var usedByOrder, usedByWithdrawal bool
 	if err := tx.QueryRowContext(
 		ctx,
-		`SELECT COALESCE(SUM(accrual), 0)
-		 FROM orders
-		 WHERE user_id = $1 AND status = 'PROCESSED'`,
-		userID,
-	).Scan(&accrued); err != nil {
+		`SELECT EXISTS (SELECT 1 FROM orders WHERE number = $1),
+		        EXISTS (SELECT 1 FROM withdrawals WHERE "order" = $1)`,
+		req.Order,
+	).Scan(&usedByOrder, &usedByWithdrawal); err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	switch {
+	case usedByWithdrawal:
+		http.Error(w, "order number was already used for a withdrawal", http.StatusConflict)
+		return
+	case usedByOrder:
+		http.Error(w, "order number belongs to an uploaded order", http.StatusConflict)
+		return
+	}
 
-	var withdrawn float64
-	if err := tx.QueryRowContext(
-		ctx,
-		`SELECT COALESCE(SUM(sum), 0)
-		 FROM withdrawals
-		 WHERE user_id = $1`,
-		userID,
-	).Scan(&withdrawn); err != nil {
+	// Concurrent withdrawals of the same user queue up here, so each one sees
+	// the balance left by the previous.
+	current, _, err := lockBalance(ctx, tx, userID)
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-
-	current := accrued - withdrawn
-	if current < req.Sum {
+	if current.Cmp(req.Sum) < 0 {
 		http.Error(w, http.StatusText(http.StatusPaymentRequired), http.StatusPaymentRequired)
 		return
 	}
 
-	if _, err := tx.ExecContext(
+	var withdrawalID int64
+	if err := tx.QueryRowContext(
 		ctx,
-		`INSERT INTO withdrawals (user_id, order, sum, processed_at)
-		 VALUES ($1, $2, $3, $4)`,
+		`INSERT INTO withdrawals (user_id, "order", sum, processed_at)
+		 VALUES ($1, $2, $3, $4)
+		 RETURNING id`,
 		userID, req.Order, req.Sum, time.Now(),
-	); err != nil {
+	).Scan(&withdrawalID); err != nil {
+		if isUniqueViolation(err) {
+			http.Error(w, "order number is already in use", http.StatusConflict)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := postLedger(ctx, tx, ledgerPosting{
+		UserID:       userID,
+		Kind:         ledgerWithdrawal,
+		WithdrawalID: withdrawalID,
+		Amount:       req.Sum.Neg(),
+	}); err != nil {
+		log.Printf("withdraw: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -616,13 +750,17 @@ func (s *Server) handleWithdrawals(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID, _ := s.currentUserID(r)
+	s.writeWithdrawals(w, r, userID)
+}
+
+func (s *Server) writeWithdrawals(w http.ResponseWriter, r *http.Request, userID int64) {
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
 	rows, err := s.db.QueryContext(
 		ctx,
-		`SELECT order, sum, processed_at
+		`SELECT "order", sum, processed_at
 		 FROM withdrawals
 		 WHERE user_id = $1
 		 ORDER BY processed_at DESC`,
@@ -635,16 +773,16 @@ func (s *Server) handleWithdrawals(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	type withdrawalResponse struct {
-		Order       string  `json:"order"`
-		Sum         float64 `json:"sum"`
-		ProcessedAt string  `json:"processed_at"`
+		Order       string       `json:"order"`
+		Sum         money.Amount `json:"sum"`
+		ProcessedAt string       `json:"processed_at"`
 	}
 
 	var items []withdrawalResponse
 	for rows.Next() {
 		var (
 			order       string
-			sum         float64
+			sum         money.Amount
 			processedAt time.Time
 		)
 		if err := rows.Scan(&order, &sum, &processedAt); err != nil {
@@ -703,6 +841,12 @@ func isUniqueViolation(err error) bool {
 	if err == nil {
 		return false
 	}
+	// pgx errors carry the SQLSTATE, which also covers unique violations
+	// raised by triggers.
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) && pgErr.SQLState() == "23505" {
+		return true
+	}
 	const duplicateKey = "duplicate key value violates unique constraint"
 	return strings.Contains(err.Error(), duplicateKey)
 }
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ctxKey int
+
+const sessionCtxKey ctxKey = iota
+
+// session is the authenticated principal of a request: either a cookie
+// session (ID set) or an API key (APIKeyID set).
+type session struct {
+	ID     string
+	UserID int64
+	Role   string
+
+	APIKeyID int64
+	ReadOnly bool
+}
+
+func withSession(ctx context.Context, sess *session) context.Context {
+	return context.WithValue(ctx, sessionCtxKey, sess)
+}
+
+func sessionFromContext(ctx context.Context) (*session, bool) {
+	sess, ok := ctx.Value(sessionCtxKey).(*session)
+	return sess, ok
+}
+
+func (s *Server) withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := bearerToken(r); ok {
+			s.serveWithAPIKey(w, r, token, next)
+			return
+		}
+
+		sess, err := s.authenticate(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(withSession(r.Context(), sess)))
+	}
+}
+
+// withInteractiveAuth is withAuth for account management endpoints that must
+// not be reachable with an API key.
+func (s *Server) withInteractiveAuth(next http.HandlerFunc) http.HandlerFunc {
+	return s.withAuth(func(w http.ResponseWriter, r *http.Request) {
+		if sess, _ := sessionFromContext(r.Context()); sess.APIKeyID != 0 {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// authenticate verifies the token signature and then checks the backing
+// session row, so a revoked or idle session is rejected even while its token
+// is still cryptographically valid.
+func (s *Server) authenticate(r *http.Request) (*session, error) {
+	c, err := r.Cookie(authCookieName)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := s.tokens.Parse(c.Value)
+	if err != nil {
+		return nil, err
+	}
+	if claims.SessionID == "" {
+		return nil, errors.New("token has no session")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	var (
+		userID int64
+		role   string
+	)
+	err = s.db.QueryRowContext(
+		ctx,
+		`UPDATE sessions
+		 SET last_seen_at = $2
+		 FROM users
+		 WHERE sessions.id = $1
+		   AND users.id = sessions.user_id
+		   AND users.deleted_at IS NULL
+		   AND sessions.revoked_at IS NULL
+		   AND sessions.expires_at > $2
+		   AND sessions.last_seen_at > $3
+		 RETURNING sessions.user_id, users.role`,
+		claims.SessionID, now, now.Add(-s.sessionIdleTimeout()),
+	).Scan(&userID, &role)
+	if err != nil {
+		return nil, fmt.Errorf("load session: %w", err)
+	}
+	if userID != claims.UserID {
+		return nil, errors.New("session belongs to another user")
+	}
+
+	return &session{ID: claims.SessionID, UserID: userID, Role: role}, nil
+}
+
+func (s *Server) sessionIdleTimeout() time.Duration {
+	if s.cfg.SessionIdleTimeout > 0 {
+		return s.cfg.SessionIdleTimeout
+	}
+	return 30 * time.Minute
+}
+
+func (s *Server) currentUserID(r *http.Request) (int64, bool) {
+	sess, ok := sessionFromContext(r.Context())
+	if !ok {
+		return 0, false
+	}
+	return sess.UserID, true
+}
+
+func (s *Server) startSession(ctx context.Context, w http.ResponseWriter, userID int64) error {
+	sessionID, err := newRandomID()
+	if err != nil {
+		return fmt.Errorf("generate session id: %w", err)
+	}
+
+	now := time.Now()
+	if _, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO sessions (id, user_id, created_at, last_seen_at, expires_at)
+		 VALUES ($1, $2, $3, $3, $4)`,
+		sessionID, userID, now, now.Add(s.tokens.TTL()),
+	); err != nil {
+		return fmt.Errorf("insert session: %w", err)
+	}
+
+	token, err := s.tokens.Issue(userID, sessionID)
+	if err != nil {
+		return fmt.Errorf("issue token: %w", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(s.tokens.TTL().Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func clearAuthCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func revokeUserSessions(ctx context.Context, ex execer, userID int64, exceptSessionID string) error {
+	_, err := ex.ExecContext(
+		ctx,
+		`UPDATE sessions
+		 SET revoked_at = now()
+		 WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL`,
+		userID, exceptSessionID,
+	)
+	return err
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	sess, _ := sessionFromContext(r.Context())
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(
+		ctx,
+		`UPDATE sessions SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`,
+		sess.ID,
+	); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	clearAuthCookie(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	sess, _ := sessionFromContext(r.Context())
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := revokeUserSessions(ctx, s.db, sess.UserID, ""); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	clearAuthCookie(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func newRandomID() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
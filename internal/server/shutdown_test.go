@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"gophermart/internal/config"
+)
+
+func TestServer_Shutdown_drainsRequests(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	mock.ExpectClose()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	s := &Server{cfg: &config.Config{}, db: db, mux: http.NewServeMux(), accrualDone: make(chan struct{})}
+	s.mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	s.httpServer = &http.Server{Handler: s.mux}
+	s.stopAccrual = func() { close(s.accrualDone) }
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- s.httpServer.Serve(ln) }()
+
+	respCh := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			respCh <- 0
+			return
+		}
+		resp.Body.Close()
+		respCh <- resp.StatusCode
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	if code := <-respCh; code != http.StatusOK {
+		t.Errorf("in-flight request status = %d, want %d", code, http.StatusOK)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Serve() error = %v, want http.ErrServerClosed", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("database not closed: %v", err)
+	}
+}
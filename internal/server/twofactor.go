@@ -0,0 +1,404 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gophermart/internal/totp"
+)
+
+const (
+	loginChallengeTTL         = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+	recoveryCodeCount         = 10
+)
+
+type enrollTOTPResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+func (s *Server) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if s.totpBox == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	userID, _ := s.currentUserID(r)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var login string
+	if err := s.db.QueryRowContext(
+		ctx,
+		`SELECT login FROM users WHERE id = $1`,
+		userID,
+	).Scan(&login); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	sealed, err := s.totpBox.Seal(secret)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Re-enrolling replaces a pending secret but never a confirmed one.
+	res, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO user_totp (user_id, secret_enc) VALUES ($1, $2)
+		 ON CONFLICT (user_id) DO UPDATE
+		 SET secret_enc = EXCLUDED.secret_enc, created_at = now()
+		 WHERE user_totp.confirmed_at IS NULL`,
+		userID, sealed,
+	)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(enrollTOTPResponse{
+		Secret:     secret,
+		OTPAuthURI: totp.URI(s.totpIssuer(), login, secret),
+	}); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func (s *Server) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if s.totpBox == nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	userID, _ := s.currentUserID(r)
+
+	var req totpCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var (
+		sealed    string
+		confirmed bool
+	)
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT secret_enc, confirmed_at IS NOT NULL FROM user_totp WHERE user_id = $1`,
+		userID,
+	).Scan(&sealed, &confirmed)
+	if errors.Is(err, sql.ErrNoRows) || confirmed {
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := s.totpBox.Open(sealed)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	step, ok := totp.Validate(secret, req.Code, time.Now(), 1)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		id, err := newRandomID()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		codes = append(codes, id[:5]+"-"+id[5:10])
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`UPDATE user_totp SET confirmed_at = now(), last_used_step = $2 WHERE user_id = $1`,
+		userID, step,
+	); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	for _, c := range codes {
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID, hashToken(c),
+		); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(recoveryCodesResponse{RecoveryCodes: codes}); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) totpEnabled(ctx context.Context, userID int64) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)`,
+		userID,
+	).Scan(&enabled)
+	return enabled, err
+}
+
+type secondFactorResponse struct {
+	Status    string `json:"status"`
+	Challenge string `json:"challenge"`
+}
+
+// startLoginChallenge answers a correct password for a 2FA account: instead of
+// a session the client gets a short-lived challenge to redeem with a code.
+func (s *Server) startLoginChallenge(ctx context.Context, w http.ResponseWriter, userID int64) error {
+	challenge, err := newRandomID()
+	if err != nil {
+		return fmt.Errorf("generate challenge: %w", err)
+	}
+
+	if _, err := s.db.ExecContext(
+		ctx,
+		`INSERT INTO login_challenges (id, user_id, expires_at) VALUES ($1, $2, $3)`,
+		hashToken(challenge), userID, time.Now().Add(loginChallengeTTL),
+	); err != nil {
+		return fmt.Errorf("insert challenge: %w", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(secondFactorResponse{
+		Status:    "second_factor_required",
+		Challenge: challenge,
+	}); err != nil {
+		log.Printf("write login challenge: %v", err)
+	}
+	return nil
+}
+
+type verifySecondFactorRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+func (s *Server) handleVerifySecondFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	var req verifySecondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Challenge == "" || req.Code == "" {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	challengeID := hashToken(req.Challenge)
+
+	// The attempt is counted before the code is checked so a challenge cannot
+	// be used to brute-force codes.
+	var (
+		userID int64
+		login  string
+	)
+	err := s.db.QueryRowContext(
+		ctx,
+		`UPDATE login_challenges c
+		 SET attempts = c.attempts + 1
+		 FROM users u
+		 WHERE c.id = $1 AND c.expires_at > now() AND c.attempts < $2 AND u.id = c.user_id
+		 RETURNING c.user_id, u.login`,
+		challengeID, loginChallengeMaxAttempts,
+	).Scan(&userID, &login)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Wrong codes count against the same lockout as wrong passwords, so
+	// asking for new challenges does not buy more guesses.
+	ip := clientIP(r)
+	lockedFor, err := s.loginLockedFor(ctx, login, ip)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if lockedFor > 0 {
+		writeTooManyRequests(w, lockedFor)
+		return
+	}
+
+	ok, err := s.checkSecondFactor(ctx, userID, req.Code)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		if err := s.recordLoginFailure(ctx, login, ip); err != nil {
+			log.Printf("record login failure: %v", err)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.resetLoginFailures(ctx, login); err != nil {
+		log.Printf("reset login failures: %v", err)
+	}
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM login_challenges WHERE id = $1`, challengeID); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.startSession(ctx, w, userID); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// checkSecondFactor accepts either a current TOTP code, which may be used only
+// once, or an unused recovery code.
+func (s *Server) checkSecondFactor(ctx context.Context, userID int64, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+
+	if len(code) == totp.Digits {
+		if s.totpBox == nil {
+			return false, nil
+		}
+
+		var sealed string
+		err := s.db.QueryRowContext(
+			ctx,
+			`SELECT secret_enc FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL`,
+			userID,
+		).Scan(&sealed)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("load totp secret: %w", err)
+		}
+
+		secret, err := s.totpBox.Open(sealed)
+		if err != nil {
+			return false, fmt.Errorf("decrypt totp secret: %w", err)
+		}
+
+		step, ok := totp.Validate(secret, code, time.Now(), 1)
+		if !ok {
+			return false, nil
+		}
+
+		res, err := s.db.ExecContext(
+			ctx,
+			`UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2`,
+			userID, step,
+		)
+		if err != nil {
+			return false, fmt.Errorf("update totp step: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return false, fmt.Errorf("update totp step: %w", err)
+		}
+		return n == 1, nil
+	}
+
+	res, err := s.db.ExecContext(
+		ctx,
+		`UPDATE recovery_codes SET used_at = now()
+		 WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, hashToken(strings.ToLower(code)),
+	)
+	if err != nil {
+		return false, fmt.Errorf("use recovery code: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("use recovery code: %w", err)
+	}
+	return n == 1, nil
+}
+
+func (s *Server) totpIssuer() string {
+	if s.cfg.TOTPIssuer != "" {
+		return s.cfg.TOTPIssuer
+	}
+	return "Gophermart"
+}
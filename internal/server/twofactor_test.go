@@ -0,0 +1,440 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+
+	"gophermart/internal/config"
+	"gophermart/internal/secretbox"
+	"gophermart/internal/totp"
+)
+
+func newTestBox(t *testing.T) *secretbox.Box {
+	t.Helper()
+	box, err := secretbox.New("test-totp-key")
+	if err != nil {
+		t.Fatalf("secretbox.New() error = %v", err)
+	}
+	return box
+}
+
+func TestServer_handleEnrollTOTP(t *testing.T) {
+	tests := []struct {
+		name           string
+		rowsAffected   int64
+		wantStatusCode int
+	}{
+		{name: "new enrollment", rowsAffected: 1, wantStatusCode: http.StatusOK},
+		{name: "already confirmed", rowsAffected: 0, wantStatusCode: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			mock.ExpectQuery(`SELECT login FROM users WHERE id = \$1`).
+				WithArgs(int64(1)).
+				WillReturnRows(sqlmock.NewRows([]string{"login"}).AddRow("alice"))
+			mock.ExpectExec(`INSERT INTO user_totp`).
+				WithArgs(int64(1), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, tt.rowsAffected))
+
+			s := &Server{
+				cfg:     &config.Config{},
+				db:      db,
+				mux:     http.NewServeMux(),
+				totpBox: newTestBox(t),
+			}
+
+			req := withTestUser(httptest.NewRequest(http.MethodPost, "/api/user/2fa/enroll", nil), 1)
+			w := httptest.NewRecorder()
+
+			s.handleEnrollTOTP(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Fatalf("handleEnrollTOTP() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+
+			if w.Code == http.StatusOK {
+				var resp enrollTOTPResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatalf("decode response: %v", err)
+				}
+				if resp.Secret == "" || resp.OTPAuthURI != totp.URI("Gophermart", "alice", resp.Secret) {
+					t.Errorf("handleEnrollTOTP() = %+v", resp)
+				}
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+func TestServer_handleEnrollTOTP_disabled(t *testing.T) {
+	s := &Server{cfg: &config.Config{}, mux: http.NewServeMux()}
+
+	req := withTestUser(httptest.NewRequest(http.MethodPost, "/api/user/2fa/enroll", nil), 1)
+	w := httptest.NewRecorder()
+
+	s.handleEnrollTOTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("handleEnrollTOTP() status = %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestServer_handleConfirmTOTP(t *testing.T) {
+	box := newTestBox(t)
+	secret, _ := totp.GenerateSecret()
+	sealed, _ := box.Seal(secret)
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT secret_enc, confirmed_at IS NOT NULL FROM user_totp`).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"secret_enc", "confirmed"}).AddRow(sealed, false))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE user_totp SET confirmed_at = now\(\)`).
+		WithArgs(int64(1), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM recovery_codes`).
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < recoveryCodeCount; i++ {
+		mock.ExpectExec(`INSERT INTO recovery_codes`).
+			WithArgs(int64(1), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	s := &Server{
+		cfg:     &config.Config{},
+		db:      db,
+		mux:     http.NewServeMux(),
+		totpBox: box,
+	}
+
+	bodyBytes, _ := json.Marshal(totpCodeRequest{Code: code})
+	req := withTestUser(httptest.NewRequest(http.MethodPost, "/api/user/2fa/confirm", bytes.NewReader(bodyBytes)), 1)
+	w := httptest.NewRecorder()
+
+	s.handleConfirmTOTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("handleConfirmTOTP() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	var resp recoveryCodesResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(resp.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("handleConfirmTOTP() returned %d recovery codes, want %d", len(resp.RecoveryCodes), recoveryCodeCount)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestServer_handleLogin_secondFactorRequired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+
+	expectNoLockout(mock)
+	mock.ExpectQuery(`SELECT id, password_hash FROM users`).
+		WithArgs("testuser").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash"}).AddRow(1, string(hash)))
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_totp`).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec(`INSERT INTO login_challenges`).
+		WithArgs(sqlmock.AnyArg(), int64(1), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	s := &Server{
+		cfg:    &config.Config{},
+		db:     db,
+		mux:    http.NewServeMux(),
+		tokens: newTestSigner(t),
+	}
+
+	bodyBytes, _ := json.Marshal(credentials{Login: "testuser", Password: "testpass"})
+	req := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewReader(bodyBytes))
+	w := httptest.NewRecorder()
+
+	s.handleLogin(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("handleLogin() status = %v, want %v", w.Code, http.StatusAccepted)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == authCookieName {
+			t.Error("handleLogin() issued a session before the second factor")
+		}
+	}
+
+	var resp secondFactorResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Status != "second_factor_required" || resp.Challenge == "" {
+		t.Errorf("handleLogin() = %+v", resp)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
+
+func TestServer_handleVerifySecondFactor(t *testing.T) {
+	box := newTestBox(t)
+	secret, _ := totp.GenerateSecret()
+	sealed, _ := box.Seal(secret)
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+
+	expectChallenge := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(`UPDATE login_challenges c\s+SET attempts = c.attempts \+ 1`).
+			WithArgs(hashToken("challenge"), loginChallengeMaxAttempts).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "login"}).AddRow(1, "alice"))
+		expectNoLockout(mock)
+	}
+	expectSession := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(`DELETE FROM login_attempts`).
+			WithArgs("alice").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`DELETE FROM login_challenges`).
+			WithArgs(hashToken("challenge")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO sessions`).
+			WithArgs(sqlmock.AnyArg(), int64(1), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	tests := []struct {
+		name           string
+		code           string
+		setupMock      func(mock sqlmock.Sqlmock)
+		wantStatusCode int
+	}{
+		{
+			name: "valid totp code",
+			code: code,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock)
+				mock.ExpectQuery(`SELECT secret_enc FROM user_totp`).
+					WithArgs(int64(1)).
+					WillReturnRows(sqlmock.NewRows([]string{"secret_enc"}).AddRow(sealed))
+				mock.ExpectExec(`UPDATE user_totp SET last_used_step`).
+					WithArgs(int64(1), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectSession(mock)
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "replayed totp code",
+			code: code,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock)
+				mock.ExpectQuery(`SELECT secret_enc FROM user_totp`).
+					WithArgs(int64(1)).
+					WillReturnRows(sqlmock.NewRows([]string{"secret_enc"}).AddRow(sealed))
+				mock.ExpectExec(`UPDATE user_totp SET last_used_step`).
+					WithArgs(int64(1), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name: "recovery code",
+			code: "ABCDE-12345",
+			setupMock: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock)
+				mock.ExpectExec(`UPDATE recovery_codes SET used_at = now\(\)`).
+					WithArgs(int64(1), hashToken("abcde-12345")).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectSession(mock)
+			},
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name: "expired or exhausted challenge",
+			code: code,
+			setupMock: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE login_challenges`).
+					WithArgs(hashToken("challenge"), loginChallengeMaxAttempts).
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+
+			tt.setupMock(mock)
+
+			s := &Server{
+				cfg:     &config.Config{},
+				db:      db,
+				mux:     http.NewServeMux(),
+				tokens:  newTestSigner(t),
+				totpBox: box,
+			}
+
+			bodyBytes, _ := json.Marshal(verifySecondFactorRequest{Challenge: "challenge", Code: tt.code})
+			req := httptest.NewRequest(http.MethodPost, "/api/user/login/2fa", bytes.NewReader(bodyBytes))
+			w := httptest.NewRecorder()
+
+			s.handleVerifySecondFactor(w, req)
+
+			if w.Code != tt.wantStatusCode {
+				t.Errorf("handleVerifySecondFactor() status = %v, want %v", w.Code, tt.wantStatusCode)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("mock expectations not met: %v", err)
+			}
+		})
+	}
+}
+
+// Wrong codes count towards the login lockout, so a client that knows the
+// password cannot keep asking for new challenges to get more guesses.
+func TestServer_handleVerifySecondFactor_lockout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error = %v", err)
+	}
+	defer db.Close()
+
+	box := newTestBox(t)
+	secret, _ := totp.GenerateSecret()
+	sealed, _ := box.Seal(secret)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	wrong := "000000"
+	if _, ok := totp.Validate(secret, wrong, time.Now(), 2); ok {
+		wrong = "111111"
+	}
+
+	const threshold = 3
+	s := &Server{
+		cfg: &config.Config{
+			LoginMaxFailures: threshold,
+			LoginLockoutBase: time.Minute,
+			LoginLockoutMax:  time.Hour,
+		},
+		db:      db,
+		mux:     http.NewServeMux(),
+		tokens:  newTestSigner(t),
+		totpBox: box,
+	}
+
+	login := func() string {
+		t.Helper()
+		bodyBytes, _ := json.Marshal(credentials{Login: "alice", Password: "testpass"})
+		req := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewReader(bodyBytes))
+		req.RemoteAddr = "192.0.2.1:52000"
+		w := httptest.NewRecorder()
+		s.handleLogin(w, req)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("handleLogin() status = %v, want %v", w.Code, http.StatusAccepted)
+		}
+		var resp secondFactorResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return resp.Challenge
+	}
+
+	for failures := 1; failures <= threshold; failures++ {
+		expectNoLockout(mock)
+		mock.ExpectQuery(`SELECT id, password_hash FROM users`).
+			WithArgs("alice").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash"}).AddRow(1, string(hash)))
+		mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_totp`).
+			WithArgs(int64(1)).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectExec(`INSERT INTO login_challenges`).
+			WithArgs(sqlmock.AnyArg(), int64(1), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		challenge := login()
+
+		mock.ExpectQuery(`UPDATE login_challenges c`).
+			WithArgs(hashToken(challenge), loginChallengeMaxAttempts).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "login"}).AddRow(1, "alice"))
+		expectNoLockout(mock)
+		mock.ExpectQuery(`SELECT secret_enc FROM user_totp`).
+			WithArgs(int64(1)).
+			WillReturnRows(sqlmock.NewRows([]string{"secret_enc"}).AddRow(sealed))
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO login_attempts`).
+			WithArgs(lockoutScopeLogin, "alice", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(failures))
+		if failures == threshold {
+			mock.ExpectExec(`UPDATE login_attempts SET locked_until`).
+				WithArgs(lockoutScopeLogin, "alice", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO login_lockouts`).
+				WithArgs(lockoutScopeLogin, "alice", threshold, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		mock.ExpectCommit()
+
+		bodyBytes, _ := json.Marshal(verifySecondFactorRequest{Challenge: challenge, Code: wrong})
+		req := httptest.NewRequest(http.MethodPost, "/api/user/login/2fa", bytes.NewReader(bodyBytes))
+		req.RemoteAddr = "192.0.2.1:52000"
+		w := httptest.NewRecorder()
+		s.handleVerifySecondFactor(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("handleVerifySecondFactor() status = %v, want %v", w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// Locked out: the password alone no longer gets a challenge.
+	mock.ExpectQuery(`SELECT MAX\(locked_until\)\s+FROM login_attempts`).
+		WithArgs("alice", "192.0.2.1").
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(time.Now().Add(time.Minute)))
+	bodyBytes, _ := json.Marshal(credentials{Login: "alice", Password: "testpass"})
+	req := httptest.NewRequest(http.MethodPost, "/api/user/login", bytes.NewReader(bodyBytes))
+	req.RemoteAddr = "192.0.2.1:52000"
+	w := httptest.NewRecorder()
+	s.handleLogin(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("handleLogin() after wrong codes status = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("mock expectations not met: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 6238 appendix B (SHA-1 key).
+func TestHOTP_RFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "94287082"},
+		{unix: 1111111109, want: "07081804"},
+		{unix: 1111111111, want: "14050471"},
+		{unix: 1234567890, want: "89005924"},
+		{unix: 2000000000, want: "69279037"},
+		{unix: 20000000000, want: "65353130"},
+	}
+
+	for _, tt := range tests {
+		got := hotp(key, uint64(tt.unix/30), 8)
+		if got != tt.want {
+			t.Errorf("hotp(T=%d) = %v, want %v", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+
+	code, err := Code(secret, Step(now))
+	if err != nil {
+		t.Fatalf("Code() error = %v", err)
+	}
+	if code != "081804" {
+		t.Fatalf("Code() = %v, want 081804", code)
+	}
+
+	if step, ok := Validate(secret, code, now, 1); !ok || step != Step(now) {
+		t.Errorf("Validate() = (%v, %v), want (%v, true)", step, ok, Step(now))
+	}
+	if _, ok := Validate(secret, code, now.Add(Period), 1); !ok {
+		t.Error("Validate() one step later: want ok within skew")
+	}
+	if _, ok := Validate(secret, code, now.Add(3*Period), 1); ok {
+		t.Error("Validate() three steps later: want rejected")
+	}
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Error("Validate() short code: want rejected")
+	}
+}
+
+func TestGenerateSecretAndURI(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret() error = %v", err)
+	}
+	if _, err := Code(secret, 1); err != nil {
+		t.Fatalf("Code() with generated secret error = %v", err)
+	}
+
+	uri := URI("Gophermart", "alice", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Gophermart:alice?") {
+		t.Errorf("URI() = %v", uri)
+	}
+	if !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("URI() = %v, want secret parameter", uri)
+	}
+}